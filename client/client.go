@@ -2,10 +2,16 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,10 +19,15 @@ import (
 
 // Main entry point for the client application
 func main() {
+	addr := flag.String("addr", "localhost:9000", "server address")
+	useTLS := flag.Bool("tls", false, "connect with TLS")
+	caFile := flag.String("ca", "", "PEM certificate to trust for -tls, e.g. the server's self-signed cert (pins it)")
+	insecure := flag.Bool("insecure", false, "with -tls, skip certificate verification (testing only)")
+	flag.Parse()
 	// Print a startup message
 	fmt.Println("TCR Client starting...")
-	// Connect to the server at localhost:9000 using TCP
-	conn, err := net.Dial("tcp", "localhost:9000")
+	// Connect to the server, over TLS if asked
+	conn, err := dial(*addr, *useTLS, *caFile, *insecure)
 	if err != nil {
 		// If connection fails, print error and exit
 		fmt.Println("Unable to connect to server:", err)
@@ -30,10 +41,16 @@ func main() {
 	reader := bufio.NewReader(os.Stdin)
 	// Create a scanner to read messages from the server
 	serverScanner := bufio.NewScanner(conn)
+	serverScanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // Replays arrive as one long line
+	// "client replay <id>" plays back a recorded match instead of showing the menus
+	if args := flag.Args(); len(args) >= 2 && args[0] == "replay" {
+		playReplay(bufio.NewReader(os.Stdin), serverScanner, conn, args[1])
+		return
+	}
 	// Login/Register loop
 	for {
 		// Show login/register menu
-		fmt.Println("1. Login\n2. Register\nChoose:")
+		fmt.Println("1. Login\n2. Register\n3. Resume session\nChoose:")
 		// Read user choice
 		choice, _ := reader.ReadString('\n')
 		choice = strings.TrimSpace(choice)
@@ -59,6 +76,16 @@ func main() {
 			msg := fmt.Sprintf("REGISTER|%s|%s", strings.TrimSpace(user), strings.TrimSpace(pass))
 			// Send register message to server
 			conn.Write([]byte(msg + "\n"))
+		} else if choice == "3" {
+			// Prompt for the session token printed at login
+			fmt.Print("Session token: ")
+			token, _ := reader.ReadString('\n')
+			// Send resume message to server
+			conn.Write([]byte("RESUME|" + strings.TrimSpace(token) + "\n"))
+			if resumeSession(serverScanner, conn) {
+				break
+			}
+			continue
 		} else {
 			// Invalid choice, prompt again
 			fmt.Println("Invalid choice.")
@@ -68,7 +95,13 @@ func main() {
 		for serverScanner.Scan() {
 			msg := serverScanner.Text()
 			fmt.Println(msg)
-			if strings.HasPrefix(msg, "ACK|Login successful") || strings.HasPrefix(msg, "ACK|Register successful") {
+			if strings.HasPrefix(msg, "ACK|Login successful") {
+				// Keep the session token so the user can resume after a dropped connection
+				if parts := strings.Split(msg, "|"); len(parts) >= 3 {
+					fmt.Println("Session token (use 'Resume session' to reconnect):", parts[2])
+				}
+				break
+			} else if strings.HasPrefix(msg, "ACK|Registration successful") {
 				// Successful login/register, break loop
 				break
 			} else if strings.HasPrefix(msg, "ERR|") {
@@ -81,7 +114,7 @@ func main() {
 	// After login/register, allow game creation/joining
 	for {
 		// Show main menu
-		fmt.Println("1. Create Game\n2. List/Join Game\n3. Exit\nChoose:")
+		fmt.Println("1. Create Game\n2. List/Join Game\n3. Exit\n4. Upgrade Towers/Troops\n5. Watch Replay\n6. Watch Game\n7. Find Match\n8. Decks\nChoose:")
 		// Read user choice
 		choice, _ := reader.ReadString('\n')
 		choice = strings.TrimSpace(choice)
@@ -89,17 +122,36 @@ func main() {
 			// Exit client
 			fmt.Println("Exiting client. Goodbye!")
 			os.Exit(0)
+		} else if choice == "4" {
+			upgradeMenu(reader, serverScanner, conn)
+		} else if choice == "5" {
+			replayMenu(reader, serverScanner, conn)
+		} else if choice == "6" {
+			watchMenu(reader, serverScanner, conn)
+		} else if choice == "7" {
+			findMatch(reader, serverScanner, conn)
+		} else if choice == "8" {
+			deckMenu(reader, serverScanner, conn)
 		} else if choice == "1" {
 			// Prompt for game mode
 			fmt.Println("Select game mode: 1. Simple  2. Enhanced")
 			mode, _ := reader.ReadString('\n')
 			mode = strings.TrimSpace(mode)
+			// Prompt for opponent: another player joins the room, or a server bot fills it at once
+			fmt.Println("Opponent: 1. Player  2. Bot (easy)  3. Bot (medium)  4. Bot (hard)")
+			opp, _ := reader.ReadString('\n')
+			bot := map[string]string{"2": "|BOT|easy", "3": "|BOT|medium", "4": "|BOT|hard"}[strings.TrimSpace(opp)]
+			// Draft rooms ban and pick troops before the match instead of dealing them
+			fmt.Println("Draft troops before the match? (y/N)")
+			if answer, _ := reader.ReadString('\n'); strings.EqualFold(strings.TrimSpace(answer), "y") {
+				bot = "|DRAFT" + bot
+			}
 			if mode == "2" {
 				// Create enhanced game
-				conn.Write([]byte("CREATE_GAME|ENHANCED\n"))
+				conn.Write([]byte("CREATE_GAME|ENHANCED" + bot + "\n"))
 			} else {
 				// Create simple game
-				conn.Write([]byte("CREATE_GAME|SIMPLE\n"))
+				conn.Write([]byte("CREATE_GAME|SIMPLE" + bot + "\n"))
 			}
 			// Wait for game to start
 			waitForGameStart(serverScanner, conn, mode)
@@ -130,7 +182,11 @@ func main() {
 				if r == "" {
 					continue
 				}
-				parts := strings.SplitN(r, ":", 2)
+				parts := strings.Split(r, ":")
+				if len(parts) > 2 {
+					// Running match, only watchable
+					continue
+				}
 				if len(parts) == 2 {
 					fmt.Printf("- Room ID: %s (Host: %s)\n", parts[0], parts[1])
 				} else {
@@ -153,16 +209,189 @@ func main() {
 	}
 }
 
+// dial connects to the server in cleartext, or with TLS when useTLS is set
+// caFile replaces the system roots with one trusted certificate; insecure skips verification
+func dial(addr string, useTLS bool, caFile string, insecure bool) (net.Conn, error) {
+	if !useTLS {
+		if caFile != "" || insecure {
+			return nil, fmt.Errorf("-ca and -insecure need -tls")
+		}
+		return net.Dial("tcp", addr)
+	}
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pemData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+	return tls.Dial("tcp", addr, cfg)
+}
+
+// upgradeMenu shows the player's gold, EXP and unit levels and sends one UPGRADE command
+func upgradeMenu(reader *bufio.Reader, scanner *bufio.Scanner, conn net.Conn) {
+	conn.Write([]byte("PROFILE\n"))
+	for scanner.Scan() {
+		msg := scanner.Text()
+		if strings.HasPrefix(msg, "PROFILE|") {
+			var p Progress
+			if err := json.Unmarshal([]byte(msg[8:]), &p); err == nil {
+				fmt.Printf("Level %d, EXP %d, Gold %d, Rating %d\n", p.Level, p.EXP, p.Gold, p.Rating)
+				fmt.Println("Tower levels:", p.TowerLv)
+				fmt.Println("Troop levels:", p.TroopLv, "(unlisted units are level 1)")
+			}
+			break
+		}
+		if strings.HasPrefix(msg, "ERR|") {
+			fmt.Println("[Error]", errorText(msg))
+			return
+		}
+	}
+	fmt.Print("Tower or troop to upgrade (empty to cancel): ")
+	name, _ := reader.ReadString('\n')
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return
+	}
+	fmt.Print("Pay with 1. Gold  2. EXP: ")
+	currency, _ := reader.ReadString('\n')
+	if strings.TrimSpace(currency) == "2" {
+		conn.Write([]byte("UPGRADE|" + name + "|EXP\n"))
+	} else {
+		conn.Write([]byte("UPGRADE|" + name + "|GOLD\n"))
+	}
+	for scanner.Scan() {
+		msg := scanner.Text()
+		if strings.HasPrefix(msg, "ACK|UPGRADED|") {
+			parts := strings.Split(msg, "|")
+			fmt.Printf("[Upgraded] %s is now level %s (%s, %s)\n", parts[2], parts[3], parts[4], parts[5])
+			return
+		}
+		if strings.HasPrefix(msg, "ERR|") {
+			fmt.Println("[Error]", errorText(msg))
+			return
+		}
+	}
+}
+
+// DeckList is the body of a DECKS reply
+type DeckList struct {
+	Active     string              `json:"active"`
+	DeckSize   int                 `json:"deck_size"`
+	Decks      map[string][]string `json:"decks"`
+	Collection []string            `json:"collection"`
+	Locked     []string            `json:"locked"`
+}
+
+// deckMenu shows the user's card collection and decks, and saves or selects a deck
+func deckMenu(reader *bufio.Reader, scanner *bufio.Scanner, conn net.Conn) {
+	conn.Write([]byte("LIST_DECKS\n"))
+	var list DeckList
+	for scanner.Scan() {
+		msg := scanner.Text()
+		if strings.HasPrefix(msg, "DECKS|") {
+			if err := json.Unmarshal([]byte(msg[6:]), &list); err != nil {
+				fmt.Println("[Error] bad deck list:", err)
+				return
+			}
+			break
+		}
+		if strings.HasPrefix(msg, "ERR|") {
+			fmt.Println("[Error]", errorText(msg))
+			return
+		}
+	}
+	fmt.Println("Your cards:", strings.Join(list.Collection, ", "))
+	if len(list.Locked) > 0 {
+		fmt.Println("Locked (win matches to unlock):", strings.Join(list.Locked, ", "))
+	}
+	names := make([]string, 0, len(list.Decks))
+	for name := range list.Decks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mark := " "
+		if name == list.Active {
+			mark = "*"
+		}
+		fmt.Printf("%s %s: %s\n", mark, name, strings.Join(list.Decks[name], ", "))
+	}
+	if len(names) == 0 {
+		fmt.Println("No decks yet; matches deal from your whole collection.")
+	}
+	fmt.Print("Deck name to use or save (empty to cancel): ")
+	name, _ := reader.ReadString('\n')
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return
+	}
+	fmt.Printf("%d cards separated by commas (empty to select the saved deck): ", list.DeckSize)
+	cards, _ := reader.ReadString('\n')
+	conn.Write([]byte("SET_DECK|" + name + "|" + strings.TrimSpace(cards) + "\n"))
+	for scanner.Scan() {
+		msg := scanner.Text()
+		if strings.HasPrefix(msg, "ACK|DECK_SAVED|") || strings.HasPrefix(msg, "ACK|DECK_SELECTED|") {
+			fmt.Println("[Deck]", name, "is now your active deck")
+			return
+		}
+		if strings.HasPrefix(msg, "ERR|") {
+			fmt.Println("[Error]", errorText(msg))
+			return
+		}
+	}
+}
+
+// resumeSession waits for the server's answer to RESUME and rejoins a running match if there is one
+// Returns true if the session was resumed
+func resumeSession(scanner *bufio.Scanner, conn net.Conn) bool {
+	for scanner.Scan() {
+		msg := scanner.Text()
+		if strings.HasPrefix(msg, "ACK|Resumed|") {
+			parts := strings.Split(msg, "|")
+			fmt.Println("[Session resumed]")
+			if len(parts) >= 4 && parts[3] == "INGAME" {
+				// Server resends GAME_STARTED and the current state
+				waitForGameStart(scanner, conn, "")
+			}
+			return true
+		}
+		if strings.HasPrefix(msg, "ERR|") {
+			fmt.Println("[Error]", errorText(msg))
+			return false
+		}
+		fmt.Println(msg)
+	}
+	return false
+}
+
 // Only one scanner reads from server, and all game logic is handled here
 func waitForGameStart(scanner *bufio.Scanner, conn net.Conn, mode string) {
 	// Reset the enhanced input goroutine for every new game
 	staticEnhancedInputOnce = sync.Once{}   // Reset for every new game
 	enhancedInputStop = make(chan struct{}) // Reset stop channel for each game
 	fmt.Println("[Waiting for game to start...]")
+	drafting := false
 	// Listen for server messages until game starts or error
 	for scanner.Scan() {
 		msg := scanner.Text()
+		if strings.HasPrefix(msg, "DRAFT|") {
+			drafting = true
+			draftTurn(msg[6:], conn)
+			continue
+		}
 		fmt.Println(msg)
+		if drafting && strings.HasPrefix(msg, "GAME_END|") {
+			fmt.Println("Returning to main menu...")
+			return
+		}
+		if drafting && strings.HasPrefix(msg, "ERR|") {
+			continue // a rejected pick; the next DRAFT asks again
+		}
 		if strings.HasPrefix(msg, "ACK|GAME_STARTED") {
 			fmt.Println("[Game started successfully!]")
 			if mode != "2" && mode != "ENHANCED" {
@@ -179,6 +408,46 @@ func waitForGameStart(scanner *bufio.Scanner, conn net.Conn, mode string) {
 	}
 }
 
+// Draft is the body of a DRAFT message
+type Draft struct {
+	Players     []string            `json:"players"`
+	Step        int                 `json:"step"`
+	Steps       int                 `json:"steps"`
+	Action      string              `json:"action"`
+	Turn        string              `json:"turn"`
+	YourTurn    bool                `json:"your_turn"`
+	SecondsLeft int                 `json:"seconds_left"`
+	Pool        []string            `json:"pool"`
+	Bans        map[string][]string `json:"bans"`
+	Picks       map[string][]string `json:"picks"`
+	Done        bool                `json:"done"`
+}
+
+// draftTurn prints the draft and, on the player's turn, asks for a ban or pick
+func draftTurn(body string, conn net.Conn) {
+	var d Draft
+	if err := json.Unmarshal([]byte(body), &d); err != nil {
+		fmt.Println("[Draft]", body)
+		return
+	}
+	fmt.Printf("=== Draft %d/%d ===\n", d.Step, d.Steps)
+	for _, uname := range d.Players {
+		fmt.Printf("  %s picks: %s  bans: %s\n", uname, strings.Join(d.Picks[uname], ", "), strings.Join(d.Bans[uname], ", "))
+	}
+	if d.Done {
+		fmt.Println("[Draft complete]")
+		return
+	}
+	fmt.Println("  Pool:", strings.Join(d.Pool, ", "))
+	if !d.YourTurn {
+		fmt.Printf("Waiting for %s to %s...\n", d.Turn, strings.ToLower(d.Action))
+		return
+	}
+	fmt.Printf("Your turn to %s (%ds): ", strings.ToLower(d.Action), d.SecondsLeft)
+	name, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	conn.Write([]byte(d.Action + "|" + strings.TrimSpace(name) + "\n"))
+}
+
 func listenTurnLoop(scanner *bufio.Scanner, conn net.Conn, mode string) {
 	myTurn := false                                   // Track if it's the player's turn
 	currentState := ""                                // Store the current game state as a string
@@ -186,13 +455,14 @@ func listenTurnLoop(scanner *bufio.Scanner, conn net.Conn, mode string) {
 	isEnhanced := (mode == "2" || mode == "ENHANCED") // Detect enhanced mode
 	// Nếu mode rỗng (join phòng), tự động nhận diện ENHANCED nếu nhận được STATE|{...json...}
 	var enhancedDetected bool
+	var lastState *EnhancedGameState // last STATE, kept up to date by DELTA
 	if isEnhanced {
 		staticEnhancedInputOnce.Do(func() {
 			go enhancedInputLoop(conn)
 		})
 	}
 	for scanner.Scan() {
-		msg := scanner.Text() // Read message from server
+		request, msg := takeReply(scanner.Text()) // Read message from server; request is set for replies to our commands
 
 		if strings.HasPrefix(msg, "STATE|") {
 			jsonStr := msg[6:]
@@ -208,6 +478,7 @@ func listenTurnLoop(scanner *bufio.Scanner, conn net.Conn, mode string) {
 			if isEnhanced || enhancedDetected {
 				err := json.Unmarshal([]byte(jsonStr), &state)
 				if err == nil {
+					lastState = &state
 					printEnhancedState(&state, conn)
 				} else {
 					fmt.Println("[ENHANCED]", jsonStr)
@@ -220,18 +491,63 @@ func listenTurnLoop(scanner *bufio.Scanner, conn net.Conn, mode string) {
 		} else if strings.HasPrefix(msg, "ATTACK_RESULT|") {
 			fmt.Println("[Attack Result]")
 			fmt.Println(msg)
-		} else if strings.HasPrefix(msg, "QUEEN_HEAL|") {
+		} else if strings.HasPrefix(msg, "DELTA|") {
+			var d FieldDelta
+			if lastState != nil && json.Unmarshal([]byte(msg[6:]), &d) == nil {
+				applyDelta(lastState, d)
+				if lastState.Arena != nil {
+					printArena(lastState) // redraw the lanes; the melee is followed through its events
+				}
+			}
+		} else if strings.HasPrefix(msg, "PHASE|") {
+			// PHASE|phase|seconds
+			if parts := strings.Split(msg, "|"); len(parts) >= 3 {
+				fmt.Printf("[Time] Tied! Next %ss%s\n", parts[2], phaseText(parts[1]))
+			}
+		} else if strings.HasPrefix(msg, "UNIT_DEPLOYED|") {
+			// UNIT_DEPLOYED|player|troop|unit|lane|pos|tower
+			if parts := strings.Split(msg, "|"); len(parts) >= 7 && parts[4] == "" {
+				fmt.Printf("[Field] %s sent %s #%s at %s\n", parts[1], parts[2], parts[3], parts[6])
+			} else if len(parts) >= 6 {
+				fmt.Printf("[Arena] %s sent %s #%s down the %s lane\n", parts[1], parts[2], parts[3], strings.ToLower(parts[4]))
+			}
+		} else if strings.HasPrefix(msg, "UNIT_HIT|") {
+			// UNIT_HIT|player|troop|unit|target|foe|foe unit|damage|foe hp[|KILLED]
+			if parts := strings.Split(msg, "|"); len(parts) >= 9 {
+				fmt.Printf("[Field] %s's %s hit %s's %s for %s (HP %s)%s\n", parts[1], parts[2], parts[4], parts[5], parts[7], parts[8], killedText(parts[9:]))
+			}
+		} else if strings.HasPrefix(msg, "TOWER_SHOT|") {
+			// TOWER_SHOT|player|tower|target|foe|foe unit|damage|foe hp|CRIT:bool[|KILLED]
+			if parts := strings.Split(msg, "|"); len(parts) >= 9 {
+				crit := ""
+				if parts[8] == "CRIT:true" {
+					crit = " CRIT"
+				}
+				fmt.Printf("[Field] %s's %s shot %s's %s for %s (HP %s)%s%s\n", parts[1], parts[2], parts[3], parts[4], parts[6], parts[7], crit, killedText(parts[9:]))
+			}
+		} else if strings.HasPrefix(msg, "SPELL_CAST|") {
+			// SPELL_CAST|player|spell|tower|mana left
+			parts := strings.Split(msg, "|")
+			if len(parts) >= 5 && parts[3] != "" {
+				fmt.Printf("[Spell] %s cast %s on %s (mana left: %s)\n", parts[1], parts[2], parts[3], parts[4])
+			} else if len(parts) >= 5 {
+				fmt.Printf("[Spell] %s cast %s (mana left: %s)\n", parts[1], parts[2], parts[4])
+			} else {
+				fmt.Println("[Spell]", msg)
+			}
+		} else if strings.HasPrefix(msg, "ABILITY|") {
+			// ABILITY|player|troop|kind|target|tower|amount|value|duration[|DESTROYED]
 			parts := strings.Split(msg, "|")
-			if len(parts) >= 5 {
-				playerName := parts[1]
-				towerName := parts[2]
-				healAmount := parts[3]
-				newHP := parts[4]
-				fmt.Printf("[Queen's Healing] %s's Queen healed %s tower for %s HP (new HP: %s)\n",
-					playerName, towerName, healAmount, newHP)
+			if len(parts) >= 9 {
+				amount, _ := strconv.Atoi(parts[6])
+				value, _ := strconv.Atoi(parts[7])
+				duration, _ := strconv.Atoi(parts[8])
+				fmt.Println(abilityText(parts[1], parts[2], parts[3], parts[4], parts[5], amount, value, duration, len(parts) > 9))
 			} else {
-				fmt.Println("[Queen's Healing]", msg)
+				fmt.Println("[Ability]", msg)
 			}
+		} else if strings.HasPrefix(msg, "CARD_UNLOCKED|") {
+			fmt.Println("[New card unlocked]", strings.TrimPrefix(msg, "CARD_UNLOCKED|"))
 		} else if strings.HasPrefix(msg, "GAME_END|") {
 			fmt.Println("[Game End]")
 			fmt.Println(msg)
@@ -271,22 +587,32 @@ func listenTurnLoop(scanner *bufio.Scanner, conn net.Conn, mode string) {
 			fmt.Println("[Đối thủ đã thực hiện xong lượt đi]")
 			fmt.Println("[Chờ đến lượt của bạn...]")
 		} else if strings.HasPrefix(msg, "ERR|") {
-			fmt.Println("[Error]", msg[4:])
+			code := errorCode(msg)
+			if request != "" {
+				fmt.Printf("[Error] %s: %s\n", request, errorText(msg))
+			} else {
+				fmt.Println("[Error]", errorText(msg))
+			}
 			if myTurn && !waitingForInput {
 				waitingForInput = true
 				go func() {
 					fmt.Println("[Error detected! Please try again with a valid input]")
-					if strings.Contains(msg, "Must destroy either Guard1 or Guard2") {
-						fmt.Println("[Reminder: You must destroy EITHER Guard1 OR Guard2 Tower before attacking King]")
-					} else if strings.Contains(msg, "You must destroy") && strings.Contains(msg, "Tower first before attacking") {
+					switch code {
+					case "KING_LOCKED":
+						fmt.Println("[Reminder: You must destroy a Guard Tower before attacking the King]")
+					case "GUARD_LOCKED":
 						fmt.Println("[Reminder: Once you start attacking a Guard Tower, you must destroy it completely before attacking the other Guard Tower]")
+					case "INSUFFICIENT_MANA":
+						fmt.Println("[Reminder: Wait for mana to regenerate before buying]")
 					}
 					inGameLoop(scanner, conn, mode, myTurn, currentState)
 					waitingForInput = false
 				}()
 			}
 		} else if strings.HasPrefix(msg, "ACK|") {
-			if myTurn {
+			if request != "" {
+				fmt.Printf("[Server] %s: %s\n", request, msg[4:])
+			} else if myTurn {
 				fmt.Println("[Server]", msg[4:])
 			}
 		} else {
@@ -305,34 +631,167 @@ type EnhancedGameState struct {
 	Over      bool
 	StartTime string
 	EndTime   string
+	Phase     string  // OVERTIME or SUDDEN_DEATH once regulation time ended on a tie
+	Seed      int64   // match seed, for reproducing the match
+	Spells    []Spell // spells that can be cast in this match
+	Order     []string
+	Arena     *Arena // lane layout, nil unless the server runs the arena
+	Field     []Unit // troops on the field
 }
-type EnhancedPlayer struct {
-	Username string
-	Towers   map[string]Tower
-	Troops   []Troop
-	Mana     int
-	EXP      int
-	Level    int
-	Progress struct {
-		Username string `json:"username"`
-		EXP      int    `json:"exp"`
-		Level    int    `json:"level"`
+
+// Arena mirrors the engine's lane layout
+type Arena struct {
+	Length     int
+	Speed      int
+	TowerRange int
+}
+
+// Unit is a troop on the field. In the arena it walks Lane and Pos counts cells from
+// the first player's towers; otherwise it fights at Tower.
+type Unit struct {
+	ID    int
+	Name  string
+	Owner string
+	Tower string
+	Lane  string
+	Pos   int
+	HP    int
+	ATK   int
+	DEF   int
+}
+
+// FieldDelta is the body of a DELTA message: what one step of the field changed
+type FieldDelta struct {
+	Step    int    `json:"step"`
+	Units   []Unit `json:"units"`   // units deployed, moved or hurt, as they are now
+	Removed []int  `json:"removed"` // IDs of units that left the field
+	Towers  []struct {
+		Player string `json:"player"`
+		Tower  string `json:"tower"`
+		HP     int    `json:"hp"`
+	} `json:"towers"`
+}
+
+// applyDelta updates a state with a DELTA so the field can be redrawn between STATEs
+func applyDelta(state *EnhancedGameState, d FieldDelta) {
+	removed := map[int]bool{}
+	for _, id := range d.Removed {
+		removed[id] = true
 	}
+	changed := map[int]Unit{}
+	for _, u := range d.Units {
+		changed[u.ID] = u
+	}
+	field := state.Field[:0]
+	for _, u := range state.Field {
+		if removed[u.ID] {
+			continue
+		}
+		if c, ok := changed[u.ID]; ok {
+			u = c
+			delete(changed, u.ID)
+		}
+		field = append(field, u)
+	}
+	for _, u := range d.Units { // new units, in deploy order
+		if _, ok := changed[u.ID]; ok {
+			field = append(field, u)
+		}
+	}
+	state.Field = field
+	for _, t := range d.Towers {
+		if p, ok := state.Players[t.Player]; ok {
+			tower := p.Towers[t.Tower]
+			tower.HP = t.HP
+			p.Towers[t.Tower] = tower
+		}
+	}
+}
+
+type EnhancedPlayer struct {
+	Username  string
+	Towers    map[string]Tower
+	Troops    []Troop
+	Mana      int
+	EXP       int
+	Level     int
+	Progress  Progress
+	Effects   []Effect       // effects on the whole side, such as rage
+	Cooldowns map[string]int // spell -> ticks until it can be cast again
+	Deck      []string       // cards this player can buy or cast
+}
+
+// Spell is a spell card from the specs file
+type Spell struct {
+	Name     string  `json:"name"`
+	MANA     int     `json:"mana"`
+	Cooldown int     `json:"cooldown"`
+	Effect   Ability `json:"effect"`
+}
+
+// Progress mirrors the server's PlayerProgress
+type Progress struct {
+	Username string         `json:"username"`
+	EXP      int            `json:"exp"`
+	Level    int            `json:"level"`
+	Gold     int            `json:"gold"`
+	Rating   int            `json:"rating"`
+	TowerLv  map[string]int `json:"tower_lv"`
+	TroopLv  map[string]int `json:"troop_lv"`
 }
 
 type Tower struct {
 	Name string
+	Role string // king or guard
 	HP   int
 	ATK  int
 	DEF  int
+	CRIT float64
+
+	Effects []Effect
+}
+
+// Effect is an ability still acting on a tower (shield, poison or stun)
+type Effect struct {
+	Kind   string
+	Owner  string
+	Troop  string
+	Amount int
+	Turns  int
 }
 
 type Troop struct {
-	Name  string
-	HP    int
-	ATK   int
-	DEF   int
-	Owner string
+	Name    string
+	HP      int
+	ATK     int
+	DEF     int
+	Owner   string
+	Ability *Ability
+}
+
+// Ability is a troop's special effect from the specs file
+type Ability struct {
+	Kind     string `json:"kind"`
+	Amount   int    `json:"amount"`
+	Target   string `json:"target"`
+	Area     int    `json:"area"`
+	Duration int    `json:"duration"`
+}
+
+// towerOrder returns tower names with the guards first (by name) and the king last
+func towerOrder(towers map[string]Tower) []string {
+	names := make([]string, 0, len(towers))
+	for name := range towers {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ki, kj := towers[names[i]].Role == "king", towers[names[j]].Role == "king"
+		if ki != kj {
+			return kj
+		}
+		return names[i] < names[j]
+	})
+	return names
 }
 
 // printEnhancedState prints the current enhanced game state in a user-friendly format
@@ -340,33 +799,8 @@ type Troop struct {
 // conn: the network connection to the server (not used for printing, but may be used for future extensions)
 func printEnhancedState(state *EnhancedGameState, conn net.Conn) {
 	fmt.Println("\n========== ENHANCED GAME STATE ==========") // Print header
-	fmt.Printf("Room: %s\n", state.RoomID)                     // Print room ID
-	for uname, p := range state.Players {                      // Loop through all players in the game
-		fmt.Printf("Player: %s (Level %d, EXP %d, Mana %d)\n", uname, p.Level, p.EXP, p.Mana) // Print player info
-		fmt.Println("  Towers:")
-		for _, t := range []string{"Guard1", "Guard2", "King"} { // Always print towers in this order
-			tower := p.Towers[t]
-			if tower.HP <= 0 {
-				continue // Skip dead towers
-			}
-			crit := ""
-			if t == "King" {
-				crit = "CRIT: 10% (Tower attacks troop)" // King tower has higher crit chance
-			} else {
-				crit = "CRIT: 5% (Tower attacks troop)" // Guard towers have lower crit chance
-			}
-			fmt.Printf("    %s: HP=%d ATK=%d DEF=%d %s\n", tower.Name, tower.HP, tower.ATK, tower.DEF, crit)
-		}
-		fmt.Println("  Troops you own:")
-		for _, tr := range p.Troops {
-			if tr.Name == "Queen" {
-				fmt.Printf("    %s: Special (Heal) - always available\n", tr.Name) // Queen's special ability
-			} else if tr.HP > 0 {
-				fmt.Printf("    %s: HP=%d ATK=%d DEF=%d\n", tr.Name, tr.HP, tr.ATK, tr.DEF) // Print troop stats
-			}
-			// Dead troops are hidden from UI
-		}
-	}
+	printBoard(state)
+	printArena(state)
 	// Print available troops to buy (static info)
 	fmt.Println("-----------------------------------------")
 	fmt.Println("Available troops to buy:")
@@ -376,16 +810,130 @@ func printEnhancedState(state *EnhancedGameState, conn net.Conn) {
 	fmt.Println("  Knight (HP: 200, ATK: 300, DEF: 150, MANA: 5)")
 	fmt.Println("  Prince (HP: 500, ATK: 400, DEF: 300, MANA: 6)")
 	fmt.Println("  Queen  (Special: Heal, MANA: 5)")
+	fmt.Println("  Wizard (HP: 150, ATK: 250, DEF: 100, MANA: 6, Splash 120)")
+	fmt.Println("  Witch  (HP: 150, ATK: 150, DEF: 100, MANA: 5, Poison 60 x3)")
+	fmt.Println("  Monk   (Special: Shield 250, MANA: 4)")
+	if len(state.Spells) > 0 {
+		fmt.Println("Spells to cast:")
+		for _, sp := range state.Spells {
+			fmt.Printf("  %-8s (%s, MANA: %d, cooldown: %ds)\n", sp.Name, sp.Effect.Kind, sp.MANA, sp.Cooldown)
+		}
+	}
 	if state.EndTime != "" {
 		end, _ := time.Parse(time.RFC3339, state.EndTime) // Parse end time
 		now := time.Now()
 		remain := end.Sub(now) // Calculate time left
 		if remain > 0 {
-			fmt.Printf("Time left: %v\n", remain.Truncate(time.Second)) // Print time left
+			fmt.Printf("Time left: %v%s\n", remain.Truncate(time.Second), phaseText(state.Phase)) // Print time left
 		}
 	}
 	fmt.Println("=========================================")
-	fmt.Println("[ENHANCED MODE] Type: buy <troop> | deploy <troop> <tower> | exit")
+	fmt.Println("[ENHANCED MODE] Type: buy <troop> | deploy <troop> <tower|left|right> | cast <spell> [tower] | exit")
+}
+
+// phaseText describes the overtime period a match is in, or "" in regulation time
+func phaseText(phase string) string {
+	switch phase {
+	case "OVERTIME":
+		return " (overtime: double mana)"
+	case "SUDDEN_DEATH":
+		return " (sudden death: first tower destroyed loses)"
+	}
+	return ""
+}
+
+// killedText marks a hit that killed its unit, given the fields after the HP
+func killedText(rest []string) string {
+	if len(rest) > 0 && rest[0] == "KILLED" {
+		return " - KILLED"
+	}
+	return ""
+}
+
+// printArena draws each lane from the first player's towers to the second player's:
+// '>' marks the first player's units, '<' the second's, '*' both. Without an arena it
+// lists the units on the field and the towers they attack.
+func printArena(state *EnhancedGameState) {
+	if state.Arena == nil {
+		if len(state.Field) > 0 {
+			fmt.Println("Field:")
+		}
+		for _, u := range state.Field {
+			fmt.Printf("  %s's %s #%d at %s HP=%d\n", u.Owner, u.Name, u.ID, u.Tower, u.HP)
+		}
+		return
+	}
+	if len(state.Order) < 2 {
+		return
+	}
+	fmt.Printf("Arena: %s's towers on the left, %s's on the right\n", state.Order[0], state.Order[1])
+	for _, lane := range []string{"LEFT", "RIGHT"} {
+		cells := []byte(strings.Repeat(".", state.Arena.Length+1))
+		var units []string
+		for _, u := range state.Field {
+			if u.Lane != lane || u.Pos < 0 || u.Pos >= len(cells) {
+				continue
+			}
+			mark := byte('<')
+			if u.Owner == state.Order[0] {
+				mark = '>'
+			}
+			if cells[u.Pos] != '.' && cells[u.Pos] != mark {
+				mark = '*'
+			}
+			cells[u.Pos] = mark
+			units = append(units, fmt.Sprintf("%s's %s #%d @%d HP=%d", u.Owner, u.Name, u.ID, u.Pos, u.HP))
+		}
+		fmt.Printf("  %-5s |%s|\n", lane, cells)
+		for _, u := range units {
+			fmt.Println("         " + u)
+		}
+	}
+}
+
+// printBoard prints the room, players, towers and troops of a state
+// Shared by live games and replays
+func printBoard(state *EnhancedGameState) {
+	fmt.Printf("Room: %s (seed %d)\n", state.RoomID, state.Seed) // Print room ID and match seed
+	for uname, p := range state.Players {                        // Loop through all players in the game
+		fmt.Printf("Player: %s (Level %d, EXP %d, Mana %d)\n", uname, p.Level, p.EXP, p.Mana) // Print player info
+		for _, e := range p.Effects {
+			fmt.Printf("  %s +%d%% ATK (%ds left, from %s)\n", e.Kind, e.Amount, e.Turns, e.Troop) // Rage
+		}
+		for spell, left := range p.Cooldowns {
+			fmt.Printf("  %s ready in %ds\n", spell, left)
+		}
+		if len(p.Deck) > 0 {
+			fmt.Println("  Deck:", strings.Join(p.Deck, ", "))
+		}
+		fmt.Println("  Towers:")
+		for _, t := range towerOrder(p.Towers) { // Guards first, then the King
+			tower := p.Towers[t]
+			if tower.HP <= 0 {
+				continue // Skip dead towers
+			}
+			crit := fmt.Sprintf("CRIT: %.0f%% (Tower attacks troop)", tower.CRIT*100) // Crit chance from the specs
+			for _, e := range tower.Effects {
+				if e.Kind == "shield" {
+					crit += fmt.Sprintf(" [shield %d]", e.Amount)
+				} else {
+					crit += fmt.Sprintf(" [%s %ds]", e.Kind, e.Turns)
+				}
+			}
+			fmt.Printf("    %s: HP=%d ATK=%d DEF=%d %s\n", tower.Name, tower.HP, tower.ATK, tower.DEF, crit)
+		}
+		fmt.Println("  Troops you own:")
+		for _, tr := range p.Troops {
+			if tr.Ability != nil && (tr.Ability.Kind == "heal" || tr.Ability.Kind == "shield") {
+				fmt.Printf("    %s: Special (%s) - usable at 0 HP\n", tr.Name, tr.Ability.Kind) // Support troops such as the Queen
+			} else if tr.HP > 0 && tr.Ability != nil {
+				fmt.Printf("    %s: HP=%d ATK=%d DEF=%d (%s)\n", tr.Name, tr.HP, tr.ATK, tr.DEF, tr.Ability.Kind)
+			} else if tr.HP > 0 {
+				fmt.Printf("    %s: HP=%d ATK=%d DEF=%d\n", tr.Name, tr.HP, tr.ATK, tr.DEF) // Print troop stats
+			}
+			// Dead troops are hidden from UI
+		}
+	}
 }
 
 // enhancedInputLoop handles user input for enhanced mode in a separate goroutine
@@ -446,23 +994,33 @@ func enhancedInputLoop(conn net.Conn) {
 			if strings.HasPrefix(line, "deploy ") {
 				parts := strings.Fields(line)
 				if len(parts) == 3 {
-					cmd := fmt.Sprintf("DEPLOY|%s|%s\n", parts[1], parts[2])
-					conn.Write([]byte(cmd)) // Send deploy command
+					sendRequest(conn, "DEPLOY|"+parts[1]+"|"+parts[2], "deploy "+parts[1]+" on "+parts[2]) // Send deploy command
 					fmt.Println("[Sent deploy command]")
 				} else {
-					fmt.Println("Usage: deploy <troop> <tower>")
+					fmt.Println("Usage: deploy <troop> <tower|left|right>")
 				}
 			} else if strings.HasPrefix(line, "buy ") {
 				parts := strings.Fields(line)
 				if len(parts) == 2 {
-					cmd := fmt.Sprintf("BUY|%s\n", parts[1])
-					conn.Write([]byte(cmd)) // Send buy command
+					sendRequest(conn, "BUY|"+parts[1], "buy "+parts[1]) // Send buy command
 					fmt.Println("[Sent buy command]")
 				} else {
 					fmt.Println("Usage: buy <troop>")
 				}
+			} else if strings.HasPrefix(line, "cast ") {
+				parts := strings.Fields(line)
+				if len(parts) == 2 || len(parts) == 3 {
+					target := ""
+					if len(parts) == 3 {
+						target = parts[2]
+					}
+					sendRequest(conn, "CAST|"+parts[1]+"|"+target, strings.TrimSpace("cast "+parts[1]+" "+target)) // Send cast command
+					fmt.Println("[Sent cast command]")
+				} else {
+					fmt.Println("Usage: cast <spell> [tower]")
+				}
 			} else {
-				fmt.Println("Unknown command. Use: buy <troop> | deploy <troop> <tower> | exit")
+				fmt.Println("Unknown command. Use: buy <troop> | deploy <troop> <tower|left|right> | cast <spell> [tower] | exit")
 			}
 		}
 	}
@@ -496,7 +1054,7 @@ func inGameLoop(scanner *bufio.Scanner, conn net.Conn, mode string, myTurn bool,
 			tower, _ := reader.ReadString('\n')
 			tower = strings.TrimSpace(tower)
 			// Send deploy command to server
-			conn.Write([]byte("DEPLOY|" + troop + "|" + tower + "\n"))
+			sendRequest(conn, "DEPLOY|"+troop+"|"+tower, "deploy "+troop+" on "+tower)
 			fmt.Println("[Sending deploy command...]")
 			return // Return to listening for server messages
 		} else if cmd == "3" {
@@ -523,3 +1081,329 @@ func inGameLoop(scanner *bufio.Scanner, conn net.Conn, mode string, myTurn bool,
 		return
 	}
 }
+
+// Replay mirrors the server's recorded match
+type Replay struct {
+	ID      string          `json:"id"`
+	Mode    string          `json:"mode"`
+	Seed    int64           `json:"seed"`
+	Players []string        `json:"players"`
+	Initial json.RawMessage `json:"initial"`
+	Frames  []ReplayFrame   `json:"frames"`
+	Winner  string          `json:"winner"`
+	Reason  string          `json:"reason"`
+}
+
+type ReplayFrame struct {
+	T      int64           `json:"t"` // milliseconds since the match started
+	Action string          `json:"action"`
+	Events []ReplayEvent   `json:"events"`
+	State  json.RawMessage `json:"state"`
+}
+
+type ReplayEvent struct {
+	Kind          string
+	Player        string
+	Troop         string
+	Tower         string
+	Damage        int
+	TowerHP       int
+	CounterDamage int
+	TroopHP       int
+	Crit          bool
+	Destroyed     bool
+	Amount        int
+	Ability       string
+	Target        string
+	Duration      int
+	Mana          int
+	Winner        string
+	Reason        string
+}
+
+// findMatch joins the matchmaking queue and plays the match it finds
+func findMatch(reader *bufio.Reader, scanner *bufio.Scanner, conn net.Conn) {
+	fmt.Println("Select game mode: 1. Simple  2. Enhanced")
+	mode, _ := reader.ReadString('\n')
+	mode = strings.TrimSpace(mode)
+	if mode == "2" {
+		conn.Write([]byte("QUEUE|ENHANCED\n"))
+	} else {
+		conn.Write([]byte("QUEUE|SIMPLE\n"))
+	}
+	for scanner.Scan() {
+		msg := scanner.Text()
+		if strings.HasPrefix(msg, "ERR|") {
+			fmt.Println("[Error]", errorText(msg))
+			return
+		}
+		if strings.HasPrefix(msg, "ACK|QUEUED|") {
+			parts := strings.Split(msg, "|")
+			fmt.Printf("[Queued] Looking for an opponent near rating %s...\n", parts[len(parts)-1])
+			break
+		}
+		fmt.Println(msg)
+	}
+	// The server sends MATCH_FOUND and then starts the match like JOIN_GAME does
+	waitForGameStart(scanner, conn, mode)
+}
+
+// watchMenu lists running matches and spectates the one the user picks
+func watchMenu(reader *bufio.Reader, scanner *bufio.Scanner, conn net.Conn) {
+	conn.Write([]byte("LIST_GAMES\n"))
+	live := 0
+	for scanner.Scan() {
+		msg := scanner.Text()
+		if !strings.HasPrefix(msg, "GAMES|") {
+			fmt.Println(msg)
+			continue
+		}
+		for _, r := range strings.Split(msg[6:], ",") {
+			// Running matches are listed as id:host:guest:mode:spectators
+			parts := strings.Split(r, ":")
+			if len(parts) == 5 {
+				if live == 0 {
+					fmt.Println("Matches in progress:")
+				}
+				live++
+				fmt.Printf("- Room ID: %s (%s vs %s, %s, %s watching)\n", parts[0], parts[1], parts[2], parts[3], parts[4])
+			}
+		}
+		break
+	}
+	if live == 0 {
+		fmt.Println("No matches in progress.")
+		return
+	}
+	fmt.Print("Room id to watch (empty to cancel): ")
+	room, _ := reader.ReadString('\n')
+	room = strings.TrimSpace(room)
+	if room == "" {
+		return
+	}
+	conn.Write([]byte("SPECTATE|" + room + "\n"))
+	var last *EnhancedGameState // last STATE, kept up to date by DELTA
+	for scanner.Scan() {
+		msg := scanner.Text()
+		switch {
+		case strings.HasPrefix(msg, "ERR|"):
+			fmt.Println(errorText(msg))
+			return
+		case strings.HasPrefix(msg, "ACK|SPECTATING|"):
+			fmt.Println("Watching room", room, "until the match ends...")
+		case strings.HasPrefix(msg, "STATE|{"):
+			var state EnhancedGameState
+			if err := json.Unmarshal([]byte(msg[6:]), &state); err == nil {
+				fmt.Printf("=== %s ===\n", room)
+				printBoard(&state)
+				printArena(&state)
+				last = &state
+			}
+		case strings.HasPrefix(msg, "DELTA|"):
+			var d FieldDelta
+			if last != nil && json.Unmarshal([]byte(msg[6:]), &d) == nil {
+				applyDelta(last, d)
+				if last.Arena != nil {
+					printArena(last)
+				}
+			}
+		case strings.HasPrefix(msg, "STATE|"):
+			fmt.Println("[Game State Update]")
+			fmt.Println(msg[6:])
+		case strings.HasPrefix(msg, "GAME_END|"):
+			fmt.Println("[Game Over]", strings.TrimPrefix(msg, "GAME_END|"))
+			return
+		default:
+			fmt.Println(msg)
+		}
+	}
+}
+
+// replayMenu lists recorded matches and plays the one the user picks
+func replayMenu(reader *bufio.Reader, scanner *bufio.Scanner, conn net.Conn) {
+	conn.Write([]byte("LIST_REPLAYS\n"))
+	for scanner.Scan() {
+		msg := scanner.Text()
+		if !strings.HasPrefix(msg, "REPLAYS|") {
+			fmt.Println(msg)
+			continue
+		}
+		if msg == "REPLAYS|" {
+			fmt.Println("No replays recorded yet.")
+			return
+		}
+		fmt.Println("Replays:")
+		for _, r := range strings.Split(msg[8:], ",") {
+			parts := strings.SplitN(r, ":", 4)
+			if len(parts) == 4 {
+				fmt.Printf("- %s (%s) %s, winner: %s\n", parts[0], parts[1], parts[2], parts[3])
+			}
+		}
+		break
+	}
+	fmt.Print("Replay id to watch (empty to cancel): ")
+	id, _ := reader.ReadString('\n')
+	id = strings.TrimSpace(id)
+	if id != "" {
+		playReplay(reader, scanner, conn, id)
+	}
+}
+
+// playReplay fetches a replay and re-renders the match step by step
+func playReplay(reader *bufio.Reader, scanner *bufio.Scanner, conn net.Conn, id string) {
+	conn.Write([]byte("GET_REPLAY|" + id + "\n"))
+	var replay Replay
+	for scanner.Scan() {
+		msg := scanner.Text()
+		if strings.HasPrefix(msg, "ERR|") {
+			fmt.Println("[Error]", errorText(msg))
+			return
+		}
+		if strings.HasPrefix(msg, "REPLAY|") {
+			if err := json.Unmarshal([]byte(msg[7:]), &replay); err != nil {
+				fmt.Println("[Error] Cannot read replay:", err)
+				return
+			}
+			break
+		}
+	}
+	fmt.Printf("\n========== REPLAY %s ==========\n", replay.ID)
+	fmt.Printf("%s match: %s (seed %d)\n", replay.Mode, strings.Join(replay.Players, " vs "), replay.Seed)
+	var state EnhancedGameState
+	if json.Unmarshal(replay.Initial, &state) == nil {
+		printBoard(&state)
+	}
+	for i, f := range replay.Frames {
+		fmt.Printf("[Enter: next step %d/%d, q: quit] ", i+1, len(replay.Frames))
+		line, _ := reader.ReadString('\n')
+		if strings.TrimSpace(line) == "q" {
+			return
+		}
+		fmt.Printf("\n--- t=%.1fs %s ---\n", float64(f.T)/1000, strings.ReplaceAll(f.Action, "|", " "))
+		for _, ev := range f.Events {
+			printReplayEvent(ev)
+		}
+		var state EnhancedGameState
+		if json.Unmarshal(f.State, &state) == nil {
+			printBoard(&state)
+		}
+	}
+	if replay.Winner == "DRAW" {
+		fmt.Printf("Result: draw (%s)\n", replay.Reason)
+	} else {
+		fmt.Printf("Result: %s wins (%s)\n", replay.Winner, replay.Reason)
+	}
+	fmt.Println("===================================")
+}
+
+// printReplayEvent prints one recorded engine event
+func printReplayEvent(ev ReplayEvent) {
+	switch ev.Kind {
+	case "ATTACK":
+		crit := ""
+		if ev.Crit {
+			crit = " CRIT!"
+		}
+		fmt.Printf("[Attack] %s hits %s for %d (tower HP %d); tower hits back for %d%s (troop HP %d)\n",
+			ev.Troop, ev.Tower, ev.Damage, ev.TowerHP, ev.CounterDamage, crit, ev.TroopHP)
+		if ev.Destroyed {
+			fmt.Printf("[Destroyed] %s\n", ev.Tower)
+		}
+	case "HEAL": // replays recorded before abilities were generalised
+		fmt.Printf("[Queen's Healing] %s's Queen healed %s tower for %d HP (new HP: %d)\n", ev.Player, ev.Tower, ev.Amount, ev.TowerHP)
+	case "ABILITY":
+		value := ev.TowerHP
+		if ev.Ability == "mana_drain" {
+			value = ev.Mana
+		}
+		fmt.Println(abilityText(ev.Player, ev.Troop, ev.Ability, ev.Target, ev.Tower, ev.Amount, value, ev.Duration, ev.Destroyed))
+	case "CAST":
+		fmt.Printf("[Spell] %s cast %s %s\n", ev.Player, ev.Troop, ev.Tower)
+	case "BOUGHT":
+		fmt.Printf("[Buy] %s bought %s\n", ev.Player, ev.Troop)
+	case "TURN":
+		fmt.Printf("[Turn] %s\n", ev.Player)
+	case "GAME_OVER":
+		fmt.Printf("[Game Over] winner: %s (%s)\n", ev.Winner, ev.Reason)
+	}
+}
+
+// abilityText describes an ability event; value is the tower's HP afterwards, or the
+// target's mana after a mana drain
+func abilityText(player, troop, kind, target, tower string, amount, value, duration int, destroyed bool) string {
+	var s string
+	switch kind {
+	case "heal":
+		s = fmt.Sprintf("[Heal] %s's %s healed %s for %d HP (new HP: %d)", player, troop, tower, amount, value)
+	case "shield":
+		s = fmt.Sprintf("[Shield] %s's %s shields %s, %d damage (tower HP: %d)", player, troop, tower, amount, value)
+	case "splash":
+		s = fmt.Sprintf("[Splash] %s's %s hit %s's %s for %d (tower HP: %d)", player, troop, target, tower, amount, value)
+	case "poison":
+		s = fmt.Sprintf("[Poison] %s's %s poisons %s's %s for %d, %d left (tower HP: %d)", player, troop, target, tower, amount, duration, value)
+	case "stun":
+		s = fmt.Sprintf("[Stun] %s's %s stunned %s's %s for %d", player, troop, target, tower, duration)
+	case "mana_drain":
+		s = fmt.Sprintf("[Mana Drain] %s's %s drained %d mana from %s (mana left: %d)", player, troop, amount, target, value)
+	case "damage":
+		s = fmt.Sprintf("[Damage] %s's %s hit %s's %s for %d (tower HP: %d)", player, troop, target, tower, amount, value)
+	case "rage":
+		s = fmt.Sprintf("[Rage] %s's %s raised troop ATK by %d%% for %d", player, troop, amount, duration)
+	default:
+		s = fmt.Sprintf("[Ability] %s's %s used %s on %s %s", player, troop, kind, target, tower)
+	}
+	if destroyed {
+		s += " - DESTROYED"
+	}
+	return s
+}
+
+// Commands sent during a match are tagged "#id|CMD|..." and the server echoes the id in
+// its reply, so replies can be told apart from pushed events and matched to their command
+var (
+	pendingRequests = map[string]string{} // id -> description of the command
+	pendingLock     sync.Mutex
+	lastRequestID   int
+)
+
+// sendRequest sends cmd tagged with a new request id; desc describes it in replies
+func sendRequest(conn net.Conn, cmd, desc string) {
+	pendingLock.Lock()
+	lastRequestID++
+	id := strconv.Itoa(lastRequestID)
+	pendingRequests[id] = desc
+	pendingLock.Unlock()
+	conn.Write([]byte("#" + id + "|" + cmd + "\n"))
+}
+
+// takeReply strips the "#id|" prefix of a reply and returns the description of the
+// command it answers, or "" for pushed events
+func takeReply(msg string) (string, string) {
+	if !strings.HasPrefix(msg, "#") {
+		return "", msg
+	}
+	parts := strings.SplitN(msg[1:], "|", 2)
+	if len(parts) < 2 {
+		return "", msg
+	}
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	desc := pendingRequests[parts[0]]
+	delete(pendingRequests, parts[0])
+	return desc, parts[1]
+}
+
+// errorCode returns the machine-readable code of an "ERR|CODE|message" line
+func errorCode(msg string) string {
+	parts := strings.SplitN(msg, "|", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// errorText returns the message of an "ERR|CODE|message" line
+func errorText(msg string) string {
+	parts := strings.SplitN(msg, "|", 3)
+	return parts[len(parts)-1]
+}
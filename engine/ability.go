@@ -0,0 +1,375 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tower roles drive the attack-order and win rules, whatever the towers are called
+const (
+	RoleKing  = "king"  // destroying it wins the match; locked while every guard stands
+	RoleGuard = "guard" // the first guard attacked must fall before another guard is attacked
+)
+
+// Ability kinds. Each is implemented once, in useAbility and the effect code below,
+// and reported with an EventAbility. Troops use their ability when deployed; spells
+// (spell.go) are nothing but an ability with a mana cost and a cooldown.
+// Durations count turns (SIMPLE) or ticks (ENHANCED, one per regen interval).
+const (
+	AbilityHeal      = "heal"       // restores Amount HP to the owner's towers
+	AbilityShield    = "shield"     // gives the owner's towers a shield absorbing Amount damage
+	AbilitySplash    = "splash"     // deals Amount damage to enemy towers next to the one attacked
+	AbilityPoison    = "poison"     // deals Amount damage to enemy towers every turn or tick for Duration
+	AbilityStun      = "stun"       // stops enemy towers from counter-attacking for Duration
+	AbilityManaDrain = "mana_drain" // removes Amount mana from the enemy
+	AbilityDamage    = "damage"     // deals Amount damage to enemy towers
+	AbilityRage      = "rage"       // raises the ATK of the owner's troops by Amount percent for Duration
+)
+
+// Ability targeting rules
+const (
+	TargetWeakestOwn = "weakest_own_tower" // the owner's standing tower with the lowest HP
+	TargetOwnKing    = "own_king"          // the owner's King, if standing
+	TargetAllOwn     = "all_own_towers"    // every standing tower of the owner
+	TargetTower      = "target_tower"      // the enemy tower the troop attacked
+	TargetAdjacent   = "adjacent_towers"   // enemy towers within Area places of the attacked one, in TowerNames order
+	TargetAllEnemy   = "all_enemy_towers"  // every enemy tower the player may attack
+	TargetEnemy      = "enemy_player"      // the opponent rather than a tower
+	TargetOwnTroops  = "own_troops"        // every troop of the owner
+)
+
+// Ability is a troop's special effect as declared in the specs file
+type Ability struct {
+	Kind     string `json:"kind"`
+	Amount   int    `json:"amount,omitempty"`   // HP healed, shield strength, damage or mana; see the kind
+	Target   string `json:"target,omitempty"`   // targeting rule; "" means the kind's default
+	Area     int    `json:"area,omitempty"`     // reach of adjacent_towers; 0 means 1
+	Duration int    `json:"duration,omitempty"` // turns (SIMPLE) or ticks (ENHANCED) the effect lasts; 0 is instant
+}
+
+// abilityKind describes what the schema allows for one kind of ability
+type abilityKind struct {
+	targets  []string // allowed targeting rules, the first is the default
+	amount   bool     // whether Amount must be set (heal falls back to Rules.HealAmount)
+	area     bool     // whether Area is meaningful
+	duration bool     // whether Duration is meaningful
+	lasting  bool     // whether Duration must be set
+	support  bool     // troops with it can be deployed even at 0 HP and do not count as fighting troops
+}
+
+var abilityKinds = map[string]abilityKind{
+	AbilityHeal:      {targets: []string{TargetWeakestOwn, TargetOwnKing, TargetAllOwn}, support: true},
+	AbilityShield:    {targets: []string{TargetWeakestOwn, TargetOwnKing, TargetAllOwn}, amount: true, duration: true, support: true},
+	AbilitySplash:    {targets: []string{TargetAdjacent, TargetAllEnemy}, amount: true, area: true},
+	AbilityPoison:    {targets: []string{TargetTower, TargetAdjacent, TargetAllEnemy}, amount: true, area: true, duration: true, lasting: true},
+	AbilityStun:      {targets: []string{TargetTower, TargetAdjacent, TargetAllEnemy}, area: true, duration: true, lasting: true},
+	AbilityManaDrain: {targets: []string{TargetEnemy}, amount: true},
+	AbilityDamage:    {targets: []string{TargetTower, TargetAdjacent, TargetAllEnemy}, amount: true, area: true},
+	AbilityRage:      {targets: []string{TargetOwnTroops}, amount: true, duration: true, lasting: true},
+}
+
+// AbilityProblem is one invalid field of an ability definition
+type AbilityProblem struct {
+	Field string // name of the field in the specs file
+	Msg   string
+}
+
+// Validate checks an ability definition against the schema of its kind
+func (a Ability) Validate() []AbilityProblem {
+	kind, ok := abilityKinds[a.Kind]
+	if !ok {
+		return []AbilityProblem{{"kind", fmt.Sprintf("unknown ability %q (known: %s)", a.Kind, knownAbilities())}}
+	}
+	var problems []AbilityProblem
+	if a.Amount < 0 || (a.Amount == 0 && kind.amount) {
+		problems = append(problems, AbilityProblem{"amount", fmt.Sprintf("%s needs a positive amount", a.Kind)})
+	}
+	if a.Target != "" && !contains(kind.targets, a.Target) {
+		problems = append(problems, AbilityProblem{"target", fmt.Sprintf("%s cannot target %q (allowed: %s)", a.Kind, a.Target, strings.Join(kind.targets, ", "))})
+	}
+	if a.Area < 0 || (a.Area > 0 && (!kind.area || a.TargetRule() != TargetAdjacent)) {
+		problems = append(problems, AbilityProblem{"area", fmt.Sprintf("only %s takes an area", TargetAdjacent)})
+	}
+	switch {
+	case a.Duration < 0 || (a.Duration > 0 && !kind.duration):
+		problems = append(problems, AbilityProblem{"duration", fmt.Sprintf("%s takes no duration", a.Kind)})
+	case a.Duration == 0 && kind.lasting:
+		problems = append(problems, AbilityProblem{"duration", fmt.Sprintf("%s needs a positive duration", a.Kind)})
+	}
+	return problems
+}
+
+// TargetRule returns the ability's targeting rule, applying the kind's default
+func (a Ability) TargetRule() string {
+	if a.Target != "" {
+		return a.Target
+	}
+	return abilityKinds[a.Kind].targets[0]
+}
+
+// Support reports whether the ability makes its troop a support unit (a healer or
+// shielder), which is usable at 0 HP and does not count as a fighting troop. SIMPLE
+// keeps it in the hand for reuse; ENHANCED uses it up like any other troop.
+func (a *Ability) Support() bool {
+	return a != nil && abilityKinds[a.Kind].support
+}
+
+// Support reports whether the troop is a support unit
+func (t *Troop) Support() bool {
+	return t.Ability.Support()
+}
+
+// NeedsTower reports whether the ability acts around a chosen enemy tower, so a spell
+// with it must be cast at one
+func (a Ability) NeedsTower() bool {
+	rule := a.TargetRule()
+	return rule == TargetTower || rule == TargetAdjacent
+}
+
+// Effect is an ability still acting on a tower (a shield, poison or stun) or on a player (rage)
+type Effect struct {
+	Kind   string // AbilityShield, AbilityPoison, AbilityStun or AbilityRage
+	Owner  string // player whose troop or spell applied it
+	Troop  string // troop or spell that applied it
+	Amount int    // shield HP left, poison damage per turn or tick, or rage ATK percent
+	Turns  int    // turns or ticks left; 0 lasts until used up (shields)
+}
+
+// hasEffect reports whether an effect of the given kind is on the tower
+func (t *Tower) hasEffect(kind string) bool {
+	for _, e := range t.Effects {
+		if e.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// shield puts a shield on the tower. Shields do not stack: a new one replaces the one
+// already there, keeping the larger amount left.
+func (t *Tower) shield(s Effect) {
+	for i, e := range t.Effects {
+		if e.Kind == AbilityShield {
+			if e.Amount > s.Amount {
+				s.Amount = e.Amount
+			}
+			t.Effects[i] = s
+			return
+		}
+	}
+	t.Effects = append(t.Effects, s)
+}
+
+// rage returns the ATK bonus in percent that rage effects give the player's troops
+func (p *Player) rage() int {
+	bonus := 0
+	for _, e := range p.Effects {
+		if e.Kind == AbilityRage {
+			bonus += e.Amount
+		}
+	}
+	return bonus
+}
+
+// useAbility applies an ability of the troop or spell named source, used by player with
+// the enemy tower target as its aim (nil if it has none). For a troop it runs before
+// the tower counter-attacks, so a stun stops that counter-attack.
+func (m *Match) useAbility(player, enemy *Player, source string, a *Ability, target *Tower) []Event {
+	if a == nil {
+		return nil
+	}
+	var events []Event
+	ev := Event{Kind: EventAbility, Player: player.Username, Troop: source, Ability: a.Kind, Duration: a.Duration}
+	switch a.Kind {
+	case AbilityHeal:
+		amount := a.Amount
+		if amount == 0 {
+			amount = m.Rules.HealAmount
+		}
+		for _, t := range ownTargets(player, a.TargetRule()) {
+			t.HP += amount
+			events = append(events, ev.on(player, t, amount))
+		}
+	case AbilityShield:
+		for _, t := range ownTargets(player, a.TargetRule()) {
+			t.shield(Effect{Kind: AbilityShield, Owner: player.Username, Troop: source, Amount: a.Amount, Turns: a.Duration})
+			events = append(events, ev.on(player, t, a.Amount))
+		}
+	case AbilitySplash, AbilityDamage:
+		for _, t := range enemyTargets(enemy, target, *a) {
+			if t == target && a.Kind == AbilitySplash {
+				continue // the attacked tower already took the hit
+			}
+			dealt, absorbed := damageTower(t, a.Amount)
+			events = append(events, absorbed...)
+			hit := ev.on(enemy, t, dealt)
+			hit.Destroyed = t.HP <= 0
+			events = append(events, hit)
+		}
+	case AbilityPoison, AbilityStun:
+		for _, t := range enemyTargets(enemy, target, *a) {
+			t.Effects = append(t.Effects, Effect{Kind: a.Kind, Owner: player.Username, Troop: source, Amount: a.Amount, Turns: a.Duration})
+			events = append(events, ev.on(enemy, t, a.Amount))
+		}
+	case AbilityManaDrain:
+		drained := a.Amount
+		if drained > enemy.Mana {
+			drained = enemy.Mana
+		}
+		enemy.Mana -= drained
+		ev.Target, ev.Amount, ev.Mana = enemy.Username, drained, enemy.Mana
+		events = append(events, ev)
+	case AbilityRage:
+		player.Effects = append(player.Effects, Effect{Kind: AbilityRage, Owner: player.Username, Troop: source, Amount: a.Amount, Turns: a.Duration})
+		ev.Target, ev.Amount = player.Username, a.Amount
+		events = append(events, ev)
+	}
+	return events
+}
+
+// on returns a copy of an ability event aimed at one tower of owner
+func (e Event) on(owner *Player, t *Tower, amount int) Event {
+	e.Target, e.Tower, e.Amount, e.TowerHP = owner.Username, t.Name, amount, t.HP
+	return e
+}
+
+// damageTower deals damage to a tower through its shields. It returns the damage left
+// after shields and an event for every shield that absorbed part of it.
+func damageTower(t *Tower, damage int) (int, []Event) {
+	var events []Event
+	kept := t.Effects[:0]
+	for _, e := range t.Effects {
+		if e.Kind == AbilityShield && damage > 0 {
+			absorbed := e.Amount
+			if absorbed > damage {
+				absorbed = damage
+			}
+			e.Amount -= absorbed
+			damage -= absorbed
+			events = append(events, Event{Kind: EventAbility, Player: e.Owner, Troop: e.Troop, Ability: AbilityShield,
+				Target: e.Owner, Tower: t.Name, Amount: absorbed, TowerHP: t.HP, Duration: e.Turns})
+			if e.Amount == 0 {
+				continue // broken
+			}
+		}
+		kept = append(kept, e)
+	}
+	t.Effects = kept
+	t.HP = max0(t.HP - damage)
+	return damage, events
+}
+
+// advanceEffects runs one turn or tick of every lasting effect: poison deals its damage,
+// then each effect's time runs down and expired effects and those on fallen towers go.
+func (m *Match) advanceEffects() []Event {
+	var events []Event
+	for _, uname := range m.Order {
+		p := m.Players[uname]
+		p.Effects = runDown(p.Effects)
+		for _, name := range p.TowerNames() {
+			t := p.Towers[name]
+			for _, e := range append([]Effect(nil), t.Effects...) { // damageTower edits t.Effects
+				if e.Kind != AbilityPoison || t.HP <= 0 {
+					continue
+				}
+				dealt, absorbed := damageTower(t, e.Amount)
+				events = append(events, absorbed...)
+				events = append(events, Event{Kind: EventAbility, Player: e.Owner, Troop: e.Troop, Ability: AbilityPoison,
+					Target: uname, Tower: t.Name, Amount: dealt, TowerHP: t.HP, Duration: e.Turns - 1, Destroyed: t.HP <= 0})
+			}
+			if t.HP <= 0 {
+				t.Effects = nil
+			}
+			t.Effects = runDown(t.Effects)
+		}
+	}
+	return events
+}
+
+// runDown takes one turn or tick off each timed effect and drops those that expire
+func runDown(effects []Effect) []Effect {
+	var kept []Effect
+	for _, e := range effects {
+		if e.Turns > 0 {
+			if e.Turns--; e.Turns == 0 {
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// ownTargets resolves a targeting rule to the player's standing towers it selects
+func ownTargets(p *Player, rule string) []*Tower {
+	switch rule {
+	case TargetOwnKing:
+		if k := p.King(); k != nil && k.HP > 0 {
+			return []*Tower{k}
+		}
+	case TargetAllOwn:
+		var all []*Tower
+		for _, name := range p.TowerNames() {
+			if t := p.Towers[name]; t.HP > 0 {
+				all = append(all, t)
+			}
+		}
+		return all
+	default:
+		if t := weakestTower(p); t != nil {
+			return []*Tower{t}
+		}
+	}
+	return nil
+}
+
+// enemyTargets resolves a targeting rule to the enemy's towers it selects, starting from
+// the attacked tower (nil for all_enemy_towers). Abilities cannot reach a King that
+// attacks could not.
+func enemyTargets(enemy *Player, attacked *Tower, a Ability) []*Tower {
+	if a.TargetRule() == TargetTower {
+		return []*Tower{attacked}
+	}
+	names := enemy.TowerNames()
+	at := 0
+	for i, name := range names {
+		if attacked != nil && name == attacked.Name {
+			at = i
+		}
+	}
+	reach := a.Area
+	if reach == 0 {
+		reach = 1
+	}
+	var targets []*Tower
+	for i, name := range names {
+		t := enemy.Towers[name]
+		if a.TargetRule() == TargetAdjacent && (i < at-reach || i > at+reach) {
+			continue
+		}
+		if (t.HP <= 0 && t != attacked) || (t.Role == RoleKing && allGuardsStanding(enemy)) {
+			continue
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+func knownAbilities() string {
+	var names []string
+	for name := range abilityKinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
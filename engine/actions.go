@@ -0,0 +1,107 @@
+package engine
+
+// Action is a player or clock input applied to a Match
+type Action interface {
+	isAction()
+}
+
+// Deploy sends one of the player's troops against an enemy tower
+type Deploy struct {
+	Player string
+	Troop  string
+	Tower  string
+}
+
+// Buy spends mana to add a troop to the player's hand (enhanced rules)
+type Buy struct {
+	Player string
+	Troop  Troop // stats already scaled for the player
+	Cost   int   // mana cost
+}
+
+// Cast spends mana to cast a spell, aimed at an enemy tower if the spell needs one
+type Cast struct {
+	Player string
+	Spell  Spell
+	Tower  string // ignored by spells that do not act around a tower
+}
+
+// Tick advances the match clock by one regen interval: mana regeneration and lasting ability effects
+type Tick struct{}
+
+// Step advances the field by one simulation step: units move and attack, towers shoot
+type Step struct{}
+
+// TimeUp ends the current period of a timed match, deciding the winner by towers left
+// standing or starting overtime (see overtime.go)
+type TimeUp struct{}
+
+// Forfeit ends the match in favour of the other player
+type Forfeit struct {
+	Player string
+}
+
+func (Deploy) isAction()  {}
+func (Buy) isAction()     {}
+func (Cast) isAction()    {}
+func (Tick) isAction()    {}
+func (Step) isAction()    {}
+func (TimeUp) isAction()  {}
+func (Forfeit) isAction() {}
+
+// EventKind identifies what happened in an Event
+type EventKind string
+
+const (
+	EventAttack   EventKind = "ATTACK"    // a troop hit a tower and took the counter-attack (none for units)
+	EventAbility  EventKind = "ABILITY"   // a troop ability acted on a tower or player; Ability names the kind
+	EventBought   EventKind = "BOUGHT"    // a troop was added to a player's hand
+	EventCast     EventKind = "CAST"      // a player cast a spell; its ABILITY events follow
+	EventTurn     EventKind = "TURN"      // the turn passed to Player
+	EventDeployed EventKind = "DEPLOYED"  // a troop took the field as Unit
+	EventClash    EventKind = "CLASH"     // a unit hit an enemy unit (the Foe)
+	EventShot     EventKind = "SHOT"      // a tower shot a unit (the Foe)
+	EventPhase    EventKind = "PHASE"     // time ran out on a tie and the match entered Phase
+	EventGameOver EventKind = "GAME_OVER" // the match ended
+)
+
+// Reasons a match can end, carried in Event.Reason
+const (
+	ReasonKingDestroyed = "KING_DESTROYED" // a King tower fell
+	ReasonMoreTowers    = "MORE_TOWERS"    // decided by number of towers alive
+	ReasonTowerHP       = "TOWER_HP"       // equal tower count, decided by total tower HP
+	ReasonSuddenDeath   = "SUDDEN_DEATH"   // the other side lost the first tower in sudden death
+	ReasonLowestTower   = "LOWEST_TOWER"   // sudden death ran out, decided by the weakest tower's HP percentage
+	ReasonForfeit       = "FORFEIT"        // a player left
+)
+
+// Event describes one outcome of an action. Only the fields relevant to Kind are set.
+type Event struct {
+	Kind          EventKind
+	Player        string `json:",omitempty"` // acting player (heal owner, buyer, next turn holder)
+	Troop         string `json:",omitempty"` // troop, or the spell for EventCast and a spell's EventAbility
+	Tower         string `json:",omitempty"`
+	Damage        int    `json:",omitempty"` // damage dealt to the tower
+	TowerHP       int    `json:",omitempty"` // tower HP after the action
+	CounterDamage int    `json:",omitempty"` // damage the tower dealt back to the troop
+	TroopHP       int    `json:",omitempty"` // troop HP after the counter-attack
+	Crit          bool   `json:",omitempty"` // counter-attack was a critical hit
+	Destroyed     bool   `json:",omitempty"` // tower was destroyed
+	Amount        int    `json:",omitempty"` // ability amount: HP healed or shielded, damage dealt, mana drained
+	Ability       string `json:",omitempty"` // ability kind, for EventAbility
+	Target        string `json:",omitempty"` // player whose tower or mana the ability affected
+	Duration      int    `json:",omitempty"` // turns or ticks the ability's effect has left
+	Mana          int    `json:",omitempty"` // target's mana after a mana drain, caster's mana after a cast
+	Winner        string `json:",omitempty"`
+	Reason        string `json:",omitempty"`
+	Scores        [2]int // compared values for the end reason: winner's then loser's
+	Seed          int64  `json:",omitempty"` // match seed, set on GAME_OVER so a result can be reproduced
+	Unit          int    `json:",omitempty"` // unit that acted
+	Lane          string `json:",omitempty"` // arena lane the event happened in
+	Pos           int    `json:",omitempty"` // position in the lane of the unit that acted or was shot
+	Foe           string `json:",omitempty"` // troop of the unit that was hit, for EventClash and EventShot
+	FoeUnit       int    `json:",omitempty"`
+	FoeHP         int    `json:",omitempty"` // HP the hit unit has left
+	Phase         string `json:",omitempty"` // period the match entered, for EventPhase
+	Killed        bool   `json:",omitempty"` // the hit unit fell
+}
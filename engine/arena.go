@@ -0,0 +1,180 @@
+package engine
+
+import "strings"
+
+// The arena is an optional layout of the field (field.go). Instead of one melee, units
+// walk down the left or right lane toward the enemy's towers. Every Step units walk, fight
+// the enemy units next to them and hit the tower at the end of their lane, and towers
+// shoot the nearest units that come in range.
+//
+// Positions count cells from the first player's end of a lane (0) to the second
+// player's end (Arena.Length). The guards, sorted by name, alternate between the lanes;
+// the King stands behind both and can be hit from a lane once that lane's guards fall.
+
+// Lanes of the arena
+const (
+	LaneLeft  = "LEFT"
+	LaneRight = "RIGHT"
+)
+
+var lanes = []string{LaneLeft, LaneRight}
+
+// Arena is the lane layout of an arena match
+type Arena struct {
+	Length     int // cells between the two sides' towers
+	Speed      int // cells a unit walks every Step
+	TowerRange int // cells from its end of a lane within which a tower shoots
+}
+
+// laneGuards returns the guards defending a lane; a lane without guards of its own,
+// when there is only one, is defended by all of them
+func laneGuards(p *Player, lane string) []*Tower {
+	var guards, all []*Tower
+	for _, name := range p.TowerNames() {
+		if t := p.Towers[name]; t.Role == RoleGuard {
+			if lanes[len(all)%len(lanes)] == lane {
+				guards = append(guards, t)
+			}
+			all = append(all, t)
+		}
+	}
+	if len(guards) == 0 {
+		return all
+	}
+	return guards
+}
+
+// laneTarget returns the tower units in a lane attack: its first standing guard, then
+// the King. nil if both have fallen.
+func laneTarget(p *Player, lane string) *Tower {
+	for _, t := range laneGuards(p, lane) {
+		if t.HP > 0 {
+			return t
+		}
+	}
+	if k := p.King(); k != nil && k.HP > 0 {
+		return k
+	}
+	return nil
+}
+
+// laneFor resolves a deploy target to a lane: a lane name, or an enemy tower whose lane
+// the troop should walk. The King can be named once one of its lanes is open.
+func laneFor(enemy *Player, target string) (string, error) {
+	if lane := strings.ToUpper(target); contains(lanes, lane) {
+		if laneTarget(enemy, lane) == nil {
+			return "", errInvalidTower
+		}
+		return lane, nil
+	}
+	tower, ok := enemy.Towers[target]
+	if !ok || tower.HP <= 0 {
+		return "", errInvalidTower
+	}
+	for _, lane := range lanes {
+		if laneTarget(enemy, lane) == tower {
+			return lane, nil
+		}
+	}
+	if tower.Role == RoleKing {
+		return "", errKingLocked
+	}
+	for _, lane := range lanes {
+		for _, t := range laneGuards(enemy, lane) {
+			if t == tower {
+				return lane, nil
+			}
+		}
+	}
+	return "", errInvalidTower
+}
+
+// end returns the position of username's towers and the direction their units walk in
+func (m *Match) end(username string) (pos, dir int) {
+	if len(m.Order) > 0 && m.Order[0] == username {
+		return 0, 1
+	}
+	return m.Rules.Arena.Length, -1
+}
+
+// walk moves a unit up to Speed cells toward the enemy's towers, stopping next to them or
+// next to the first enemy unit in its way. Units that only attack towers walk past enemy units.
+func (m *Match) walk(u *Unit, enemy *Player) {
+	_, dir := m.end(u.Owner)
+	goal, _ := m.end(enemy.Username)
+	stop := goal - dir
+	if foe := m.foeAhead(u, dir); foe != nil && u.Targets != HitsTowers {
+		if (foe.Pos-u.Pos)*dir <= 1 {
+			return // already fighting
+		}
+		if (foe.Pos-dir-stop)*dir < 0 {
+			stop = foe.Pos - dir
+		}
+	}
+	next := u.Pos + dir*m.Rules.Arena.Speed
+	if (next-stop)*dir > 0 {
+		next = stop
+	}
+	if (next-u.Pos)*dir > 0 {
+		u.Pos = next
+	}
+}
+
+// foeAhead returns the nearest standing enemy unit in front of u in its lane, or nil
+func (m *Match) foeAhead(u *Unit, dir int) *Unit {
+	var nearest *Unit
+	for _, f := range m.Field {
+		if f.Owner == u.Owner || f.Lane != u.Lane || f.HP <= 0 || (f.Pos-u.Pos)*dir < 0 {
+			continue
+		}
+		if nearest == nil || (f.Pos-nearest.Pos)*dir < 0 {
+			nearest = f
+		}
+	}
+	return nearest
+}
+
+// laneTowerInReach returns the tower at the end of u's lane if u stands next to it
+func (m *Match) laneTowerInReach(u *Unit, enemy *Player) *Tower {
+	goal, _ := m.end(enemy.Username)
+	if abs(goal-u.Pos) > 1 {
+		return nil
+	}
+	return laneTarget(enemy, u.Lane)
+}
+
+// nearestInRange returns the enemy unit nearest to p's end of the lanes tower t defends,
+// within TowerRange, or nil
+func (m *Match) nearestInRange(p *Player, t *Tower) *Unit {
+	home, _ := m.end(p.Username)
+	var target *Unit
+	for _, u := range m.Field {
+		if u.Owner == p.Username || u.HP <= 0 || abs(u.Pos-home) > m.Rules.Arena.TowerRange || !defends(p, t, u.Lane) {
+			continue
+		}
+		if target == nil || abs(u.Pos-home) < abs(target.Pos-home) {
+			target = u
+		}
+	}
+	return target
+}
+
+// defends reports whether tower t of p shoots into lane
+func defends(p *Player, t *Tower, lane string) bool {
+	if t.Role == RoleKing {
+		return true
+	}
+	for _, g := range laneGuards(p, lane) {
+		if g == t {
+			return true
+		}
+	}
+	return false
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// Difficulty sets how a computer-controlled player picks its deploys
+type Difficulty string
+
+const (
+	Easy   Difficulty = "easy"   // any legal deploy, at random
+	Medium Difficulty = "medium" // the deploy with the best immediate outcome
+	Hard   Difficulty = "hard"   // the deploy whose outcome holds up best against the opponent's best reply
+)
+
+// ParseDifficulty returns the difficulty named by s (case-insensitive)
+func ParseDifficulty(s string) (Difficulty, bool) {
+	switch d := Difficulty(strings.ToLower(s)); d {
+	case Easy, Medium, Hard:
+		return d, true
+	}
+	return "", false
+}
+
+// Clone returns a deep copy of the match for trying out actions.
+// The copy gets a fresh random source seeded with Seed, so simulating on it never
+// advances the original's rolls.
+func (m *Match) Clone() *Match {
+	c := NewMatch(m.Mode, m.Rules, m.Seed)
+	c.Order = append([]string(nil), m.Order...)
+	c.TurnUser = m.TurnUser
+	c.Winner = m.Winner
+	c.Over = m.Over
+	c.Phase = m.Phase
+	c.units = m.units
+	for _, u := range m.Field {
+		uc := *u
+		c.Field = append(c.Field, &uc)
+	}
+	for k, v := range m.AttackPatterns {
+		c.AttackPatterns[k] = v
+	}
+	for name, p := range m.Players {
+		cp := &Player{Username: p.Username, Mana: p.Mana, Towers: map[string]*Tower{}}
+		cp.Effects = append([]Effect(nil), p.Effects...)
+		for spell, left := range p.Cooldowns {
+			if cp.Cooldowns == nil {
+				cp.Cooldowns = map[string]int{}
+			}
+			cp.Cooldowns[spell] = left
+		}
+		for tn, t := range p.Towers {
+			tc := *t
+			tc.Effects = append([]Effect(nil), t.Effects...)
+			cp.Towers[tn] = &tc
+		}
+		for _, tr := range p.Troops {
+			tc := *tr
+			cp.Troops = append(cp.Troops, &tc)
+		}
+		c.Players[name] = cp
+	}
+	return c
+}
+
+// LegalDeploys returns every deploy the rules currently allow player to make
+func (m *Match) LegalDeploys(player string) []Deploy {
+	p, enemy := m.Players[player], m.Players[m.Opponent(player)]
+	if p == nil || enemy == nil || m.Over {
+		return nil
+	}
+	var moves []Deploy
+	seen := map[string]bool{}
+	for _, tr := range p.Troops {
+		if seen[tr.Name] {
+			continue // deploy always uses the first usable troop of a name
+		}
+		seen[tr.Name] = true
+		for _, tower := range enemy.TowerNames() {
+			d := Deploy{Player: player, Troop: tr.Name, Tower: tower}
+			if _, err := m.Clone().Apply(d); err == nil {
+				moves = append(moves, d)
+			}
+		}
+	}
+	return moves
+}
+
+// PlanDeploy picks a deploy for player at the given difficulty.
+// rng only drives the easy bot's choice; it is separate from the match's own source.
+// ok is false when player has no legal deploy.
+func PlanDeploy(m *Match, player string, d Difficulty, rng *rand.Rand) (Deploy, bool) {
+	moves := m.LegalDeploys(player)
+	if len(moves) == 0 {
+		return Deploy{}, false
+	}
+	if d == Easy {
+		return moves[rng.Intn(len(moves))], true
+	}
+	best, bestScore := moves[0], math.Inf(-1)
+	for _, mv := range moves {
+		sim := m.Clone()
+		sim.Apply(mv)
+		score := Evaluate(sim, player)
+		if d == Hard && !sim.Over {
+			// Assume the opponent answers with the reply that hurts most
+			for _, reply := range sim.LegalDeploys(sim.Opponent(player)) {
+				next := sim.Clone()
+				next.Apply(reply)
+				if s := Evaluate(next, player); s < score {
+					score = s
+				}
+			}
+		}
+		if score > bestScore {
+			best, bestScore = mv, score
+		}
+	}
+	return best, true
+}
+
+// Evaluate scores the match from player's point of view; higher is better
+func Evaluate(m *Match, player string) float64 {
+	if m.Over {
+		switch m.Winner {
+		case player:
+			return 1e9
+		case Draw:
+			return 0
+		}
+		return -1e9
+	}
+	me, enemy := m.Players[player], m.Players[m.Opponent(player)]
+	if me == nil || enemy == nil {
+		return 0
+	}
+	score := float64(SumTowerHP(me.Towers) - SumTowerHP(enemy.Towers))
+	score += 1000 * float64(CountAliveTowers(me.Towers)-CountAliveTowers(enemy.Towers))
+	score += 0.5 * float64(troopHP(me)-troopHP(enemy)) // troops left are future damage
+	score += m.fieldStrength(me.Username) - m.fieldStrength(enemy.Username)
+	return score
+}
+
+// troopHP returns the total HP of a player's troops
+func troopHP(p *Player) int {
+	total := 0
+	for _, tr := range p.Troops {
+		total += tr.HP
+	}
+	return total
+}
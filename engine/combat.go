@@ -0,0 +1,251 @@
+package engine
+
+import "fmt"
+
+// deploy resolves one troop-versus-tower exchange
+func (m *Match) deploy(a Deploy) ([]Event, error) {
+	player := m.Players[a.Player]
+	if player == nil {
+		return nil, errNotInGame
+	}
+	if m.Rules.TurnBased && m.TurnUser != a.Player {
+		return nil, errNotYourTurn
+	}
+	var troop *Troop
+	for _, t := range player.Troops {
+		// Support troops (the Queen) can be used even with HP=0 while in the hand
+		if t.Name == a.Troop && (t.HP > 0 || t.Support()) {
+			troop = t
+			break
+		}
+	}
+	if troop == nil {
+		return nil, errInvalidTroop
+	}
+	enemyName := m.Opponent(a.Player)
+	enemy := m.Players[enemyName]
+	if enemy == nil {
+		return nil, errNoOpponent
+	}
+	if m.Rules.Units {
+		return m.deployUnit(player, enemy, troop, a.Tower)
+	}
+	if err := m.checkTarget(a.Player, enemy, a.Tower); err != nil {
+		return nil, err
+	}
+	tower := enemy.Towers[a.Tower]
+
+	// Troop attacks tower, raged troops harder; shields on the tower absorb damage first
+	atk := troop.ATK + troop.ATK*player.rage()/100
+	damage, absorbed := damageTower(tower, max0(atk-tower.DEF))
+
+	// Abilities act before the counter-attack, so a stun can stop it
+	abilities := m.useAbility(player, enemy, troop.Name, troop.Ability, tower)
+
+	// Turn-based matches end once either side has no troops left, checked before the
+	// counter-attack as the original SIMPLE rules do
+	if m.Rules.TurnBased && (CountAliveTroops(player) == 0 || CountAliveTroops(enemy) == 0) {
+		events := []Event{{Kind: EventAttack, Player: a.Player, Troop: troop.Name, Tower: tower.Name,
+			Damage: damage, TowerHP: tower.HP, TroopHP: troop.HP, Destroyed: tower.HP <= 0}}
+		events = append(events, absorbed...)
+		events = append(events, abilities...)
+		return append(events, m.decideByTowers()), nil
+	}
+
+	// Tower counter-attacks troop, possibly with a critical hit, unless stunned
+	crit, counterDamage := false, 0
+	if !tower.hasEffect(AbilityStun) {
+		crit = m.Rules.Crit && m.rng.Float64() < tower.CRIT
+		counterATK := tower.ATK
+		if crit {
+			counterATK = int(float64(counterATK) * m.Rules.CritMultiplier)
+		}
+		counterDamage = max0(counterATK - troop.DEF)
+	}
+	troop.HP = max0(troop.HP - counterDamage)
+
+	events := []Event{{
+		Kind:          EventAttack,
+		Player:        a.Player,
+		Troop:         troop.Name,
+		Tower:         tower.Name,
+		Damage:        damage,
+		TowerHP:       tower.HP,
+		CounterDamage: counterDamage,
+		TroopHP:       troop.HP,
+		Crit:          crit,
+		Destroyed:     tower.HP <= 0,
+	}}
+	events = append(events, absorbed...)
+	events = append(events, abilities...)
+
+	// Win by King destroyed
+	if king := enemy.King(); king != nil && king.HP <= 0 {
+		return append(events, m.finish(a.Player, ReasonKingDestroyed, [2]int{})), nil
+	}
+	if m.Rules.TurnBased {
+		// Each turn runs lasting effects once; poison may finish a King
+		events = append(events, m.advanceEffects()...)
+		if over, ok := m.kingFallen(); ok {
+			return append(events, over), nil
+		}
+		m.TurnUser = enemyName
+		events = append(events, Event{Kind: EventTurn, Player: enemyName})
+	}
+	return events, nil
+}
+
+// checkTarget enforces the tower attack order by role:
+// a guard must fall before the King, and the first guard attacked must be finished first
+func (m *Match) checkTarget(username string, enemy *Player, towerName string) error {
+	tower, ok := enemy.Towers[towerName]
+	first, hasPattern := m.AttackPatterns[username]
+	if ok && tower.Role == RoleKing {
+		if allGuardsStanding(enemy) {
+			return errKingLocked
+		}
+	} else if ok && tower.Role == RoleGuard && hasPattern && first != towerName && enemy.Towers[first].HP > 0 {
+		// The first guard tower is not yet destroyed, prevent switch
+		return &RuleError{Code: CodeGuardLocked, Msg: fmt.Sprintf("You must destroy %s Tower first before attacking %s Tower", first, towerName)}
+	}
+	if !ok || tower.HP <= 0 {
+		return errInvalidTower
+	}
+	if !hasPattern && tower.Role == RoleGuard {
+		// First time attacking a guard tower - record the choice
+		m.AttackPatterns[username] = towerName
+	}
+	return nil
+}
+
+// allGuardsStanding reports whether every guard tower of p is still standing
+func allGuardsStanding(p *Player) bool {
+	guards := 0
+	for _, t := range p.Towers {
+		if t.Role == RoleGuard {
+			if t.HP <= 0 {
+				return false
+			}
+			guards++
+		}
+	}
+	return guards > 0
+}
+
+// weakestTower returns the player's standing tower with the lowest HP, or nil
+func weakestTower(p *Player) *Tower {
+	var weakest *Tower
+	for _, name := range p.TowerNames() {
+		t := p.Towers[name]
+		if t.HP > 0 && (weakest == nil || t.HP < weakest.HP) {
+			weakest = t
+		}
+	}
+	return weakest
+}
+
+// buy adds a troop to the player's hand if they can afford it
+func (m *Match) buy(a Buy) ([]Event, error) {
+	p := m.Players[a.Player]
+	if p == nil {
+		return nil, errNotInGame
+	}
+	if p.Mana < a.Cost {
+		return nil, errNoMana
+	}
+	p.Mana -= a.Cost
+	troop := a.Troop
+	troop.Owner = a.Player
+	p.Troops = append(p.Troops, &troop)
+	return []Event{{Kind: EventBought, Player: a.Player, Troop: troop.Name}}, nil
+}
+
+// tick regenerates mana up to the cap, twice as fast in overtime, runs down spell
+// cooldowns and runs lasting ability effects
+func (m *Match) tick() []Event {
+	regen := m.Rules.ManaRegen
+	if m.Phase != PhaseRegular {
+		regen *= 2
+	}
+	for _, p := range m.Players {
+		p.Mana += regen
+		if p.Mana > m.Rules.ManaCap {
+			p.Mana = m.Rules.ManaCap
+		}
+		for spell, left := range p.Cooldowns {
+			if left <= 1 {
+				delete(p.Cooldowns, spell)
+			} else {
+				p.Cooldowns[spell] = left - 1
+			}
+		}
+	}
+	events := m.advanceEffects()
+	if over, ok := m.kingFallen(); ok {
+		events = append(events, over)
+	}
+	return events
+}
+
+// kingFallen ends the match if a King has fallen outside an attack (to poison):
+// its owner's opponent wins
+func (m *Match) kingFallen() (Event, bool) {
+	for _, uname := range m.Order {
+		if king := m.Players[uname].King(); king != nil && king.HP <= 0 {
+			winner := m.Opponent(uname)
+			if winner == "" {
+				winner = Draw
+			}
+			return m.finish(winner, ReasonKingDestroyed, [2]int{}), true
+		}
+	}
+	return Event{}, false
+}
+
+// decideByTowers ends the match on tower count, breaking ties with total tower HP
+func (m *Match) decideByTowers() Event {
+	a, b := m.Order[0], m.Order[1]
+	aliveA := CountAliveTowers(m.Players[a].Towers)
+	aliveB := CountAliveTowers(m.Players[b].Towers)
+	switch {
+	case aliveA > aliveB:
+		return m.finish(a, ReasonMoreTowers, [2]int{aliveA, aliveB})
+	case aliveB > aliveA:
+		return m.finish(b, ReasonMoreTowers, [2]int{aliveB, aliveA})
+	}
+	hpA := SumTowerHP(m.Players[a].Towers)
+	hpB := SumTowerHP(m.Players[b].Towers)
+	switch {
+	case hpA > hpB:
+		return m.finish(a, ReasonTowerHP, [2]int{hpA, hpB})
+	case hpB > hpA:
+		return m.finish(b, ReasonTowerHP, [2]int{hpB, hpA})
+	}
+	return m.finish(Draw, ReasonTowerHP, [2]int{hpA, hpB})
+}
+
+// forfeit ends the match in favour of the player who stayed
+func (m *Match) forfeit(a Forfeit) ([]Event, error) {
+	if m.Players[a.Player] == nil {
+		return nil, errNotInGame
+	}
+	winner := m.Opponent(a.Player)
+	if winner == "" {
+		winner = Draw
+	}
+	return []Event{m.finish(winner, ReasonForfeit, [2]int{})}, nil
+}
+
+// finish marks the match over and returns the GAME_OVER event
+func (m *Match) finish(winner, reason string, scores [2]int) Event {
+	m.Over = true
+	m.Winner = winner
+	return Event{Kind: EventGameOver, Winner: winner, Reason: reason, Scores: scores, Seed: m.Seed}
+}
+
+func max0(v int) int {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
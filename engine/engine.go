@@ -0,0 +1,237 @@
+// Package engine implements the TCR combat rules shared by SIMPLE and ENHANCED matches.
+// It performs no I/O: the server applies player actions to a Match and turns the
+// returned events into protocol messages.
+package engine
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// Mode selects the rule set of a match
+type Mode string
+
+const (
+	ModeSimple   Mode = "SIMPLE"   // turn-based, game ends when a player runs out of troops
+	ModeEnhanced Mode = "ENHANCED" // real-time with mana, crit and a match timer
+)
+
+// Draw is the Winner value of a match that ended without a winner
+const Draw = "DRAW"
+
+type Tower struct {
+	Name string
+	Role string // RoleKing or RoleGuard
+	HP   int
+	ATK  int
+	DEF  int
+	CRIT float64 // chance that the tower's counter-attack is a critical hit
+	// MaxHP is the tower's HP when the match started, set by AddPlayer
+	MaxHP int `json:",omitempty"`
+
+	Effects  []Effect `json:",omitempty"` // shields, poison and stuns acting on the tower
+	HitSpeed int      `json:",omitempty"` // steps from one shot at a unit to the next; 0 means every step
+	Reload   int      `json:",omitempty"` // steps until the tower can shoot again
+}
+
+type Troop struct {
+	Name    string
+	HP      int
+	ATK     int
+	DEF     int
+	Owner   string   // Username
+	Ability *Ability `json:",omitempty"` // special effect used when the troop is deployed, see ability.go
+	// HP = 0 means the troop is dead or used up
+
+	HitSpeed int    `json:",omitempty"` // steps from one attack to the next on the field; 0 means every step
+	Targets  string `json:",omitempty"` // what it attacks on the field: HitsAny ("") or HitsTowers
+}
+
+// Player is one side of a match
+type Player struct {
+	Username  string
+	Towers    map[string]*Tower
+	Troops    []*Troop
+	Mana      int
+	Effects   []Effect       `json:",omitempty"` // effects on the whole side, such as rage
+	Cooldowns map[string]int `json:",omitempty"` // spell -> ticks until it can be cast again
+}
+
+// TowerNames returns the player's tower names in a fixed order: guards by name, then the King
+func (p *Player) TowerNames() []string {
+	names := make([]string, 0, len(p.Towers))
+	for name := range p.Towers {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ki, kj := p.Towers[names[i]].Role == RoleKing, p.Towers[names[j]].Role == RoleKing
+		if ki != kj {
+			return kj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// King returns the player's King tower, or nil
+func (p *Player) King() *Tower {
+	for _, t := range p.Towers {
+		if t.Role == RoleKing {
+			return t
+		}
+	}
+	return nil
+}
+
+// Rules holds the tunable parameters of a match
+type Rules struct {
+	TurnBased      bool    // players alternate turns and the match ends when one side has no troops left
+	Crit           bool    // towers may land critical counter-attacks
+	CritMultiplier float64 // counter-attack multiplier on a critical hit
+	HealAmount     int     // HP restored by a heal ability that sets no amount
+	ManaCap        int     // maximum mana
+	ManaRegen      int     // mana gained per Tick
+	Units          bool    // deployed troops stay on the field and fight every Step (see field.go); false resolves a deploy as one exchange
+	Arena          *Arena  // lanes the units walk down; nil for one melee, see arena.go
+	Overtime       bool    // a tie when time runs out goes to a double mana period, see overtime.go
+	SuddenDeath    bool    // a tie after regulation and overtime goes to sudden death
+}
+
+// SimpleRules returns the rules of a SIMPLE match
+func SimpleRules() Rules {
+	return Rules{TurnBased: true, HealAmount: 300}
+}
+
+// EnhancedRules returns the rules of an ENHANCED match
+func EnhancedRules() Rules {
+	return Rules{Crit: true, CritMultiplier: 1.2, HealAmount: 300, ManaCap: 10, ManaRegen: 1, Units: true}
+}
+
+// Match is the full combat state of one game
+type Match struct {
+	Mode           Mode
+	Rules          Rules              `json:"-"`
+	Players        map[string]*Player // username -> state
+	Order          []string           // usernames in join order
+	TurnUser       string             // whose turn it is (turn-based rules only)
+	Winner         string             // username, Draw, or "" while running
+	Over           bool
+	AttackPatterns map[string]string // tracks which guard tower each player is attacking first
+	Seed           int64             // seed of the match's random source; same seed and actions replay the same match
+	Phase          string            `json:",omitempty"` // PhaseRegular, PhaseOvertime or PhaseSuddenDeath
+	Field          []*Unit           `json:",omitempty"` // units on the field, in deploy order
+	units          int               // units deployed so far, which numbers them
+	rng            *rand.Rand
+}
+
+// NewMatch creates an empty match whose random rolls all come from a source seeded with seed
+func NewMatch(mode Mode, rules Rules, seed int64) *Match {
+	return &Match{
+		Mode:           mode,
+		Rules:          rules,
+		Players:        map[string]*Player{},
+		AttackPatterns: map[string]string{},
+		Seed:           seed,
+		rng:            rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Rand returns the match's random source, for setup steps such as dealing troops
+func (m *Match) Rand() *rand.Rand {
+	return m.rng
+}
+
+// AddPlayer adds a side to the match; the first player added starts on turn-based rules
+// unless SetTurn is called
+func (m *Match) AddPlayer(p *Player) {
+	for _, t := range p.Towers {
+		if t.MaxHP == 0 {
+			t.MaxHP = t.HP
+		}
+	}
+	m.Players[p.Username] = p
+	m.Order = append(m.Order, p.Username)
+	if m.TurnUser == "" && m.Rules.TurnBased {
+		m.TurnUser = p.Username
+	}
+}
+
+// SetTurn gives the turn to username
+func (m *Match) SetTurn(username string) {
+	m.TurnUser = username
+}
+
+// Opponent returns the username of the other player, or ""
+func (m *Match) Opponent(username string) string {
+	for _, uname := range m.Order {
+		if uname != username {
+			return uname
+		}
+	}
+	return ""
+}
+
+// Apply validates and executes one action, returning the events it produced.
+// A rejected action leaves the match unchanged and returns a *RuleError.
+func (m *Match) Apply(a Action) ([]Event, error) {
+	if m.Over {
+		return nil, errGameOver
+	}
+	events, err := m.apply(a)
+	if over, ok := m.suddenDeath(); ok && err == nil {
+		events = append(events, over)
+	}
+	return events, err
+}
+
+// apply executes one action of a running match
+func (m *Match) apply(a Action) ([]Event, error) {
+	switch a := a.(type) {
+	case Deploy:
+		return m.deploy(a)
+	case Buy:
+		return m.buy(a)
+	case Cast:
+		return m.cast(a)
+	case Tick:
+		return m.tick(), nil
+	case Step:
+		return m.step(), nil
+	case TimeUp:
+		return m.timeUp(), nil
+	case Forfeit:
+		return m.forfeit(a)
+	}
+	return nil, &RuleError{Code: CodeBadAction, Msg: "Unknown action"}
+}
+
+// CountAliveTroops returns the number of alive troops (HP > 0) for a player
+func CountAliveTroops(p *Player) int {
+	c := 0
+	for _, tr := range p.Troops {
+		if tr.HP > 0 {
+			c++
+		}
+	}
+	return c
+}
+
+// CountAliveTowers returns the number of alive towers (HP > 0)
+func CountAliveTowers(towers map[string]*Tower) int {
+	cnt := 0
+	for _, tw := range towers {
+		if tw.HP > 0 {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// SumTowerHP returns the total HP of all towers
+func SumTowerHP(towers map[string]*Tower) int {
+	total := 0
+	for _, tw := range towers {
+		total += tw.HP
+	}
+	return total
+}
@@ -0,0 +1,245 @@
+package engine
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// testPlayer returns a side with the stock towers and the given troops
+func testPlayer(username string, troops ...*Troop) *Player {
+	return &Player{
+		Username: username,
+		Towers: map[string]*Tower{
+			"King":   {Name: "King", Role: RoleKing, HP: 2000, ATK: 500, DEF: 300, CRIT: 0.1},
+			"Guard1": {Name: "Guard1", Role: RoleGuard, HP: 1000, ATK: 300, DEF: 100, CRIT: 0.05},
+			"Guard2": {Name: "Guard2", Role: RoleGuard, HP: 1000, ATK: 300, DEF: 100, CRIT: 0.05},
+		},
+		Troops: troops,
+	}
+}
+
+func knight() *Troop { return &Troop{Name: "Knight", HP: 200, ATK: 300, DEF: 150} }
+func pawn() *Troop   { return &Troop{Name: "Pawn", HP: 50, ATK: 150, DEF: 100} }
+
+// testMatch returns a match between a and b with a to move on turn-based rules
+func testMatch(rules Rules, seed int64, a, b *Player) *Match {
+	m := NewMatch(ModeSimple, rules, seed)
+	m.AddPlayer(a)
+	m.AddPlayer(b)
+	return m
+}
+
+// ruleCode returns the RuleError code of err, or ""
+func ruleCode(err error) string {
+	var rule *RuleError
+	if errors.As(err, &rule) {
+		return rule.Code
+	}
+	return ""
+}
+
+func TestApplyDeploy(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(m *Match)
+		deploy  Deploy
+		code    string // expected RuleError code, "" for success
+		towerHP int    // HP of the attacked tower afterwards
+		troopHP int    // HP of the deployed troop afterwards
+	}{
+		{name: "hits a guard and takes the counter-attack",
+			deploy: Deploy{Player: "a", Troop: "Knight", Tower: "Guard1"}, towerHP: 800, troopHP: 50},
+		{name: "not your turn",
+			deploy: Deploy{Player: "b", Troop: "Knight", Tower: "Guard1"}, code: CodeNotYourTurn},
+		{name: "unknown troop",
+			deploy: Deploy{Player: "a", Troop: "Dragon", Tower: "Guard1"}, code: CodeInvalidTroop},
+		{name: "dead troop",
+			setup:  func(m *Match) { m.Players["a"].Troops[0].HP = 0 },
+			deploy: Deploy{Player: "a", Troop: "Knight", Tower: "Guard1"}, code: CodeInvalidTroop},
+		{name: "destroyed tower",
+			setup:  func(m *Match) { m.Players["b"].Towers["Guard1"].HP = 0 },
+			deploy: Deploy{Player: "a", Troop: "Knight", Tower: "Guard1"}, code: CodeInvalidTower},
+		{name: "king locked while both guards stand",
+			deploy: Deploy{Player: "a", Troop: "Knight", Tower: "King"}, code: CodeKingLocked},
+		{name: "king open once a guard falls",
+			setup:  func(m *Match) { m.Players["b"].Towers["Guard2"].HP = 0 },
+			deploy: Deploy{Player: "a", Troop: "Knight", Tower: "King"}, towerHP: 2000, troopHP: 0},
+		{name: "first guard must fall before the second",
+			setup:  func(m *Match) { m.AttackPatterns["a"] = "Guard1" },
+			deploy: Deploy{Player: "a", Troop: "Knight", Tower: "Guard2"}, code: CodeGuardLocked},
+		{name: "second guard open once the first falls",
+			setup: func(m *Match) {
+				m.AttackPatterns["a"] = "Guard1"
+				m.Players["b"].Towers["Guard1"].HP = 0
+			},
+			deploy: Deploy{Player: "a", Troop: "Knight", Tower: "Guard2"}, towerHP: 800, troopHP: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testMatch(SimpleRules(), 1, testPlayer("a", knight(), pawn()), testPlayer("b", knight(), pawn()))
+			if tt.setup != nil {
+				tt.setup(m)
+			}
+			_, err := m.Apply(tt.deploy)
+			if got := ruleCode(err); got != tt.code {
+				t.Fatalf("error code = %q (%v), want %q", got, err, tt.code)
+			}
+			if tt.code != "" {
+				return
+			}
+			if hp := m.Players["b"].Towers[tt.deploy.Tower].HP; hp != tt.towerHP {
+				t.Errorf("tower HP = %d, want %d", hp, tt.towerHP)
+			}
+			if hp := m.Players["a"].Troops[0].HP; hp != tt.troopHP {
+				t.Errorf("troop HP = %d, want %d", hp, tt.troopHP)
+			}
+			if m.TurnUser != "b" {
+				t.Errorf("turn = %q, want b", m.TurnUser)
+			}
+		})
+	}
+}
+
+func TestApplyCritIsSeeded(t *testing.T) {
+	rules := Rules{Crit: true, CritMultiplier: 2}
+	tests := []struct {
+		name string
+		crit float64
+		seed int64
+	}{
+		{"never", 0, 1},
+		{"always", 1, 1},
+		{"even odds, seed 1", 0.5, 1},
+		{"even odds, seed 2", 0.5, 2},
+		{"even odds, seed 3", 0.5, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testPlayer("b")
+			b.Towers["Guard1"].CRIT = tt.crit
+			m := testMatch(rules, tt.seed, testPlayer("a", &Troop{Name: "Prince", HP: 1000, ATK: 400, DEF: 0}), b)
+			events, err := m.Apply(Deploy{Player: "a", Troop: "Prince", Tower: "Guard1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The crit roll is the first draw from the match's source
+			wantCrit := rand.New(rand.NewSource(tt.seed)).Float64() < tt.crit
+			wantDamage := 300
+			if wantCrit {
+				wantDamage = 600
+			}
+			if ev := events[0]; ev.Crit != wantCrit || ev.CounterDamage != wantDamage {
+				t.Errorf("crit %v for %d, want crit %v for %d", ev.Crit, ev.CounterDamage, wantCrit, wantDamage)
+			}
+		})
+	}
+}
+
+func TestApplyQueenHeal(t *testing.T) {
+	queen := &Troop{Name: "Queen", Ability: &Ability{Kind: AbilityHeal, Target: TargetWeakestOwn}}
+	a := testPlayer("a", queen, knight())
+	a.Towers["Guard2"].HP = 400
+	m := testMatch(SimpleRules(), 1, a, testPlayer("b", knight()))
+	events, err := m.Apply(Deploy{Player: "a", Troop: "Queen", Tower: "Guard1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hp := a.Towers["Guard2"].HP; hp != 700 {
+		t.Errorf("healed tower HP = %d, want 700", hp)
+	}
+	var heal *Event
+	for i := range events {
+		if events[i].Kind == EventAbility {
+			heal = &events[i]
+		}
+	}
+	if heal == nil || heal.Ability != AbilityHeal || heal.Tower != "Guard2" || heal.Amount != 300 {
+		t.Errorf("heal event = %+v, want heal of 300 on Guard2", heal)
+	}
+}
+
+func TestApplyGameEndByTowers(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(a, b *Player)
+		winner string
+		reason string
+		scores [2]int
+	}{
+		{name: "more towers alive",
+			setup:  func(a, b *Player) { b.Towers["Guard2"].HP = 0 },
+			winner: "a", reason: ReasonMoreTowers, scores: [2]int{3, 2}},
+		{name: "equal towers, higher total HP",
+			winner: "a", reason: ReasonTowerHP, scores: [2]int{4000, 3800}},
+		{name: "equal towers, lower total HP",
+			setup:  func(a, b *Player) { a.Towers["King"].HP = 1700 },
+			winner: "b", reason: ReasonTowerHP, scores: [2]int{3800, 3700}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// b has no troops left, so a's deploy ends the match
+			a, b := testPlayer("a", knight()), testPlayer("b")
+			if tt.setup != nil {
+				tt.setup(a, b)
+			}
+			m := testMatch(SimpleRules(), 1, a, b)
+			events, err := m.Apply(Deploy{Player: "a", Troop: "Knight", Tower: "Guard1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			over := events[len(events)-1]
+			if over.Kind != EventGameOver || over.Winner != tt.winner || over.Reason != tt.reason || over.Scores != tt.scores {
+				t.Errorf("end = %+v, want %s by %s %v", over, tt.winner, tt.reason, tt.scores)
+			}
+			if !m.Over {
+				t.Error("match not over")
+			}
+			// The out-of-troops check comes before the counter-attack
+			if hp := a.Troops[0].HP; hp != 200 {
+				t.Errorf("troop HP = %d, want 200 (no counter-attack)", hp)
+			}
+		})
+	}
+}
+
+func TestApplySupportTroopUsedOnce(t *testing.T) {
+	monk := &Troop{Name: "Monk", Ability: &Ability{Kind: AbilityShield, Amount: 250, Target: TargetWeakestOwn}}
+	a := testPlayer("a", monk, knight())
+	m := testMatch(EnhancedRules(), 1, a, testPlayer("b", knight()))
+	if _, err := m.Apply(Deploy{Player: "a", Troop: "Monk", Tower: "Guard1"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.Apply(Deploy{Player: "a", Troop: "Monk", Tower: "Guard1"})
+	if got := ruleCode(err); got != CodeInvalidTroop {
+		t.Fatalf("second Monk deploy: error code = %q (%v), want %q", got, err, CodeInvalidTroop)
+	}
+	if len(a.Troops) != 1 || a.Troops[0].Name != "Knight" {
+		t.Errorf("hand = %v, want only the Knight", a.Troops)
+	}
+}
+
+func TestShieldsDoNotStack(t *testing.T) {
+	a := testPlayer("a", &Troop{Name: "Monk", Ability: &Ability{Kind: AbilityShield, Amount: 250, Target: TargetOwnKing}})
+	m := testMatch(SimpleRules(), 1, a, testPlayer("b", knight()))
+	king := a.Towers["King"]
+	king.Effects = []Effect{{Kind: AbilityShield, Amount: 100}}
+	if _, err := m.Apply(Deploy{Player: "a", Troop: "Monk", Tower: "Guard1"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(king.Effects) != 1 || king.Effects[0].Amount != 250 {
+		t.Errorf("shields = %+v, want one of 250", king.Effects)
+	}
+}
+
+func TestLowestTowerCappedAtFullHP(t *testing.T) {
+	a, b := testPlayer("a", knight()), testPlayer("b", knight())
+	m := testMatch(EnhancedRules(), 1, a, b)
+	for _, tower := range a.Towers {
+		tower.HP += 200 // healed past its starting HP
+	}
+	over := m.decideByLowestTower()
+	if over.Winner != Draw || over.Reason != ReasonLowestTower || over.Scores != [2]int{100, 100} {
+		t.Errorf("end = %+v, want a draw at 100%% each", over)
+	}
+}
@@ -0,0 +1,37 @@
+package engine
+
+// RuleError is returned by Apply when an action breaks the rules.
+// Code is stable and machine-readable; Msg is shown to players.
+type RuleError struct {
+	Code string
+	Msg  string
+}
+
+func (e *RuleError) Error() string { return e.Msg }
+
+// Rule error codes
+const (
+	CodeGameOver         = "GAME_OVER"
+	CodeNotYourTurn      = "NOT_YOUR_TURN"
+	CodeInvalidTroop     = "INVALID_TROOP"
+	CodeInvalidTower     = "INVALID_TOWER"
+	CodeInvalidSpell     = "INVALID_SPELL"
+	CodeKingLocked       = "KING_LOCKED"
+	CodeGuardLocked      = "GUARD_LOCKED"
+	CodeInsufficientMana = "INSUFFICIENT_MANA"
+	CodeOnCooldown       = "ON_COOLDOWN"
+	CodeNoOpponent       = "NO_OPPONENT"
+	CodeNotInGame        = "NOT_IN_GAME"
+	CodeBadAction        = "BAD_ACTION"
+)
+
+var (
+	errGameOver     = &RuleError{Code: CodeGameOver, Msg: "Game is over"}
+	errNotYourTurn  = &RuleError{Code: CodeNotYourTurn, Msg: "Not your turn"}
+	errInvalidTroop = &RuleError{Code: CodeInvalidTroop, Msg: "Invalid or dead troop"}
+	errInvalidTower = &RuleError{Code: CodeInvalidTower, Msg: "Invalid or destroyed tower"}
+	errKingLocked   = &RuleError{Code: CodeKingLocked, Msg: "Must destroy a Guard tower before attacking the King"}
+	errNoMana       = &RuleError{Code: CodeInsufficientMana, Msg: "Not enough mana"}
+	errNoOpponent   = &RuleError{Code: CodeNoOpponent, Msg: "No opponent"}
+	errNotInGame    = &RuleError{Code: CodeNotInGame, Msg: "Not in game"}
+)
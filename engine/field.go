@@ -0,0 +1,249 @@
+package engine
+
+// On rules with Units (ENHANCED) a deployed troop is not resolved at once: it stays on
+// the field as a Unit until it falls. Every Step, units whose hit speed allows attack the
+// weakest enemy unit they can reach, or else the tower they are after, and towers shoot
+// the units attacking them. Support troops still act at once and never take the field.
+//
+// Without an arena the field is one melee: every unit reaches every enemy unit, and a
+// unit attacks the tower it was deployed at, then the next standing one when it falls.
+// With an arena (arena.go) units walk lanes and only reach what is next to them.
+
+// What a unit attacks, from its troop's Targets
+const (
+	HitsAny    = "any"    // enemy units in reach first, then towers; also ""
+	HitsTowers = "towers" // towers only: enemy units neither stop nor distract it
+)
+
+// Unit is a deployed troop on the field
+type Unit struct {
+	ID       int
+	Name     string
+	Owner    string
+	Tower    string `json:",omitempty"` // tower the unit is after, without an arena
+	Lane     string `json:",omitempty"` // arena lane
+	Pos      int    // arena cells from the first player's end of the lane
+	HP       int
+	ATK      int
+	DEF      int
+	HitSpeed int      `json:",omitempty"` // steps from one attack to the next; 0 means every step
+	Reload   int      `json:",omitempty"` // steps until the unit can attack again
+	Targets  string   `json:",omitempty"` // HitsAny or HitsTowers
+	Ability  *Ability `json:",omitempty"` // used on the first tower the unit hits
+}
+
+// deployUnit puts a troop on the field, aimed at target: an enemy tower, or with an
+// arena also a lane. Support troops do not take the field: their ability acts at once
+// and they leave the hand.
+func (m *Match) deployUnit(player, enemy *Player, troop *Troop, target string) ([]Event, error) {
+	u := &Unit{Name: troop.Name, Owner: player.Username, HP: troop.HP, ATK: troop.ATK, DEF: troop.DEF,
+		HitSpeed: troop.HitSpeed, Targets: troop.Targets, Ability: troop.Ability}
+	if m.Rules.Arena != nil {
+		lane, err := laneFor(enemy, target)
+		if err != nil {
+			return nil, err
+		}
+		u.Lane = lane
+		u.Pos, _ = m.end(player.Username)
+	} else {
+		if err := m.checkTarget(player.Username, enemy, target); err != nil {
+			return nil, err
+		}
+		u.Tower = target
+	}
+	if troop.Support() {
+		player.discard(troop)
+		return m.useAbility(player, enemy, troop.Name, troop.Ability, nil), nil
+	}
+	m.units++
+	u.ID = m.units
+	troop.HP = 0 // the troop has left the hand
+	m.Field = append(m.Field, u)
+	return []Event{{Kind: EventDeployed, Player: player.Username, Troop: u.Name, Unit: u.ID, Lane: u.Lane, Pos: u.Pos, Tower: u.Tower}}, nil
+}
+
+// discard removes a troop from the player's hand
+func (p *Player) discard(troop *Troop) {
+	for i, t := range p.Troops {
+		if t == troop {
+			p.Troops = append(p.Troops[:i:i], p.Troops[i+1:]...)
+			return
+		}
+	}
+}
+
+// step runs one simulation step of the field and ends the match if a King fell
+func (m *Match) step() []Event {
+	events := m.stepField()
+	if over, ok := m.kingFallen(); ok {
+		events = append(events, over)
+	}
+	return events
+}
+
+// stepField lets every unit move and attack in the order it was deployed, then the
+// towers shoot, then fallen units leave the field
+func (m *Match) stepField() []Event {
+	var events []Event
+	for _, u := range m.Field {
+		if u.HP > 0 {
+			events = append(events, m.act(u)...)
+		}
+	}
+	for _, uname := range m.Order {
+		events = append(events, m.shoot(m.Players[uname])...)
+	}
+	alive := m.Field[:0]
+	for _, u := range m.Field {
+		if u.HP > 0 {
+			alive = append(alive, u)
+		}
+	}
+	m.Field = alive
+	return events
+}
+
+// act walks a unit in the arena, then, if it is loaded, attacks its pick of target
+func (m *Match) act(u *Unit) []Event {
+	owner := m.Players[u.Owner]
+	enemy := m.Players[m.Opponent(u.Owner)]
+	if owner == nil || enemy == nil {
+		return nil
+	}
+	if m.Rules.Arena != nil {
+		m.walk(u, enemy)
+	}
+	if u.Reload > 0 {
+		u.Reload--
+		return nil
+	}
+	atk := u.ATK + u.ATK*owner.rage()/100
+	if foe := m.pickFoe(u); foe != nil {
+		u.Reload = reloadTime(u.HitSpeed)
+		damage := max0(atk - foe.DEF)
+		foe.HP = max0(foe.HP - damage)
+		return []Event{{Kind: EventClash, Player: u.Owner, Troop: u.Name, Unit: u.ID, Lane: u.Lane, Pos: u.Pos,
+			Target: foe.Owner, Foe: foe.Name, FoeUnit: foe.ID, Damage: damage, FoeHP: foe.HP, Killed: foe.HP <= 0}}
+	}
+	tower := m.towerInReach(u, enemy)
+	if tower == nil {
+		return nil
+	}
+	u.Reload = reloadTime(u.HitSpeed)
+	damage, absorbed := damageTower(tower, max0(atk-tower.DEF))
+	events := []Event{{Kind: EventAttack, Player: u.Owner, Troop: u.Name, Unit: u.ID, Lane: u.Lane, Pos: u.Pos,
+		Tower: tower.Name, Damage: damage, TowerHP: tower.HP, TroopHP: u.HP, Destroyed: tower.HP <= 0}}
+	events = append(events, absorbed...)
+	if u.Ability != nil {
+		events = append(events, m.useAbility(owner, enemy, u.Name, u.Ability, tower)...)
+		u.Ability = nil // abilities fire once, on the first hit
+	}
+	return events
+}
+
+// pickFoe returns the enemy unit u attacks: the one with the least HP it can reach,
+// the earliest deployed on ties. nil if it reaches none or only attacks towers.
+func (m *Match) pickFoe(u *Unit) *Unit {
+	if u.Targets == HitsTowers {
+		return nil
+	}
+	var foe *Unit
+	for _, f := range m.Field {
+		if f.Owner == u.Owner || f.HP <= 0 {
+			continue
+		}
+		if m.Rules.Arena != nil && (f.Lane != u.Lane || abs(f.Pos-u.Pos) > 1) {
+			continue
+		}
+		if foe == nil || f.HP < foe.HP {
+			foe = f
+		}
+	}
+	return foe
+}
+
+// towerInReach returns the enemy tower u can hit now, or nil. Without an arena that is
+// the tower it was sent at or, once it falls, the enemy's next standing tower.
+func (m *Match) towerInReach(u *Unit, enemy *Player) *Tower {
+	if m.Rules.Arena != nil {
+		return m.laneTowerInReach(u, enemy)
+	}
+	if t := enemy.Towers[u.Tower]; t != nil && t.HP > 0 {
+		return t
+	}
+	for _, name := range enemy.TowerNames() { // guards first, then the King
+		if t := enemy.Towers[name]; t.HP > 0 {
+			u.Tower = name
+			return t
+		}
+	}
+	return nil
+}
+
+// shoot lets each of p's standing, loaded and unstunned towers shoot one enemy unit:
+// without an arena the first unit attacking it (any attacker, for the King), in the
+// arena the nearest unit in range in the lanes it defends
+func (m *Match) shoot(p *Player) []Event {
+	var events []Event
+	for _, name := range p.TowerNames() {
+		t := p.Towers[name]
+		if t.HP <= 0 {
+			continue
+		}
+		if t.Reload > 0 {
+			t.Reload--
+			continue
+		}
+		if t.hasEffect(AbilityStun) {
+			continue
+		}
+		target := m.towerTarget(p, t)
+		if target == nil {
+			continue
+		}
+		t.Reload = reloadTime(t.HitSpeed)
+		crit := m.Rules.Crit && m.rng.Float64() < t.CRIT
+		atk := t.ATK
+		if crit {
+			atk = int(float64(atk) * m.Rules.CritMultiplier)
+		}
+		damage := max0(atk - target.DEF)
+		target.HP = max0(target.HP - damage)
+		events = append(events, Event{Kind: EventShot, Player: p.Username, Tower: t.Name, Lane: target.Lane, Pos: target.Pos,
+			Target: target.Owner, Foe: target.Name, FoeUnit: target.ID, Damage: damage, FoeHP: target.HP, Crit: crit, Killed: target.HP <= 0})
+	}
+	return events
+}
+
+// towerTarget returns the enemy unit tower t of p shoots, or nil
+func (m *Match) towerTarget(p *Player, t *Tower) *Unit {
+	if m.Rules.Arena != nil {
+		return m.nearestInRange(p, t)
+	}
+	for _, u := range m.Field {
+		if u.Owner != p.Username && u.HP > 0 && (u.Tower == t.Name || t.Role == RoleKing) {
+			return u
+		}
+	}
+	return nil
+}
+
+// reloadTime returns the steps a unit or tower waits after attacking, given its hit speed
+func reloadTime(hitSpeed int) int {
+	if hitSpeed > 1 {
+		return hitSpeed - 1
+	}
+	return 0
+}
+
+// fieldStrength values username's units on the field for bots: their HP, like troops in
+// hand, plus their ATK, since they are damage already on its way
+func (m *Match) fieldStrength(username string) float64 {
+	total := 0.0
+	for _, u := range m.Field {
+		if u.Owner == username {
+			total += 0.5*float64(u.HP) + float64(u.ATK)
+		}
+	}
+	return total
+}
@@ -0,0 +1,109 @@
+package engine
+
+// Overtime of timed matches. When time runs out with both sides on the same number of
+// towers, rules with Overtime give a period of double mana regeneration, and rules with
+// SuddenDeath then a period in which the first side to lose a tower loses the match.
+// The server times each period and applies TimeUp when it runs out. A sudden death
+// that runs out is decided by the lowest tower: the side whose weakest standing tower
+// has the higher share of its starting HP wins.
+
+// Phases of a timed match, in Match.Phase
+const (
+	PhaseRegular     = ""             // regulation time
+	PhaseOvertime    = "OVERTIME"     // mana regenerates twice as fast
+	PhaseSuddenDeath = "SUDDEN_DEATH" // the first tower destroyed decides the match; mana stays doubled
+)
+
+// timeUp ends the current period of a timed match: more towers alive wins, equal counts
+// go to the next period the rules have, or are a draw in regulation time without overtime
+func (m *Match) timeUp() []Event {
+	if len(m.Order) < 2 {
+		return []Event{m.finish(Draw, ReasonMoreTowers, [2]int{})}
+	}
+	if m.Phase != PhaseSuddenDeath {
+		a, b := m.Order[0], m.Order[1]
+		aliveA := CountAliveTowers(m.Players[a].Towers)
+		aliveB := CountAliveTowers(m.Players[b].Towers)
+		switch {
+		case aliveA > aliveB:
+			return []Event{m.finish(a, ReasonMoreTowers, [2]int{aliveA, aliveB})}
+		case aliveB > aliveA:
+			return []Event{m.finish(b, ReasonMoreTowers, [2]int{aliveB, aliveA})}
+		}
+		if next := m.nextPhase(); next != "" {
+			m.Phase = next
+			return []Event{{Kind: EventPhase, Phase: next}}
+		}
+		if m.Phase == PhaseRegular {
+			return []Event{m.finish(Draw, ReasonMoreTowers, [2]int{aliveA, aliveB})}
+		}
+	}
+	return []Event{m.decideByLowestTower()}
+}
+
+// nextPhase returns the period that follows the current one on a tie, or "" if none
+func (m *Match) nextPhase() string {
+	if m.Phase == PhaseRegular && m.Rules.Overtime {
+		return PhaseOvertime
+	}
+	if m.Phase != PhaseSuddenDeath && m.Rules.SuddenDeath {
+		return PhaseSuddenDeath
+	}
+	return ""
+}
+
+// suddenDeath ends the match in sudden death once one side has lost more towers than
+// the other; sides are level when it starts, so that side lost the first tower
+func (m *Match) suddenDeath() (Event, bool) {
+	if m.Phase != PhaseSuddenDeath || m.Over || len(m.Order) < 2 {
+		return Event{}, false
+	}
+	a, b := m.Order[0], m.Order[1]
+	aliveA := CountAliveTowers(m.Players[a].Towers)
+	aliveB := CountAliveTowers(m.Players[b].Towers)
+	switch {
+	case aliveA > aliveB:
+		return m.finish(a, ReasonSuddenDeath, [2]int{aliveA, aliveB}), true
+	case aliveB > aliveA:
+		return m.finish(b, ReasonSuddenDeath, [2]int{aliveB, aliveA}), true
+	}
+	return Event{}, false
+}
+
+// decideByLowestTower ends the match on the HP percentage of each side's weakest
+// standing tower: the higher one wins, equal ones are a draw
+func (m *Match) decideByLowestTower() Event {
+	a, b := m.Order[0], m.Order[1]
+	pctA := lowestTowerPercent(m.Players[a])
+	pctB := lowestTowerPercent(m.Players[b])
+	switch {
+	case pctA > pctB:
+		return m.finish(a, ReasonLowestTower, [2]int{pctA, pctB})
+	case pctB > pctA:
+		return m.finish(b, ReasonLowestTower, [2]int{pctB, pctA})
+	}
+	return m.finish(Draw, ReasonLowestTower, [2]int{pctA, pctB})
+}
+
+// lowestTowerPercent returns the lowest HP of p's standing towers as a percentage of
+// the tower's starting HP, at most 100 as heals can push a tower past it; 0 if none stands
+func lowestTowerPercent(p *Player) int {
+	lowest := -1
+	for _, name := range p.TowerNames() {
+		t := p.Towers[name]
+		if t.HP <= 0 {
+			continue
+		}
+		pct := 100
+		if t.MaxHP > 0 {
+			pct = t.HP * 100 / t.MaxHP
+		}
+		if pct > 100 {
+			pct = 100
+		}
+		if lowest < 0 || pct < lowest {
+			lowest = pct
+		}
+	}
+	return max0(lowest)
+}
@@ -0,0 +1,61 @@
+package engine
+
+import "fmt"
+
+// Spell is a card that is cast rather than deployed: it never fights a tower, it only
+// applies its effect. Cooldown is in ticks.
+type Spell struct {
+	Name     string
+	Cost     int // mana
+	Cooldown int // ticks before the player can cast it again
+	Effect   Ability
+}
+
+// cast spends mana on a spell and applies its effect
+func (m *Match) cast(a Cast) ([]Event, error) {
+	p := m.Players[a.Player]
+	if p == nil {
+		return nil, errNotInGame
+	}
+	if m.Rules.TurnBased && m.TurnUser != a.Player {
+		return nil, errNotYourTurn
+	}
+	if left := p.Cooldowns[a.Spell.Name]; left > 0 {
+		return nil, &RuleError{Code: CodeOnCooldown, Msg: fmt.Sprintf("%s is on cooldown for %d more ticks", a.Spell.Name, left)}
+	}
+	if p.Mana < a.Spell.Cost {
+		return nil, errNoMana
+	}
+	enemy := m.Players[m.Opponent(a.Player)]
+	if enemy == nil {
+		return nil, errNoOpponent
+	}
+	var target *Tower
+	if a.Spell.Effect.NeedsTower() {
+		t, ok := enemy.Towers[a.Tower]
+		if !ok || t.HP <= 0 {
+			return nil, errInvalidTower
+		}
+		if t.Role == RoleKing && allGuardsStanding(enemy) {
+			return nil, errKingLocked
+		}
+		target = t
+	}
+	p.Mana -= a.Spell.Cost
+	if a.Spell.Cooldown > 0 {
+		if p.Cooldowns == nil {
+			p.Cooldowns = map[string]int{}
+		}
+		p.Cooldowns[a.Spell.Name] = a.Spell.Cooldown
+	}
+	ev := Event{Kind: EventCast, Player: a.Player, Troop: a.Spell.Name, Mana: p.Mana}
+	if target != nil {
+		ev.Tower = target.Name
+	}
+	effect := a.Spell.Effect
+	events := append([]Event{ev}, m.useAbility(p, enemy, a.Spell.Name, &effect, target)...)
+	if king := enemy.King(); king != nil && king.HP <= 0 {
+		events = append(events, m.finish(a.Player, ReasonKingDestroyed, [2]int{}))
+	}
+	return events, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Read-only HTTP/JSON API served next to the web client, for dashboards and tooling:
+//
+//	GET /users/{name}  level, EXP, rating, unit levels and recent matches
+//	GET /leaderboard   users ranked by rating (?limit=n, default 20)
+//	GET /rooms         every room with its mode and status
+//	GET /specs         the tower, troop and spell specs new matches use, with their version
+
+const leaderboardDefault = 20
+
+// registerAPI adds the API routes to mux
+func registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/users/", apiHandler(apiUser))
+	mux.HandleFunc("/leaderboard", apiHandler(apiLeaderboard))
+	mux.HandleFunc("/rooms", apiHandler(apiRooms))
+	mux.HandleFunc("/specs", apiHandler(apiSpecs))
+}
+
+// apiError is an API failure; its code and message mirror the protocol's ERR replies
+type apiError struct {
+	status int
+	code   string
+	msg    string
+}
+
+// apiHandler wraps an endpoint: only GET and HEAD are allowed, results and errors are written as JSON
+func apiHandler(fn func(r *http.Request) (interface{}, *apiError)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*") // read-only public data
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeAPI(w, http.StatusMethodNotAllowed, map[string]string{"code": codeBadRequest, "message": "Method not allowed"})
+			return
+		}
+		body, apiErr := fn(r)
+		if apiErr != nil {
+			writeAPI(w, apiErr.status, map[string]string{"code": apiErr.code, "message": apiErr.msg})
+			return
+		}
+		writeAPI(w, http.StatusOK, body)
+	}
+}
+
+func writeAPI(w http.ResponseWriter, status int, body interface{}) {
+	w.WriteHeader(status)
+	w.Write(append(encodeJSON(body), '\n'))
+}
+
+// apiUserProfile is the public view of a user: progress without the password hash
+type apiUserProfile struct {
+	*PlayerProgress
+	History []MatchRecord `json:"history"`
+}
+
+func apiUser(r *http.Request) (interface{}, *apiError) {
+	name := strings.TrimPrefix(r.URL.Path, "/users/")
+	if name == "" || strings.Contains(name, "/") {
+		return nil, &apiError{http.StatusNotFound, codeNotFound, "Usage: /users/{name}"}
+	}
+	u, ok := userStore.Get(name)
+	if !ok {
+		return nil, &apiError{http.StatusNotFound, codeNotFound, "No such user"}
+	}
+	history := u.History
+	if history == nil {
+		history = []MatchRecord{}
+	}
+	return apiUserProfile{PlayerProgress: loadProgress(u.Username), History: history}, nil
+}
+
+// leaderboardEntry is one row of /leaderboard
+type leaderboardEntry struct {
+	Rank     int    `json:"rank"`
+	Username string `json:"username"`
+	Rating   int    `json:"rating"`
+	Level    int    `json:"level"`
+	EXP      int    `json:"exp"`
+}
+
+func apiLeaderboard(r *http.Request) (interface{}, *apiError) {
+	limit := leaderboardDefault
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, &apiError{http.StatusBadRequest, codeBadRequest, "limit must be a positive number"}
+		}
+		limit = n
+	}
+	users := userStore.List()
+	// Highest rating first, then highest level; List is sorted by name, which breaks the remaining ties
+	sort.SliceStable(users, func(i, j int) bool {
+		ri, rj := userRating(users[i]), userRating(users[j])
+		if ri != rj {
+			return ri > rj
+		}
+		return users[i].Level > users[j].Level
+	})
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	board := make([]leaderboardEntry, len(users))
+	for i, u := range users {
+		board[i] = leaderboardEntry{Rank: i + 1, Username: u.Username, Rating: userRating(u), Level: u.Level, EXP: u.EXP}
+	}
+	return board, nil
+}
+
+// apiRoom is one entry of /rooms
+type apiRoom struct {
+	ID         string   `json:"id"`
+	Mode       string   `json:"mode"`
+	Status     string   `json:"status"` // open (waiting for a guest) or running
+	Host       string   `json:"host"`
+	Guest      string   `json:"guest,omitempty"`
+	Spectators []string `json:"spectators"`
+}
+
+func apiRooms(r *http.Request) (interface{}, *apiError) {
+	roomsLock.Lock()
+	defer roomsLock.Unlock()
+	rooms := make([]apiRoom, 0, len(gameRooms))
+	for id, room := range gameRooms {
+		status := "open"
+		if room.Started {
+			status = "running"
+		}
+		watchers := make([]string, 0, len(room.Spectators))
+		for uname := range room.Spectators {
+			watchers = append(watchers, uname)
+		}
+		sort.Strings(watchers)
+		rooms = append(rooms, apiRoom{ID: id, Mode: room.Mode, Status: status, Host: room.Host, Guest: room.Guest, Spectators: watchers})
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	return rooms, nil
+}
+
+func apiSpecs(r *http.Request) (interface{}, *apiError) {
+	specs := currentSpecs()
+	return map[string]interface{}{"version": specs.Version, "towers": specs.Towers, "troops": specs.Troops, "spells": specs.Spells}, nil
+}
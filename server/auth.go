@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Password hashing uses PBKDF2-HMAC-SHA256 with a random per-user salt.
+// Stored format: pbkdf2-sha256$<iterations>$<salt base64>$<hash base64>
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 120000
+	hashSaltLen    = 16
+	hashKeyLen     = 32
+)
+
+// PasswordPolicy describes the minimum strength REGISTER accepts
+type PasswordPolicy struct {
+	MinLength     int  `json:"min_length"`     // minimum number of characters
+	RequireLetter bool `json:"require_letter"` // at least one letter
+	RequireDigit  bool `json:"require_digit"`  // at least one digit
+	RequireSymbol bool `json:"require_symbol"` // at least one non-letter, non-digit character
+}
+
+// Check returns an error describing the first rule the password breaks, or nil
+func (p PasswordPolicy) Check(password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	var letter, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if p.RequireLetter && !letter {
+		return fmt.Errorf("password must contain a letter")
+	}
+	if p.RequireDigit && !digit {
+		return fmt.Errorf("password must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		return fmt.Errorf("password must contain a symbol")
+	}
+	return nil
+}
+
+// hashPassword returns a salted hash of password in the stored format
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, hashSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, hashIterations, hashKeyLen)
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, hashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// isHashedPassword reports whether stored is in the hashed format (and not legacy plaintext)
+func isHashedPassword(stored string) bool {
+	return strings.HasPrefix(stored, hashScheme+"$")
+}
+
+// verifyPassword checks password against a stored value, which may be a hash or legacy plaintext
+func verifyPassword(stored, password string) bool {
+	if !isHashedPassword(stored) {
+		// Legacy plaintext entry, still accepted so it can be migrated on login
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iter, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		// U1 = PRF(password, salt || INT(block))
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+		// Un = PRF(password, Un-1), T = U1 xor U2 xor ... xor Un
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
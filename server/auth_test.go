@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// Test vectors for PBKDF2-HMAC-SHA256 from RFC 7914 section 11
+	tests := []struct {
+		password, salt string
+		iter, keyLen   int
+		want           string
+	}{
+		{"passwd", "salt", 1, 64,
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+				"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64,
+			"4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+				"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iter, tt.keyLen))
+		if got != tt.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iter, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	hashed, err := hashPassword("s3cret!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHashedPassword(hashed) {
+		t.Fatalf("%q is not in the hashed format", hashed)
+	}
+	other, _ := hashPassword("s3cret!")
+	if other == hashed {
+		t.Error("two hashes of one password are equal; the salt is not random")
+	}
+	tests := []struct {
+		name, stored, password string
+		ok                     bool
+	}{
+		{"right password", hashed, "s3cret!", true},
+		{"wrong password", hashed, "s3cret?", false},
+		{"empty password", hashed, "", false},
+		{"truncated hash", strings.Join(strings.Split(hashed, "$")[:3], "$"), "s3cret!", false},
+		{"bad iterations", "pbkdf2-sha256$0$c2FsdA$AAAA", "s3cret!", false},
+		{"legacy plaintext", "123456", "123456", true},
+		{"legacy plaintext, wrong password", "123456", "1234567", false},
+	}
+	for _, tt := range tests {
+		if ok := verifyPassword(tt.stored, tt.password); ok != tt.ok {
+			t.Errorf("%s: verify = %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, RequireLetter: true, RequireDigit: true, RequireSymbol: true}
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"abc1!", false},     // too short
+		{"12345678!", false}, // no letter
+		{"abcdefgh!", false}, // no digit
+		{"abcdefgh1", false}, // no symbol
+		{"abcdefg1!", true},
+		{"mậtkhẩu1!", true}, // letters are counted as characters, not bytes
+	}
+	for _, tt := range tests {
+		if err := policy.Check(tt.password); (err == nil) != tt.ok {
+			t.Errorf("Check(%q) = %v, want ok %v", tt.password, err, tt.ok)
+		}
+	}
+	if err := (PasswordPolicy{}).Check(""); err != nil {
+		t.Errorf("empty policy rejected a password: %v", err)
+	}
+}
+
+func TestLoginRehashesPlaintextPassword(t *testing.T) {
+	store, err := openJSONFileStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := userStore
+	userStore = store
+	defer func() { userStore = saved }()
+	if err := store.Create(User{Username: "idea", Password: "123456", Level: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if u := authenticate("idea", "654321"); u != nil {
+		t.Fatal("wrong password accepted")
+	}
+	if u, _ := store.Get("idea"); u.Password != "123456" {
+		t.Fatalf("failed login changed the password to %q", u.Password)
+	}
+	if u := authenticate("idea", "123456"); u == nil {
+		t.Fatal("plaintext password rejected")
+	}
+	u, _ := store.Get("idea")
+	if !isHashedPassword(u.Password) || !verifyPassword(u.Password, "123456") {
+		t.Fatalf("password after login = %q, want a hash of the old one", u.Password)
+	}
+	if authenticate("idea", "123456") == nil {
+		t.Error("rehashed password rejected")
+	}
+}
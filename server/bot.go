@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
+)
+
+// botPrefix starts every bot username; REGISTER refuses names that use it
+const botPrefix = "Bot-"
+
+// botThink is how long a bot waits between actions at each difficulty
+var botThink = map[engine.Difficulty]time.Duration{
+	engine.Easy:   3 * time.Second,
+	engine.Medium: 2 * time.Second,
+	engine.Hard:   1200 * time.Millisecond,
+}
+
+// botName returns the username of the bot playing in roomID
+func botName(roomID string, d engine.Difficulty) string {
+	return fmt.Sprintf("%s%s-%s", botPrefix, d, roomID)
+}
+
+// isBot reports whether username belongs to a server-side bot
+func isBot(username string) bool {
+	return strings.HasPrefix(username, botPrefix)
+}
+
+// runBot plays the bot's side of a match until the match is gone.
+// The bot acts through handleDeploy and handleEnhancedBuy like any connected player,
+// so the engine enforces turns, AttackPatterns and mana for it as well.
+func runBot(roomID, name string, d engine.Difficulty, seed int64) {
+	rng := rand.New(rand.NewSource(seed + 1)) // own source so bot choices never shift the match's rolls
+	for {
+		time.Sleep(botThink[d])
+		if !botStep(roomID, name, d, rng) {
+			return
+		}
+	}
+}
+
+// botStep makes at most one move for the bot; returns false once the match has ended
+func botStep(roomID, name string, d engine.Difficulty, rng *rand.Rand) bool {
+	gamesLock.Lock()
+	if g, ok := games[roomID]; ok {
+		if g.Over {
+			gamesLock.Unlock()
+			return false
+		}
+		var mv engine.Deploy
+		moved := false
+		if g.TurnUser == name {
+			mv, moved = engine.PlanDeploy(g.Match, name, d, rng)
+		}
+		gamesLock.Unlock()
+		if moved {
+			logBotReply(name, handleDeploy(name, mv.Troop, mv.Tower))
+		}
+		return true
+	}
+	gamesLock.Unlock()
+
+	enhancedGamesLock.Lock()
+	gs, ok := enhancedGames[roomID]
+	if !ok || gs.Over {
+		enhancedGamesLock.Unlock()
+		return false
+	}
+	buy := botPickBuy(gs.Players[name].Player, gs.Specs, d, rng)
+	var mv engine.Deploy
+	moved := false
+	if buy == "" {
+		mv, moved = engine.PlanDeploy(gs.Match, name, d, rng)
+	}
+	enhancedGamesLock.Unlock()
+	if buy != "" {
+		logBotReply(name, handleEnhancedBuy(name, buy))
+	} else if moved {
+		logBotReply(name, handleEnhancedDeploy(name, mv.Troop, mv.Tower))
+	}
+	return true
+}
+
+// botPickBuy returns the troop the bot should buy now, or "" to deploy instead.
+// The bot restocks when it has fewer than two fighting troops; easy picks any
+// affordable troop, harder bots pick the one with the most attack.
+func botPickBuy(p *PlayerState, specs *SpecSet, d engine.Difficulty, rng *rand.Rand) string {
+	fighting := 0
+	for _, tr := range p.Troops {
+		if tr.HP > 0 && !tr.Support() {
+			fighting++
+		}
+	}
+	if fighting >= 2 {
+		return ""
+	}
+	var affordable []TroopSpec
+	for _, t := range specs.Troops {
+		if t.MANA <= p.Mana {
+			affordable = append(affordable, t)
+		}
+	}
+	if len(affordable) == 0 {
+		return ""
+	}
+	if d == engine.Easy {
+		return affordable[rng.Intn(len(affordable))].Name
+	}
+	best := affordable[0]
+	for _, t := range affordable[1:] {
+		if t.ATK > best.ATK {
+			best = t
+		}
+	}
+	return best.Name
+}
+
+// logBotReply prints rejected bot actions to the server log
+func logBotReply(name, reply string) {
+	if strings.HasPrefix(reply, "ERR|") {
+		fmt.Println("Bot", name, "action rejected:", reply[4:])
+	}
+}
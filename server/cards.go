@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
+)
+
+// Card collections and decks. Every troop and spell in the specs is a card. Cards not
+// marked "locked" belong to every user; locked cards are earned by winning matches.
+// A user saves named decks of config.DeckSize cards from their collection, and matches
+// deal the starting hand from the active deck and only sell or cast cards in it.
+
+const (
+	maxDecks      = 5
+	maxDeckName   = 20
+	minDeckTroops = 3 // a deck must be able to deal a starting hand
+	handSize      = 3 // troops each player starts a match with
+)
+
+var tooManyDecks = fmt.Sprintf("You already have %d decks; reuse a name to replace one", maxDecks)
+
+// collection returns the cards u owns in the given specs, troops first, in spec order
+func collection(u User, specs *SpecSet) []string {
+	earned := map[string]bool{}
+	for _, c := range u.Cards {
+		earned[c] = true
+	}
+	var cards []string
+	for _, t := range specs.Troops {
+		if !t.Locked || earned[t.Name] {
+			cards = append(cards, t.Name)
+		}
+	}
+	for _, sp := range specs.Spells {
+		if !sp.Locked || earned[sp.Name] {
+			cards = append(cards, sp.Name)
+		}
+	}
+	return cards
+}
+
+// allCards returns every card in the specs, troops first
+func allCards(specs *SpecSet) []string {
+	cards := make([]string, 0, len(specs.Troops)+len(specs.Spells))
+	for _, t := range specs.Troops {
+		cards = append(cards, t.Name)
+	}
+	for _, sp := range specs.Spells {
+		cards = append(cards, sp.Name)
+	}
+	return cards
+}
+
+// deckTroops returns the troops of a deck in deck order
+func deckTroops(deck []string, specs *SpecSet) []string {
+	var troops []string
+	for _, c := range deck {
+		if _, ok := specs.Troop(c); ok {
+			troops = append(troops, c)
+		}
+	}
+	return troops
+}
+
+// ownedCards returns the cards username owns; bots own every card
+func ownedCards(username string, specs *SpecSet) []string {
+	u, ok := userStore.Get(username)
+	if !ok || isBot(username) {
+		return allCards(specs)
+	}
+	return collection(u, specs)
+}
+
+// activeDeck returns the cards a user plays a match with: their active deck, minus any
+// card they no longer own or the specs no longer have. A user without a usable deck
+// plays with their whole collection; bots play with every card.
+func activeDeck(username string, specs *SpecSet) []string {
+	u, ok := userStore.Get(username)
+	if !ok || isBot(username) {
+		return allCards(specs)
+	}
+	owned := collection(u, specs)
+	var deck []string
+	for _, c := range u.Decks[u.ActiveDeck] {
+		if contains(owned, c) {
+			deck = append(deck, c)
+		}
+	}
+	if len(deckTroops(deck, specs)) < minDeckTroops {
+		return owned
+	}
+	return deck
+}
+
+// dealHand picks n different troops from the deck with the match's random source
+func dealHand(deck []string, specs *SpecSet, rng *rand.Rand, n int) []TroopSpec {
+	names := deckTroops(deck, specs)
+	rng.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	if len(names) > n {
+		names = names[:n]
+	}
+	hand := make([]TroopSpec, len(names))
+	for i, name := range names {
+		hand[i], _ = specs.Troop(name)
+	}
+	return hand
+}
+
+// validDeckName reports whether name is 1-20 letters, digits, '-' or '_'
+func validDeckName(name string) bool {
+	if name == "" || len(name) > maxDeckName {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// handleSetDeck saves a deck and makes it active, or with no cards selects a saved deck
+// cards: comma-separated card names
+// Returns a string message to send back to the client
+func handleSetDeck(username, name, cards string) string {
+	u, ok := userStore.Get(username)
+	if !ok {
+		return errMsg(codeNotFound, "Unknown user")
+	}
+	if !validDeckName(name) {
+		return errMsg(codeBadRequest, fmt.Sprintf("Deck names are 1-%d letters, digits, '-' or '_'", maxDeckName))
+	}
+	if strings.TrimSpace(cards) == "" {
+		err := userStore.Modify(username, func(u *User) error {
+			if _, ok := u.Decks[name]; !ok {
+				return &codedError{codeNotFound, "No deck named " + name}
+			}
+			u.ActiveDeck = name
+			return nil
+		})
+		if err != nil {
+			return deckSaveError(err)
+		}
+		return "ACK|DECK_SELECTED|" + name
+	}
+	if _, exists := u.Decks[name]; !exists && len(u.Decks) >= maxDecks {
+		return errMsg(codeBadRequest, tooManyDecks)
+	}
+	specs := currentSpecs()
+	owned := collection(u, specs)
+	var deck []string
+	for _, c := range strings.Split(cards, ",") {
+		c = strings.TrimSpace(c)
+		_, isTroop := specs.Troop(c)
+		_, isSpell := specs.Spell(c)
+		switch {
+		case c == "":
+			continue
+		case !isTroop && !isSpell:
+			return errMsg(codeUnknownUnit, "No such card: "+c)
+		case !contains(owned, c):
+			return errMsg(codeNotOwned, "You have not unlocked "+c)
+		case contains(deck, c):
+			return errMsg(codeBadRequest, "Duplicate card: "+c)
+		}
+		deck = append(deck, c)
+	}
+	if len(deck) != config.DeckSize {
+		return errMsg(codeBadRequest, fmt.Sprintf("A deck has exactly %d cards, got %d", config.DeckSize, len(deck)))
+	}
+	if len(deckTroops(deck, specs)) < minDeckTroops {
+		return errMsg(codeBadRequest, fmt.Sprintf("A deck needs at least %d troops", minDeckTroops))
+	}
+	// Save in one locked step on a fresh copy of the user, so a failed save changes nothing
+	err := userStore.Modify(username, func(u *User) error {
+		if _, exists := u.Decks[name]; !exists && len(u.Decks) >= maxDecks {
+			return &codedError{codeBadRequest, tooManyDecks}
+		}
+		if u.Decks == nil {
+			u.Decks = map[string][]string{}
+		}
+		u.Decks[name] = deck
+		u.ActiveDeck = name
+		return nil
+	})
+	if err != nil {
+		return deckSaveError(err)
+	}
+	return fmt.Sprintf("ACK|DECK_SAVED|%s|%d", name, len(deck))
+}
+
+// deckSaveError turns an error from saving a deck into an error reply
+func deckSaveError(err error) string {
+	var coded *codedError
+	if errors.As(err, &coded) || errors.Is(err, ErrUserNotFound) {
+		return errorReply(err)
+	}
+	return errMsg(codeStorage, "Could not save deck: "+err.Error())
+}
+
+// deckList is the body of a DECKS reply
+type deckList struct {
+	Active     string              `json:"active"`
+	DeckSize   int                 `json:"deck_size"`
+	Decks      map[string][]string `json:"decks"`
+	Collection []string            `json:"collection"` // cards the user owns
+	Locked     []string            `json:"locked"`     // cards still to be earned
+}
+
+// handleListDecks returns the user's decks and card collection as DECKS|{json}
+func handleListDecks(username string) string {
+	u, ok := userStore.Get(username)
+	if !ok {
+		return errMsg(codeNotFound, "Unknown user")
+	}
+	specs := currentSpecs()
+	list := deckList{Active: u.ActiveDeck, DeckSize: config.DeckSize, Decks: u.Decks, Collection: collection(u, specs), Locked: []string{}}
+	if list.Decks == nil {
+		list.Decks = map[string][]string{}
+	}
+	for _, c := range allCards(specs) {
+		if !contains(list.Collection, c) {
+			list.Locked = append(list.Locked, c)
+		}
+	}
+	out, _ := json.Marshal(list)
+	return "DECKS|" + string(out)
+}
+
+// awardCard gives the winner of a match one locked card they do not own yet, picked at
+// random, and tells them with CARD_UNLOCKED|card. Draws, forfeits, bots and complete
+// collections get nothing; a forfeit win would let two accounts farm cards by quitting.
+func awardCard(m *engine.Match, ev engine.Event, specs *SpecSet) {
+	if ev.Winner == "" || ev.Winner == engine.Draw || ev.Reason == engine.ReasonForfeit || isBot(ev.Winner) {
+		return
+	}
+	var card string
+	err := userStore.Modify(ev.Winner, func(u *User) error {
+		owned := collection(*u, specs)
+		var candidates []string
+		for _, c := range allCards(specs) {
+			if !contains(owned, c) {
+				candidates = append(candidates, c)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		card = candidates[m.Rand().Intn(len(candidates))]
+		u.Cards = append(u.Cards, card)
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			fmt.Println("Error saving unlocked card for", ev.Winner+":", err)
+		}
+		return
+	}
+	if card != "" {
+		sendToUser(ev.Winner, "CARD_UNLOCKED|"+card)
+	}
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
+)
+
+// defaultConfigFile is read at startup unless -config names another file; it may be absent
+const defaultConfigFile = "data/config.json"
+
+// Config holds every network, storage and gameplay setting of the server.
+// Values come from the defaults below, then the config file, then command-line flags.
+type Config struct {
+	// Network
+	Port     int    `json:"port"`      // game listener (TCP line protocol)
+	HTTPAddr string `json:"http_addr"` // web client, WebSocket and HTTP API; empty disables it
+	TLSCert  string `json:"tls_cert"`  // with TLSKey, both listeners serve TLS
+	TLSKey   string `json:"tls_key"`
+
+	// Storage
+	Store        string `json:"store"` // json or log
+	UsersFile    string `json:"users_file"`
+	UsersLogFile string `json:"users_log_file"`
+	SpecsFile    string `json:"specs_file"`
+	ReplaysDir   string `json:"replays_dir"`
+
+	SpecsPoll duration `json:"specs_poll"` // how often the specs file is checked for changes; 0 disables
+	Admins    []string `json:"admins"`     // users allowed to run admin commands such as RELOAD_SPECS
+
+	// Accounts
+	Password       PasswordPolicy `json:"password"`
+	ReconnectGrace duration       `json:"reconnect_grace"` // how long a match waits for a disconnected player to RESUME
+
+	// ENHANCED matches
+	MatchLength    duration `json:"match_length"`
+	Overtime       duration `json:"overtime"`     // double mana period after a tied match_length; 0 skips it
+	SuddenDeath    duration `json:"sudden_death"` // first tower destroyed wins, after a tied overtime; 0 skips it
+	StartingMana   int      `json:"starting_mana"`
+	ManaCap        int      `json:"mana_cap"`
+	ManaRegen      int      `json:"mana_regen"` // mana gained every RegenInterval
+	RegenInterval  duration `json:"regen_interval"`
+	SimTick        duration `json:"sim_tick"`    // how often troops on the field move and attack; also how often the match timer is checked
+	HealAmount     int      `json:"heal_amount"` // HP a "heal" troop restores, in both modes
+	CritMultiplier float64  `json:"crit_multiplier"`
+
+	// Arena: ENHANCED troops on the field walk two lanes toward the enemy towers
+	Arena      bool `json:"arena"`
+	LaneLength int  `json:"lane_length"` // cells between the two sides' towers
+	TroopSpeed int  `json:"troop_speed"` // cells a troop walks every sim tick
+	TowerRange int  `json:"tower_range"` // cells in front of a tower that it shoots at
+
+	// Decks and drafts
+	DeckSize  int      `json:"deck_size"`  // cards in a deck saved with SET_DECK
+	DraftTurn duration `json:"draft_turn"` // time a player has for each ban or pick in a draft room
+
+	// Leveling: reaching level L+1 from L costs LevelBaseEXP + LevelStepEXP*(L-1) EXP
+	LevelBaseEXP int `json:"level_base_exp"`
+	LevelStepEXP int `json:"level_step_exp"`
+}
+
+// config is the configuration loaded at startup
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Port:           9000,
+		Store:          "json",
+		UsersFile:      "data/users.json",
+		UsersLogFile:   "data/users.log",
+		SpecsFile:      "data/specs.json",
+		ReplaysDir:     "data/replays",
+		SpecsPoll:      duration{2 * time.Second},
+		Password:       PasswordPolicy{MinLength: 6},
+		ReconnectGrace: duration{60 * time.Second},
+		MatchLength:    duration{3 * time.Minute},
+		Overtime:       duration{1 * time.Minute},
+		SuddenDeath:    duration{1 * time.Minute},
+		StartingMana:   5,
+		ManaCap:        10,
+		ManaRegen:      1,
+		RegenInterval:  duration{1 * time.Second},
+		SimTick:        duration{500 * time.Millisecond},
+		HealAmount:     300,
+		CritMultiplier: 1.2,
+		LaneLength:     8,
+		TroopSpeed:     1,
+		TowerRange:     2,
+		DeckSize:       8,
+		DraftTurn:      duration{20 * time.Second},
+		LevelBaseEXP:   100,
+		LevelStepEXP:   10,
+	}
+}
+
+// duration is a time.Duration written as a string such as "3m" or "1s" in the config file
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"90s\" or \"3m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// stringList is a flag holding a comma-separated list; setting it replaces the list
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// bindFlags registers one flag per setting, writing into c
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.Port, "port", c.Port, "TCP port of the game listener")
+	fs.StringVar(&c.HTTPAddr, "http", c.HTTPAddr, "address for the web client and WebSocket gateway, e.g. :8080 (disabled if empty)")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "PEM certificate file; with -tls-key, serves TLS on the game and HTTP listeners")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "PEM private key file for -tls-cert")
+	fs.StringVar(&c.Store, "store", c.Store, "user store: json (users file) or log (append-only users log file)")
+	fs.StringVar(&c.UsersFile, "users-file", c.UsersFile, "JSON file of user accounts")
+	fs.StringVar(&c.UsersLogFile, "users-log-file", c.UsersLogFile, "append-only user log used by -store log")
+	fs.StringVar(&c.SpecsFile, "specs-file", c.SpecsFile, "JSON file of tower and troop specs")
+	fs.StringVar(&c.ReplaysDir, "replays-dir", c.ReplaysDir, "directory where finished matches are saved")
+	fs.DurationVar(&c.SpecsPoll.Duration, "specs-poll", c.SpecsPoll.Duration, "how often to check the specs file for changes (0 disables)")
+	fs.Var((*stringList)(&c.Admins), "admins", "comma-separated users allowed to run admin commands")
+	fs.IntVar(&c.Password.MinLength, "password-min-length", c.Password.MinLength, "minimum password length for REGISTER")
+	fs.BoolVar(&c.Password.RequireLetter, "password-require-letter", c.Password.RequireLetter, "require at least one letter in passwords")
+	fs.BoolVar(&c.Password.RequireDigit, "password-require-digit", c.Password.RequireDigit, "require at least one digit in passwords")
+	fs.BoolVar(&c.Password.RequireSymbol, "password-require-symbol", c.Password.RequireSymbol, "require at least one symbol in passwords")
+	fs.DurationVar(&c.ReconnectGrace.Duration, "reconnect-grace", c.ReconnectGrace.Duration, "how long a match waits for a disconnected player to RESUME")
+	fs.DurationVar(&c.MatchLength.Duration, "match-length", c.MatchLength.Duration, "length of an ENHANCED match")
+	fs.DurationVar(&c.Overtime.Duration, "overtime", c.Overtime.Duration, "double mana period after a tied ENHANCED match (0 disables)")
+	fs.DurationVar(&c.SuddenDeath.Duration, "sudden-death", c.SuddenDeath.Duration, "sudden death period after a tied overtime (0 disables)")
+	fs.IntVar(&c.StartingMana, "starting-mana", c.StartingMana, "mana each player starts an ENHANCED match with")
+	fs.IntVar(&c.ManaCap, "mana-cap", c.ManaCap, "maximum mana")
+	fs.IntVar(&c.ManaRegen, "mana-regen", c.ManaRegen, "mana gained every -regen-interval")
+	fs.DurationVar(&c.RegenInterval.Duration, "regen-interval", c.RegenInterval.Duration, "how often mana regenerates")
+	fs.DurationVar(&c.SimTick.Duration, "sim-tick", c.SimTick.Duration, "how often ENHANCED troops on the field move and attack")
+	fs.IntVar(&c.HealAmount, "heal-amount", c.HealAmount, "HP restored by a heal troop (the Queen)")
+	fs.Float64Var(&c.CritMultiplier, "crit-multiplier", c.CritMultiplier, "tower counter-attack multiplier on a critical hit")
+	fs.BoolVar(&c.Arena, "arena", c.Arena, "ENHANCED troops walk two lanes instead of fighting in one melee")
+	fs.IntVar(&c.LaneLength, "lane-length", c.LaneLength, "cells between the two sides' towers in the arena")
+	fs.IntVar(&c.TroopSpeed, "troop-speed", c.TroopSpeed, "cells an arena troop walks every -sim-tick")
+	fs.IntVar(&c.TowerRange, "tower-range", c.TowerRange, "cells in front of a tower that it shoots at in the arena")
+	fs.IntVar(&c.DeckSize, "deck-size", c.DeckSize, "number of cards in a deck")
+	fs.DurationVar(&c.DraftTurn.Duration, "draft-turn", c.DraftTurn.Duration, "time for each ban or pick in a draft room")
+	fs.IntVar(&c.LevelBaseEXP, "level-base-exp", c.LevelBaseEXP, "EXP needed to go from level 1 to 2")
+	fs.IntVar(&c.LevelStepEXP, "level-step-exp", c.LevelStepEXP, "extra EXP needed for each further level")
+}
+
+// loadConfig parses the command line and builds the configuration.
+// Flags given explicitly win over the config file, which wins over the defaults.
+func loadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	c := defaultConfig()
+	path := fs.String("config", defaultConfigFile, "JSON config file; flags override its values")
+	c.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	given := map[string]string{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = f.Value.String() })
+	data, err := ioutil.ReadFile(*path)
+	switch {
+	case os.IsNotExist(err) && given["config"] == "":
+		// No config file: defaults and flags only
+	case err != nil:
+		return c, err
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields() // a misspelt setting is an error, not a silent default
+		if err := dec.Decode(&c); err != nil {
+			return c, fmt.Errorf("%s: %v", *path, err)
+		}
+		for name, v := range given {
+			fs.Set(name, v) // reapply the command line over the file
+		}
+	}
+	return c, c.validate()
+}
+
+// validate reports every invalid setting at once
+func (c Config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.Port > 0 && c.Port < 65536, "port must be between 1 and 65535, got %d", c.Port)
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls_cert and tls_key must be set together")
+	check(c.Store == "json" || c.Store == "log", "store must be json or log, got %q", c.Store)
+	check(c.UsersFile != "", "users_file must not be empty")
+	check(c.UsersLogFile != "", "users_log_file must not be empty")
+	check(c.SpecsFile != "", "specs_file must not be empty")
+	check(c.ReplaysDir != "", "replays_dir must not be empty")
+	check(c.SpecsPoll.Duration >= 0, "specs_poll must not be negative")
+	check(c.Password.MinLength >= 0, "password.min_length must not be negative")
+	check(c.ReconnectGrace.Duration >= 0, "reconnect_grace must not be negative")
+	check(c.MatchLength.Duration > 0, "match_length must be positive")
+	check(c.Overtime.Duration >= 0 && c.SuddenDeath.Duration >= 0, "overtime and sudden_death must not be negative")
+	check(c.ManaCap > 0, "mana_cap must be positive, got %d", c.ManaCap)
+	check(c.StartingMana >= 0 && c.StartingMana <= c.ManaCap, "starting_mana must be between 0 and mana_cap (%d), got %d", c.ManaCap, c.StartingMana)
+	check(c.ManaRegen > 0, "mana_regen must be positive, got %d", c.ManaRegen)
+	check(c.RegenInterval.Duration >= 100*time.Millisecond, "regen_interval must be at least 100ms")
+	check(c.SimTick.Duration >= 50*time.Millisecond && c.SimTick.Duration <= c.RegenInterval.Duration, "sim_tick must be between 50ms and regen_interval")
+	check(c.HealAmount >= 0, "heal_amount must not be negative, got %d", c.HealAmount)
+	check(c.CritMultiplier >= 1, "crit_multiplier must be at least 1, got %v", c.CritMultiplier)
+	check(c.LaneLength >= 2, "lane_length must be at least 2, got %d", c.LaneLength)
+	check(c.TroopSpeed > 0, "troop_speed must be positive, got %d", c.TroopSpeed)
+	check(c.TowerRange >= 1 && c.TowerRange <= c.LaneLength, "tower_range must be between 1 and lane_length (%d), got %d", c.LaneLength, c.TowerRange)
+	check(c.DraftTurn.Duration >= time.Second, "draft_turn must be at least 1s")
+	check(c.DeckSize >= minDeckTroops, "deck_size must be at least %d, got %d", minDeckTroops, c.DeckSize)
+	check(c.LevelBaseEXP > 0, "level_base_exp must be positive, got %d", c.LevelBaseEXP)
+	check(c.LevelStepEXP >= 0, "level_step_exp must not be negative, got %d", c.LevelStepEXP)
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// rules returns the engine rules for a match of the given mode with the configured values
+func (c Config) rules(mode engine.Mode) engine.Rules {
+	r := engine.SimpleRules()
+	if mode == engine.ModeEnhanced {
+		r = engine.EnhancedRules()
+		r.CritMultiplier = c.CritMultiplier
+		r.ManaCap = c.ManaCap
+		r.ManaRegen = c.ManaRegen
+		r.Overtime = c.Overtime.Duration > 0
+		r.SuddenDeath = c.SuddenDeath.Duration > 0
+		if c.Arena {
+			r.Arena = &engine.Arena{Length: c.LaneLength, Speed: c.TroopSpeed, TowerRange: c.TowerRange}
+		}
+	}
+	r.HealAmount = c.HealAmount
+	return r
+}
+
+// isAdmin reports whether username may run admin commands
+func (c Config) isAdmin(username string) bool {
+	for _, a := range c.Admins {
+		if a == username {
+			return true
+		}
+	}
+	return false
+}
+
+// expToLevelUp returns the EXP needed to go from level to level+1
+func (c Config) expToLevelUp(level int) int {
+	return c.LevelBaseEXP + c.LevelStepEXP*(level-1)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
+)
+
+// Per-step updates of ENHANCED matches. The field is simulated every config.SimTick, far
+// more often than anything else changes, so after each step players and spectators get
+// DELTA|{json} with only what the step changed instead of a full STATE. A full STATE
+// still follows every deploy, buy and cast, and every regen tick that had events.
+
+// fieldDelta is the body of a DELTA message
+type fieldDelta struct {
+	Step    int           `json:"step"`              // steps simulated so far
+	Units   []engine.Unit `json:"units,omitempty"`   // units deployed, moved or hurt since the last DELTA, as they are now
+	Removed []int         `json:"removed,omitempty"` // IDs of units that left the field
+	Towers  []towerHP     `json:"towers,omitempty"`  // towers whose HP changed
+}
+
+// towerHP is a tower's HP in a DELTA
+type towerHP struct {
+	Player string `json:"player"`
+	Tower  string `json:"tower"`
+	HP     int    `json:"hp"`
+}
+
+// fieldSeen is the field as players and spectators last saw it, in a STATE or a DELTA
+type fieldSeen struct {
+	steps  int
+	units  map[int]engine.Unit
+	towers map[string]int // player + "/" + tower -> HP
+}
+
+// sync records the field of g as just sent in full
+func (s *fieldSeen) sync(g *EnhancedGameState) {
+	s.units = map[int]engine.Unit{}
+	s.towers = map[string]int{}
+	for _, u := range g.Field {
+		s.units[u.ID] = *u
+	}
+	for _, uname := range g.Order {
+		p := g.Match.Players[uname]
+		for _, name := range p.TowerNames() {
+			s.towers[uname+"/"+name] = p.Towers[name].HP
+		}
+	}
+}
+
+// deltaMessage returns the DELTA|{json} line for the step just simulated, or "" if the
+// step changed nothing anyone can see. Caller holds enhancedGamesLock.
+func (g *EnhancedGameState) deltaMessage() string {
+	seen := &g.seen
+	seen.steps++
+	d := fieldDelta{Step: seen.steps}
+	onField := map[int]bool{}
+	for _, u := range g.Field {
+		onField[u.ID] = true
+		if old, ok := seen.units[u.ID]; !ok || old.Pos != u.Pos || old.HP != u.HP {
+			d.Units = append(d.Units, *u)
+		}
+	}
+	for id := range seen.units {
+		if !onField[id] {
+			d.Removed = append(d.Removed, id)
+		}
+	}
+	sort.Ints(d.Removed)
+	for _, uname := range g.Order {
+		p := g.Match.Players[uname]
+		for _, name := range p.TowerNames() {
+			if hp, ok := seen.towers[uname+"/"+name]; !ok || hp != p.Towers[name].HP {
+				d.Towers = append(d.Towers, towerHP{Player: uname, Tower: name, HP: p.Towers[name].HP})
+			}
+		}
+	}
+	seen.sync(g)
+	if len(d.Units) == 0 && len(d.Removed) == 0 && len(d.Towers) == 0 {
+		return ""
+	}
+	out, _ := json.Marshal(d)
+	return "DELTA|" + string(out)
+}
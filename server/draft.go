@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
+)
+
+// Draft rooms (CREATE_GAME|mode|DRAFT): before the match the players take turns to ban troops
+// from the pool and then to pick them. Picks are exclusive and become each player's starting
+// troops. Every turn lasts config.DraftTurn; when it runs out a ban is skipped and a pick is
+// made at random. The draft is pushed to both players and the spectators as DRAFT|{json}.
+
+// draftStep is one turn of the draft
+type draftStep struct {
+	Action string // BAN or PICK
+	Seat   int    // 0 for the host, 1 for the guest
+}
+
+// draftOrder bans one troop each, then picks in snake order so the second player gets two in a row
+var draftOrder = []draftStep{
+	{"BAN", 0}, {"BAN", 1},
+	{"PICK", 0}, {"PICK", 1}, {"PICK", 1}, {"PICK", 0}, {"PICK", 0}, {"PICK", 1},
+}
+
+// Draft is the pick phase of one room
+type Draft struct {
+	RoomID   string
+	Players  [2]string // host, guest
+	Steps    []draftStep
+	Step     int      // index of the current step; len(Steps) once the draft is over
+	Pool     []string // troops still available, in spec order
+	Bans     map[string][]string
+	Picks    map[string][]string
+	Deadline time.Time // end of the current turn
+	specs    *SpecSet
+	bot      engine.Difficulty // difficulty of the guest if it is a bot
+	rng      *rand.Rand
+}
+
+var (
+	drafts     = make(map[string]*Draft) // room ID -> draft in progress
+	draftsLock sync.Mutex                // taken before gamesLock and roomsLock, never after
+)
+
+// startDraft opens the draft of a full room. bot is the guest's difficulty if the guest is a
+// bot, which starts playing once the match begins. If the specs have too few troops for
+// everyone to pick a hand, the match starts at once with dealt troops.
+func startDraft(roomID string, bot engine.Difficulty) {
+	roomsLock.Lock()
+	room := gameRooms[roomID]
+	if room == nil || room.Host == "" || room.Guest == "" {
+		roomsLock.Unlock()
+		return
+	}
+	d := &Draft{
+		RoomID:  roomID,
+		Players: [2]string{room.Host, room.Guest},
+		Steps:   draftOrder,
+		Bans:    map[string][]string{},
+		Picks:   map[string][]string{},
+		specs:   currentSpecs(),
+		bot:     bot,
+		rng:     rand.New(rand.NewSource(room.Seed + 2)), // own source so the draft never shifts the match's rolls
+	}
+	// Only troops both players own, so a draft cannot hand out cards still locked for one of them
+	hostCards, guestCards := ownedCards(room.Host, d.specs), ownedCards(room.Guest, d.specs)
+	for _, t := range d.specs.Troops {
+		if contains(hostCards, t.Name) && contains(guestCards, t.Name) {
+			d.Pool = append(d.Pool, t.Name)
+		}
+	}
+	if len(d.Pool) < len(draftOrder) {
+		d.Steps = draftOrder[2:] // not enough troops to ban any
+	}
+	if len(d.Pool) < len(d.Steps) {
+		room.Draft = false
+		roomsLock.Unlock()
+		fmt.Printf("Room %s: %d troops are too few to draft, dealing instead\n", roomID, len(d.Pool))
+		beginMatch(roomID)
+		if bot != "" {
+			go runBot(roomID, room.Guest, bot, room.Seed)
+		}
+		return
+	}
+	roomsLock.Unlock()
+	draftsLock.Lock()
+	drafts[roomID] = d
+	done := d.next()
+	draftsLock.Unlock()
+	if done {
+		finishDraft(d)
+	}
+}
+
+// draftOf returns the draft username is taking part in; call with draftsLock held
+func draftOf(username string) *Draft {
+	for _, d := range drafts {
+		if d.Players[0] == username || d.Players[1] == username {
+			return d
+		}
+	}
+	return nil
+}
+
+// draftOpponent returns the other player of the draft username is in; ok is false if
+// username is not drafting
+func draftOpponent(username string) (opponent string, ok bool) {
+	draftsLock.Lock()
+	defer draftsLock.Unlock()
+	d := draftOf(username)
+	if d == nil {
+		return "", false
+	}
+	if d.Players[0] == username {
+		return d.Players[1], true
+	}
+	return d.Players[0], true
+}
+
+// take bans or picks a troop for the player whose turn it is and moves to the next step
+func (d *Draft) take(troop string) {
+	step := d.Steps[d.Step]
+	user := d.Players[step.Seat]
+	for i, name := range d.Pool {
+		if name == troop {
+			d.Pool = append(d.Pool[:i:i], d.Pool[i+1:]...)
+			break
+		}
+	}
+	if step.Action == "BAN" {
+		d.Bans[user] = append(d.Bans[user], troop)
+	} else {
+		d.Picks[user] = append(d.Picks[user], troop)
+	}
+	d.Step++
+}
+
+// next plays the bot's turns, then starts the timer of the next human turn and pushes the
+// draft to everyone in the room. Returns true once every step is done.
+// Call with draftsLock held.
+func (d *Draft) next() bool {
+	for d.Step < len(d.Steps) && isBot(d.Players[d.Steps[d.Step].Seat]) {
+		d.take(d.botChoice())
+	}
+	if d.Step == len(d.Steps) {
+		delete(drafts, d.RoomID)
+		d.push()
+		return true
+	}
+	d.Deadline = time.Now().Add(config.DraftTurn.Duration)
+	step := d.Step
+	time.AfterFunc(config.DraftTurn.Duration, func() { draftTimeout(d.RoomID, step) })
+	d.push()
+	return false
+}
+
+// botChoice is the troop a bot bans or picks: easy bots choose at random, harder ones the
+// strongest attacker, which they either deny the opponent or take themselves
+func (d *Draft) botChoice() string {
+	if d.bot == engine.Easy {
+		return d.Pool[d.rng.Intn(len(d.Pool))]
+	}
+	best := d.Pool[0]
+	bestSpec, _ := d.specs.Troop(best)
+	for _, name := range d.Pool[1:] {
+		if t, _ := d.specs.Troop(name); t.ATK > bestSpec.ATK {
+			best, bestSpec = name, t
+		}
+	}
+	return best
+}
+
+// draftTimeout ends a turn the player let run out: a ban is skipped, a pick is made at random
+func draftTimeout(roomID string, step int) {
+	draftsLock.Lock()
+	d := drafts[roomID]
+	if d == nil || d.Step != step {
+		draftsLock.Unlock()
+		return // the player acted in time or the draft is gone
+	}
+	if d.Steps[step].Action == "BAN" {
+		d.Step++
+	} else {
+		d.take(d.Pool[d.rng.Intn(len(d.Pool))])
+	}
+	done := d.next()
+	draftsLock.Unlock()
+	if done {
+		finishDraft(d)
+	}
+}
+
+// finishDraft hands the picks to the room and starts its match
+func finishDraft(d *Draft) {
+	roomsLock.Lock()
+	room := gameRooms[d.RoomID]
+	if room != nil {
+		room.Picks = d.Picks
+	}
+	roomsLock.Unlock()
+	if room == nil {
+		return
+	}
+	beginMatch(d.RoomID)
+	if d.bot != "" {
+		go runBot(d.RoomID, d.Players[1], d.bot, room.Seed)
+	}
+}
+
+// handleDraft implements PICK|troop and BAN|troop
+// action: PICK or BAN
+// Returns a string message to send back to the client
+func handleDraft(username, action, troop string) string {
+	draftsLock.Lock()
+	d := draftOf(username)
+	if d == nil {
+		draftsLock.Unlock()
+		return errMsg(codeNotInDraft, "No draft in progress")
+	}
+	step := d.Steps[d.Step]
+	switch {
+	case d.Players[step.Seat] != username:
+		draftsLock.Unlock()
+		return errMsg(engine.CodeNotYourTurn, "Not your turn")
+	case step.Action != action:
+		draftsLock.Unlock()
+		return errMsg(codeBadRequest, "It is your turn to "+step.Action)
+	case !contains(d.Pool, troop):
+		draftsLock.Unlock()
+		return errMsg(engine.CodeInvalidTroop, troop+" is not in the pool")
+	}
+	d.take(troop)
+	done := d.next()
+	draftsLock.Unlock()
+	if done {
+		finishDraft(d)
+	}
+	if action == "BAN" {
+		return "ACK|BANNED|" + troop
+	}
+	return "ACK|PICKED|" + troop
+}
+
+// cancelDraft ends the draft username is in, if any, and closes its room; the opponent is
+// sent back to the menu. Returns false if username is not drafting.
+func cancelDraft(username, reason string) bool {
+	draftsLock.Lock()
+	d := draftOf(username)
+	if d != nil {
+		delete(drafts, d.RoomID)
+	}
+	draftsLock.Unlock()
+	if d == nil {
+		return false
+	}
+	msg := fmt.Sprintf("GAME_END|Draft cancelled: %s %s", username, reason)
+	for _, uname := range d.Players {
+		if uname != username {
+			sendToUser(uname, msg)
+		}
+	}
+	sendToSpectators(d.RoomID, msg)
+	roomsLock.Lock()
+	delete(gameRooms, d.RoomID)
+	roomsLock.Unlock()
+	return true
+}
+
+// sendDraftState pushes the draft username is in to them, e.g. after RESUME
+func sendDraftState(username string) {
+	draftsLock.Lock()
+	defer draftsLock.Unlock()
+	if d := draftOf(username); d != nil {
+		sendToUser(username, d.message(username))
+	}
+}
+
+// draftView is the body of a DRAFT message
+type draftView struct {
+	RoomID      string              `json:"room_id"`
+	Players     [2]string           `json:"players"`
+	Step        int                 `json:"step"` // steps taken so far
+	Steps       int                 `json:"steps"`
+	Action      string              `json:"action,omitempty"` // BAN or PICK; empty once the draft is over
+	Turn        string              `json:"turn,omitempty"`
+	YourTurn    bool                `json:"your_turn"`
+	SecondsLeft int                 `json:"seconds_left"`
+	Pool        []string            `json:"pool"`
+	Bans        map[string][]string `json:"bans"`
+	Picks       map[string][]string `json:"picks"`
+	Done        bool                `json:"done"`
+}
+
+// message returns the DRAFT|{json} line as viewer sees it
+func (d *Draft) message(viewer string) string {
+	v := draftView{RoomID: d.RoomID, Players: d.Players, Step: d.Step, Steps: len(d.Steps), Pool: d.Pool, Bans: d.Bans, Picks: d.Picks}
+	if v.Pool == nil {
+		v.Pool = []string{}
+	}
+	if d.Step < len(d.Steps) {
+		step := d.Steps[d.Step]
+		v.Action = step.Action
+		v.Turn = d.Players[step.Seat]
+		v.YourTurn = v.Turn == viewer
+		v.SecondsLeft = int(time.Until(d.Deadline).Round(time.Second).Seconds())
+	} else {
+		v.Done = true
+	}
+	out, _ := json.Marshal(v)
+	return "DRAFT|" + string(out)
+}
+
+// push sends the draft to both players and the room's spectators
+func (d *Draft) push() {
+	for _, uname := range d.Players {
+		if !isBot(uname) {
+			sendToUser(uname, d.message(uname))
+		}
+	}
+	sendToSpectators(d.RoomID, d.message(""))
+}
+
+// startingCards returns the troops a player starts a match with and the cards they may buy
+// and cast: dealt from their deck, or in a drafted room their picks plus the deck's spells
+func startingCards(room *GameRoom, username string, specs *SpecSet, rng *rand.Rand) ([]TroopSpec, []string) {
+	deck := activeDeck(username, specs)
+	picks, drafted := room.Picks[username]
+	if !drafted {
+		return dealHand(deck, specs, rng, handSize), deck
+	}
+	var hand []TroopSpec
+	var cards []string
+	for _, name := range picks {
+		if t, ok := specs.Troop(name); ok { // a reload mid-draft may have removed it
+			hand = append(hand, t)
+			cards = append(cards, name)
+		}
+	}
+	for _, c := range deck {
+		if _, ok := specs.Spell(c); ok {
+			cards = append(cards, c)
+		}
+	}
+	return hand, cards
+}
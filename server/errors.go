@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
+)
+
+// Error codes sent as ERR|CODE|message. Clients branch on the code; the message is for players.
+// Rule violations use the engine's codes (NOT_YOUR_TURN, GUARD_LOCKED, INSUFFICIENT_MANA, ...).
+const (
+	codeBadRequest      = "BAD_REQUEST"         // missing or malformed arguments
+	codeUnknownCommand  = "UNKNOWN_COMMAND"     // command not recognised
+	codeLoginRequired   = "LOGIN_REQUIRED"      // command needs a logged-in user
+	codeBadCredentials  = "INVALID_CREDENTIALS" // wrong username or password
+	codeBadSession      = "INVALID_SESSION"     // RESUME token unknown or expired
+	codeUsernameTaken   = "USERNAME_TAKEN"      // REGISTER with an existing name
+	codeReservedName    = "RESERVED_NAME"       // REGISTER with a name kept for bots
+	codeWeakPassword    = "WEAK_PASSWORD"       // password fails the server's policy
+	codeInGame          = "IN_GAME"             // not allowed while playing a match
+	codeRoomUnavailable = "ROOM_UNAVAILABLE"    // room missing, full or not running
+	codeNotSpectating   = "NOT_SPECTATING"
+	codeNotQueued       = "NOT_QUEUED"
+	codeNotFound        = "NOT_FOUND"    // user or replay does not exist
+	codeUnknownUnit     = "UNKNOWN_UNIT" // no tower or troop with that name
+	codeMaxLevel        = "MAX_LEVEL"    // unit cannot be upgraded further
+	codeNoGold          = "INSUFFICIENT_GOLD"
+	codeNoEXP           = "INSUFFICIENT_EXP"
+	codeNotOwned        = "NOT_OWNED"     // card not in the user's collection
+	codeNotInDeck       = "NOT_IN_DECK"   // card not in the deck the match was dealt from
+	codeNotInDraft      = "NOT_IN_DRAFT"  // PICK or BAN outside a draft
+	codeStorage         = "STORAGE_ERROR" // the user store failed to save
+	codeForbidden       = "FORBIDDEN"     // admin command from a non-admin
+	codeInvalidSpecs    = "INVALID_SPECS" // reloaded specs file failed validation
+	codeInternal        = "INTERNAL"
+)
+
+// errMsg formats an error reply
+func errMsg(code, msg string) string {
+	return "ERR|" + code + "|" + msg
+}
+
+// codedError is an error that carries its protocol error code
+type codedError struct {
+	code string
+	msg  string
+}
+
+func (e *codedError) Error() string { return e.msg }
+
+// errorReply formats err as an error reply, picking the code from the error chain
+func errorReply(err error) string {
+	var rule *engine.RuleError
+	var coded *codedError
+	switch {
+	case errors.As(err, &rule):
+		return errMsg(rule.Code, err.Error())
+	case errors.As(err, &coded):
+		return errMsg(coded.code, err.Error())
+	case errors.Is(err, ErrUserExists):
+		return errMsg(codeUsernameTaken, err.Error())
+	case errors.Is(err, ErrUserNotFound):
+		return errMsg(codeNotFound, err.Error())
+	}
+	return errMsg(codeInternal, err.Error())
+}
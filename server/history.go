@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
+)
+
+// historyLimit is how many finished matches are kept per user, newest first
+const historyLimit = 20
+
+// MatchRecord is one finished match in a user's history
+type MatchRecord struct {
+	ReplayID string    `json:"replay_id"`
+	Mode     string    `json:"mode"`
+	Opponent string    `json:"opponent"`
+	Result   string    `json:"result"` // win, loss or draw
+	Reason   string    `json:"reason"`
+	Rating   int       `json:"rating"` // the user's rating after the match
+	EndedAt  time.Time `json:"ended_at"`
+}
+
+// recordHistory adds a finished match to the history of both players
+// Call after updateRatings so the stored rating is the new one; bots have no history
+func recordHistory(m *engine.Match, ev engine.Event, replayID string) {
+	for _, uname := range m.Order {
+		result := "loss"
+		switch ev.Winner {
+		case engine.Draw:
+			result = "draw"
+		case uname:
+			result = "win"
+		}
+		err := userStore.Modify(uname, func(u *User) error {
+			rec := MatchRecord{
+				ReplayID: replayID,
+				Mode:     string(m.Mode),
+				Opponent: m.Opponent(uname),
+				Result:   result,
+				Reason:   ev.Reason,
+				Rating:   userRating(*u),
+				EndedAt:  time.Now(),
+			}
+			u.History = append([]MatchRecord{rec}, u.History...)
+			if len(u.History) > historyLimit {
+				u.History = u.History[:historyLimit]
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrUserNotFound) { // bots have no account
+			fmt.Println("Error saving match history for", uname+":", err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
+)
+
+// Elo rating and the matchmaking queue
+const (
+	defaultRating = 1200
+	ratingK       = 32 // maximum rating change per match
+
+	queueGapStart  = 100             // rating gap accepted as soon as a player queues
+	queueGapStep   = 50              // extra gap accepted per queueGapEvery waited
+	queueGapEvery  = 5 * time.Second // how often the accepted gap widens
+	queueGapMax    = 1000            // the gap never widens past this
+	queueScanEvery = 1 * time.Second // how often the matchmaker looks for pairs
+)
+
+// queueEntry is one player waiting for a match
+type queueEntry struct {
+	Username string
+	Mode     string
+	Rating   int
+	Since    time.Time
+}
+
+var (
+	matchQueue = make(map[string]*queueEntry) // username -> entry
+	queueLock  sync.Mutex
+)
+
+// userRating returns a user's rating, defaulting to defaultRating for unrated users
+func userRating(u User) int {
+	if u.Rating == 0 {
+		return defaultRating
+	}
+	return u.Rating
+}
+
+// enqueue adds username to the matchmaking queue for mode
+// Returns the reply for the QUEUE command
+func enqueue(username, mode string) string {
+	if mode != "SIMPLE" && mode != "ENHANCED" {
+		return errMsg(codeBadRequest, "Usage: QUEUE|SIMPLE or QUEUE|ENHANCED")
+	}
+	if _, _, inGame := findActiveGame(username); inGame {
+		return errMsg(codeInGame, "Already in a match")
+	}
+	u, ok := userStore.Get(username)
+	if !ok {
+		return errMsg(codeNotFound, "Unknown user")
+	}
+	rating := userRating(u)
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	matchQueue[username] = &queueEntry{Username: username, Mode: mode, Rating: rating, Since: time.Now()}
+	return fmt.Sprintf("ACK|QUEUED|%s|%d", mode, rating)
+}
+
+// dequeue removes username from the queue; returns false if they were not queued
+func dequeue(username string) bool {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	if _, ok := matchQueue[username]; !ok {
+		return false
+	}
+	delete(matchQueue, username)
+	return true
+}
+
+// acceptedGap returns the rating gap a player accepts after waiting for d
+func acceptedGap(d time.Duration) int {
+	gap := queueGapStart + queueGapStep*int(d/queueGapEvery)
+	if gap > queueGapMax {
+		return queueGapMax
+	}
+	return gap
+}
+
+// runMatchmaker pairs queued players forever
+func runMatchmaker() {
+	for {
+		time.Sleep(queueScanEvery)
+		for _, pair := range findPairs(time.Now()) {
+			startQueuedMatch(pair[0], pair[1])
+		}
+	}
+}
+
+// findPairs removes and returns pairs of queued players of the same mode whose ratings
+// are close enough. Longest-waiting players are matched first, each with the closest
+// rating within the gap the longer waiter of the two accepts.
+func findPairs(now time.Time) [][2]*queueEntry {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	waiting := make([]*queueEntry, 0, len(matchQueue))
+	for _, e := range matchQueue {
+		waiting = append(waiting, e)
+	}
+	sort.Slice(waiting, func(i, j int) bool { return waiting[i].Since.Before(waiting[j].Since) })
+	var pairs [][2]*queueEntry
+	paired := map[string]bool{}
+	for i, a := range waiting {
+		if paired[a.Username] {
+			continue
+		}
+		gap := acceptedGap(now.Sub(a.Since)) // a waited longest, so a's gap is the wider one
+		var best *queueEntry
+		for _, b := range waiting[i+1:] {
+			if paired[b.Username] || b.Mode != a.Mode {
+				continue
+			}
+			diff := abs(a.Rating - b.Rating)
+			if diff <= gap && (best == nil || diff < abs(a.Rating-best.Rating)) {
+				best = b
+			}
+		}
+		if best != nil {
+			paired[a.Username], paired[best.Username] = true, true
+			delete(matchQueue, a.Username)
+			delete(matchQueue, best.Username)
+			pairs = append(pairs, [2]*queueEntry{a, best})
+		}
+	}
+	return pairs
+}
+
+// startQueuedMatch creates a room for a matched pair and starts the match
+func startQueuedMatch(a, b *queueEntry) {
+	roomID := createGameRoom(a.Username, a.Mode, time.Now().UnixNano(), false)
+	joinGameRoom(roomID, b.Username)
+	sendToUser(a.Username, fmt.Sprintf("MATCH_FOUND|%s|%s|%d", roomID, b.Username, b.Rating))
+	sendToUser(b.Username, fmt.Sprintf("MATCH_FOUND|%s|%s|%d", roomID, a.Username, a.Rating))
+	beginMatch(roomID)
+}
+
+// updateRatings applies the Elo result of a finished match between two human players.
+// Returns the "|RATING:old->new" suffix for each player's GAME_END line; bot matches are unrated.
+func updateRatings(m *engine.Match, ev engine.Event) map[string]string {
+	suffix := map[string]string{}
+	if len(m.Order) < 2 || isBot(m.Order[0]) || isBot(m.Order[1]) {
+		return suffix
+	}
+	ua, okA := userStore.Get(m.Order[0])
+	ub, okB := userStore.Get(m.Order[1])
+	if !okA || !okB {
+		return suffix
+	}
+	ra, rb := userRating(ua), userRating(ub)
+	scoreA := 0.5
+	switch ev.Winner {
+	case ua.Username:
+		scoreA = 1
+	case ub.Username:
+		scoreA = 0
+	}
+	expectedA := 1 / (1 + math.Pow(10, float64(rb-ra)/400))
+	delta := int(math.Round(ratingK * (scoreA - expectedA)))
+	ua.Rating, ub.Rating = ra+delta, rb-delta
+	for _, u := range []User{ua, ub} {
+		rating := u.Rating
+		err := userStore.Modify(u.Username, func(stored *User) error {
+			stored.Rating = rating
+			return nil
+		})
+		if err != nil {
+			fmt.Println("Error saving rating for", u.Username+":", err)
+		}
+	}
+	suffix[ua.Username] = fmt.Sprintf("|RATING:%d->%d", ra, ua.Rating)
+	suffix[ub.Username] = fmt.Sprintf("|RATING:%d->%d", rb, ub.Rating)
+	return suffix
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
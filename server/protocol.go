@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Wire protocol versions, negotiated per connection with HELLO|version
+// Version 1 is the original CMD|a|b line format. Version 2 switches the connection to
+// newline-delimited JSON envelopes for every command, reply and event.
+const (
+	protoPipe   = 1
+	protoJSON   = 2
+	protoLatest = protoJSON
+)
+
+// envelope is one JSON line of protocol version 2
+type envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`      // request id, echoed in the reply to that request
+	Payload json.RawMessage `json:"payload,omitempty"` // command arguments or event fields
+}
+
+// peer is one client connection and the protocol version it speaks
+// All writes go through Send so concurrent pushes never interleave within a line
+type peer struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	version int
+}
+
+func newPeer(conn net.Conn) *peer {
+	return &peer{conn: conn, version: protoPipe}
+}
+
+// Send writes a legacy protocol line, converted to a JSON envelope for version 2 peers
+func (p *peer) Send(line string) {
+	p.Reply(line, "")
+}
+
+// Reply writes line as the reply to the request with the given id
+// Pipe replies carry the id as a "#id|" prefix, JSON replies in the envelope
+func (p *peer) Reply(line, id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.version < protoJSON {
+		if id != "" {
+			line = "#" + id + "|" + line
+		}
+		p.conn.Write([]byte(line + "\n"))
+		return
+	}
+	p.conn.Write(append(encodeJSON(lineToEnvelope(line, id)), '\n'))
+}
+
+// JSON reports whether the peer speaks protocol version 2
+func (p *peer) JSON() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.version >= protoJSON
+}
+
+// hello switches the peer to the highest version it asked for that the server speaks.
+// The HELLO reply is already written in the new format, so a JSON client's first JSON line is the HELLO answer.
+func (p *peer) hello(requested string) {
+	v, err := strconv.Atoi(strings.TrimSpace(requested))
+	if err != nil || v < protoPipe {
+		p.Send(errMsg(codeBadRequest, "Usage: HELLO|version"))
+		return
+	}
+	if v > protoLatest {
+		v = protoLatest
+	}
+	p.mu.Lock()
+	p.version = v
+	p.mu.Unlock()
+	p.Send(fmt.Sprintf("HELLO|%d|%d", v, protoLatest))
+}
+
+// loadPeer returns the peer of a connected user
+func loadPeer(username string) (*peer, bool) {
+	v, ok := userConns.Load(username)
+	if !ok {
+		return nil, false
+	}
+	p, ok := v.(*peer)
+	return p, ok
+}
+
+// commandArgs lists, per command, the payload fields of a JSON envelope in pipe argument order
+var commandArgs = map[string][]string{
+	"HELLO":       {"version"},
+	"LOGIN":       {"username", "password"},
+	"RESUME":      {"token"},
+	"REGISTER":    {"username", "password"},
+	"CREATE_GAME": {"mode", "draft", "bot", "seed"},
+	"JOIN_GAME":   {"room_id"},
+	"START_GAME":  {"room_id"},
+	"DEPLOY":      {"troop", "tower"},
+	"SPECTATE":    {"room_id"},
+	"GET_REPLAY":  {"id"},
+	"UPGRADE":     {"name", "currency"},
+	"BUY":         {"troop"},
+	"CAST":        {"spell", "tower"},
+	"QUEUE":       {"mode"},
+	"SET_DECK":    {"name", "cards"},
+	"PICK":        {"troop"},
+	"BAN":         {"troop"},
+}
+
+// envelopeToLine converts a JSON command into the equivalent pipe line
+// Returns the line and the request id
+func envelopeToLine(raw string) (string, string, error) {
+	var env envelope
+	if err := json.Unmarshal([]byte(raw), &env); err != nil {
+		return "", "", fmt.Errorf("Invalid JSON envelope")
+	}
+	cmd := strings.ToUpper(env.Type)
+	if cmd == "" {
+		return "", env.ID, fmt.Errorf("Missing envelope type")
+	}
+	fields := map[string]interface{}{}
+	if len(env.Payload) > 0 {
+		if err := json.Unmarshal(env.Payload, &fields); err != nil {
+			return "", env.ID, fmt.Errorf("Payload must be a JSON object")
+		}
+	}
+	parts := []string{cmd}
+	for _, name := range commandArgs[cmd] {
+		v, ok := fields[name]
+		if cmd == "CREATE_GAME" && name == "draft" {
+			if v == true {
+				parts = append(parts, "DRAFT") // a flag: pipe form is CREATE_GAME|mode|DRAFT|...
+			}
+			continue
+		}
+		if !ok || v == nil {
+			if cmd != "CREATE_GAME" || name != "bot" {
+				parts = append(parts, "")
+			}
+			continue
+		}
+		s := fmt.Sprint(v)
+		if list, isList := v.([]interface{}); isList {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			s = strings.Join(items, ",") // lists such as a deck's cards are comma-separated
+		}
+		if f, isNum := v.(float64); isNum {
+			s = strconv.FormatFloat(f, 'f', -1, 64) // seeds must not come out in exponent form
+		}
+		if strings.ContainsAny(s, "|\n") {
+			return "", env.ID, fmt.Errorf("Field %s must not contain '|' or newlines", name)
+		}
+		if cmd == "CREATE_GAME" && name == "bot" && s != "" {
+			parts = append(parts, "BOT") // pipe form is CREATE_GAME|mode|BOT|difficulty|seed
+		}
+		parts = append(parts, s)
+	}
+	// Drop empty trailing arguments so optional fields behave as in the pipe protocol
+	for len(parts) > 1 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, "|"), env.ID, nil
+}
+
+// eventFields names the fields of each pipe message, in order, for its JSON payload.
+// A "#" suffix marks an integer field and "?" a flag; ACK lines are keyed by their status word.
+// Values written as KEY:value in the pipe line are unwrapped.
+var eventFields = map[string][]string{
+	"HELLO":                 {"version#", "latest#"},
+	"ACK|Login successful":  {"message", "token"},
+	"ACK|Resumed":           {"message", "username", "where", "room_id"},
+	"ACK|GAME_CREATED":      {"status", "room_id"},
+	"ACK|JOINED":            {"status", "room_id"},
+	"ACK|SPECTATING":        {"status", "room_id", "mode"},
+	"ACK|QUEUED":            {"status", "mode", "rating#"},
+	"ACK|UPGRADED":          {"status", "name", "level#", "gold#", "exp#"},
+	"ACK|SPECS_RELOADED":    {"status", "version#", "towers#", "troops#"},
+	"ACK|DECK_SAVED":        {"status", "name", "cards#"},
+	"ACK|DECK_SELECTED":     {"status", "name"},
+	"ACK|PICKED":            {"status", "troop"},
+	"ACK|BANNED":            {"status", "troop"},
+	"ACK":                   {"message"},
+	"TURN":                  {"message"},
+	"WAITING":               {"message"},
+	"GAME_END":              {"message", "seed#", "rating"},
+	"ATTACK_RESULT":         {"troop", "tower", "damage#", "tower_hp#", "tower_hit#", "crit?", "troop_hp#", "destroyed?"},
+	"SPELL_CAST":            {"player", "spell", "tower", "mana#"},
+	"ABILITY":               {"player", "troop", "ability", "target", "tower", "amount#", "value#", "duration#", "destroyed?"},
+	"OPPONENT_DISCONNECTED": {"player", "grace_seconds#"},
+	"OPPONENT_RECONNECTED":  {"player"},
+	"MATCH_FOUND":           {"room_id", "opponent", "rating#"},
+	"CARD_UNLOCKED":         {"card"},
+	"UNIT_DEPLOYED":         {"player", "troop", "unit#", "lane", "pos#", "tower"},
+	"UNIT_HIT":              {"player", "troop", "unit#", "target", "foe", "foe_unit#", "damage#", "foe_hp#", "killed?"},
+	"PHASE":                 {"phase", "seconds#"},
+	"TOWER_SHOT":            {"player", "tower", "target", "foe", "foe_unit#", "damage#", "foe_hp#", "crit?", "killed?"},
+}
+
+// jsonBodies are messages whose whole body is already JSON and becomes the payload as is
+var jsonBodies = map[string]bool{"STATE": true, "REPLAY": true, "PROFILE": true, "DECKS": true, "DRAFT": true, "DELTA": true}
+
+// lineToEnvelope converts a pipe protocol line into a JSON envelope
+func lineToEnvelope(line, id string) envelope {
+	parts := strings.Split(line, "|")
+	typ := parts[0]
+	env := envelope{Type: typ, ID: id}
+	if len(parts) == 1 {
+		return env
+	}
+	body := strings.SplitN(line, "|", 2)[1]
+	if jsonBodies[typ] && strings.HasPrefix(body, "{") {
+		env.Payload = json.RawMessage(body)
+		return env
+	}
+	var payload interface{}
+	switch typ {
+	case "ERR":
+		codeAndMsg := strings.SplitN(body, "|", 2) // messages may themselves contain '|'
+		if len(codeAndMsg) < 2 {
+			codeAndMsg = append(codeAndMsg, "")
+		}
+		payload = map[string]interface{}{"code": codeAndMsg[0], "message": codeAndMsg[1]}
+	case "GAMES":
+		payload = map[string]interface{}{"rooms": roomEntries(body)}
+	case "REPLAYS":
+		payload = map[string]interface{}{"replays": listEntries(body, []string{"id", "mode", "players", "winner"})}
+	case "STATE":
+		payload = map[string]interface{}{"text": body} // multi-line text state of a pipe-only sender
+	default:
+		payload = fieldsPayload(typ, parts[1:])
+	}
+	env.Payload = encodeJSON(payload)
+	return env
+}
+
+// encodeJSON marshals v without HTML escaping, so values like "1200->1216" stay readable
+func encodeJSON(v interface{}) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
+
+// fieldsPayload maps pipe arguments onto the field names declared in eventFields
+func fieldsPayload(typ string, args []string) map[string]interface{} {
+	names, ok := eventFields[typ+"|"+args[0]]
+	if !ok {
+		names = eventFields[typ]
+	}
+	out := map[string]interface{}{}
+	for i, arg := range args {
+		if i >= len(names) {
+			out["args"] = args[i:] // fields without a declared name
+			break
+		}
+		name := names[i]
+		kind := name[len(name)-1]
+		if kind == '#' || kind == '?' {
+			name = name[:len(name)-1]
+		}
+		if k := strings.ToUpper(name) + ":"; strings.HasPrefix(strings.ToUpper(arg), k) {
+			arg = arg[len(k):] // SEED:42 -> 42
+		}
+		switch kind {
+		case '#':
+			if n, err := strconv.ParseInt(arg, 10, 64); err == nil {
+				out[name] = n
+				continue
+			}
+		case '?':
+			out[name] = arg == "true" || strings.EqualFold(arg, name)
+			continue
+		}
+		out[name] = arg
+	}
+	return out
+}
+
+// roomEntries splits a GAMES list into open rooms (id:host) and running ones (id:host:guest:mode:spectators)
+func roomEntries(body string) []map[string]interface{} {
+	rooms := listEntries(body, []string{"id", "host", "guest", "mode", "spectators"})
+	for _, r := range rooms {
+		if s, ok := r["spectators"].(string); ok {
+			n, _ := strconv.Atoi(s)
+			r["spectators"] = n
+			r["running"] = true
+		} else {
+			r["running"] = false
+		}
+	}
+	return rooms
+}
+
+// listEntries splits a comma-separated list of colon-separated entries into named fields
+func listEntries(body string, names []string) []map[string]interface{} {
+	out := []map[string]interface{}{}
+	for _, entry := range strings.Split(body, ",") {
+		if entry == "" {
+			continue
+		}
+		vals := strings.SplitN(entry, ":", len(names))
+		m := map[string]interface{}{}
+		for i, v := range vals {
+			m[names[i]] = v
+		}
+		out = append(out, m)
+	}
+	return out
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
+)
+
+// Replay is the full record of one match: its seed, starting state and every step
+type Replay struct {
+	ID        string          `json:"id"`
+	RoomID    string          `json:"room_id"`
+	Mode      string          `json:"mode"`
+	Seed      int64           `json:"seed"`
+	Players   []string        `json:"players"`
+	StartTime time.Time       `json:"start_time"`
+	EndTime   time.Time       `json:"end_time"`
+	Initial   json.RawMessage `json:"initial"` // state before the first action
+	Frames    []ReplayFrame   `json:"frames"`
+	Winner    string          `json:"winner"`
+	Reason    string          `json:"reason"`
+}
+
+// ReplayFrame is one applied action with the events it produced and the state afterwards
+type ReplayFrame struct {
+	T      int64           `json:"t"`      // milliseconds since the match started
+	Action string          `json:"action"` // e.g. "DEPLOY|alice|Pawn|Guard1"
+	Events []engine.Event  `json:"events"`
+	State  json.RawMessage `json:"state"`
+}
+
+// replayRecorder collects frames while a match runs
+type replayRecorder struct {
+	replay Replay
+}
+
+// newReplayRecorder starts recording a match from its initial state
+func newReplayRecorder(roomID string, m *engine.Match, state interface{}) *replayRecorder {
+	start := time.Now()
+	initial, _ := json.Marshal(state)
+	return &replayRecorder{replay: Replay{
+		ID:        fmt.Sprintf("%s-%d", roomID, start.Unix()),
+		RoomID:    roomID,
+		Mode:      string(m.Mode),
+		Seed:      m.Seed,
+		Players:   append([]string(nil), m.Order...),
+		StartTime: start,
+		Initial:   initial,
+	}}
+}
+
+// record appends a frame for an applied action
+// action: the command fields joined by "|"; state: snapshot after the action
+func (r *replayRecorder) record(action string, events []engine.Event, state interface{}) {
+	if r == nil {
+		return
+	}
+	snapshot, _ := json.Marshal(state)
+	r.replay.Frames = append(r.replay.Frames, ReplayFrame{
+		T:      time.Since(r.replay.StartTime).Milliseconds(),
+		Action: action,
+		Events: events,
+		State:  snapshot,
+	})
+}
+
+// ID returns the id the replay is saved under
+func (r *replayRecorder) ID() string {
+	if r == nil {
+		return ""
+	}
+	return r.replay.ID
+}
+
+// finish stores the result and writes the replay to the replays directory
+func (r *replayRecorder) finish(ev engine.Event) {
+	if r == nil {
+		return
+	}
+	r.replay.EndTime = time.Now()
+	r.replay.Winner = ev.Winner
+	r.replay.Reason = ev.Reason
+	out, err := json.Marshal(r.replay)
+	if err == nil {
+		if err = os.MkdirAll(config.ReplaysDir, 0755); err == nil {
+			err = writeFileAtomic(filepath.Join(config.ReplaysDir, r.replay.ID+".json"), out)
+		}
+	}
+	if err != nil {
+		fmt.Println("Error saving replay", r.replay.ID+":", err)
+	}
+}
+
+// replayIDPattern guards GET_REPLAY against paths outside the replays directory
+var replayIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// listReplays returns "REPLAYS|id:mode:p1 vs p2:winner,..." newest first
+func listReplays() string {
+	files, err := ioutil.ReadDir(config.ReplaysDir)
+	if err != nil {
+		return "REPLAYS|"
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	var entries []string
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(config.ReplaysDir, f.Name()))
+		if err != nil {
+			continue
+		}
+		var r Replay
+		if json.Unmarshal(data, &r) != nil {
+			continue
+		}
+		entries = append(entries, fmt.Sprintf("%s:%s:%s:%s", r.ID, r.Mode, strings.Join(r.Players, " vs "), r.Winner))
+	}
+	return "REPLAYS|" + strings.Join(entries, ",")
+}
+
+// getReplay returns "REPLAY|{json}" for a replay id
+func getReplay(id string) string {
+	if !replayIDPattern.MatchString(id) {
+		return errMsg(codeBadRequest, "Invalid replay id")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(config.ReplaysDir, id+".json"))
+	if err != nil {
+		return errMsg(codeNotFound, "No such replay")
+	}
+	return "REPLAY|" + string(data)
+}
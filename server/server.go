@@ -2,23 +2,36 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"math/rand"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
 )
 
 // User and GameRoom structures
 type User struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	EXP      int    `json:"exp"`
-	Level    int    `json:"level"`
+	Username string         `json:"username"`
+	Password string         `json:"password"`
+	EXP      int            `json:"exp"`
+	Level    int            `json:"level"`
+	Gold     int            `json:"gold"`
+	Rating   int            `json:"rating,omitempty"`   // Elo rating, defaultRating until the first rated match
+	TowerLv  map[string]int `json:"tower_lv,omitempty"` // per-tower upgrade level
+	TroopLv  map[string]int `json:"troop_lv,omitempty"` // per-troop upgrade level
+	History  []MatchRecord  `json:"history,omitempty"`  // recent matches, newest first
+
+	Cards      []string            `json:"cards,omitempty"`       // locked cards the user has earned
+	Decks      map[string][]string `json:"decks,omitempty"`       // saved decks by name
+	ActiveDeck string              `json:"active_deck,omitempty"` // deck new matches deal from
 }
 
 type UsersData struct {
@@ -31,55 +44,35 @@ type GameRoom struct {
 	Guest   string
 	Started bool
 	Mode    string // SIMPLE or ENHANCED
+	Seed    int64  // seed for the match's random source
+	// Spectators are logged-in users watching the match (username -> true)
+	Spectators map[string]bool
+	// Draft rooms let the players pick their troops before the match (see draft.go);
+	// Picks holds each player's picks once the draft is over
+	Draft bool
+	Picks map[string][]string
 }
 
 var (
-	usersLock sync.Mutex
-	usersFile = "data/users.json"
-	gameRooms = make(map[string]*GameRoom)
-	roomsLock sync.Mutex
+	gameRooms  = make(map[string]*GameRoom)
+	roomsLock  sync.Mutex
+	lastRoomID int // room IDs are never reused, even after rooms are deleted
 )
 
-// Tower and Troop specs (Simple TCR, hardcoded for now)
-// REMOVE any hardcoded troopTemplates or towerTemplates here
-
-// Declare global variables for loaded specs
-var (
-	towerSpecs []TowerSpec
-	troopSpecs []TroopSpec
+// Tower, Troop and PlayerState are the combat types of the engine package
+type (
+	Tower       = engine.Tower
+	Troop       = engine.Troop
+	PlayerState = engine.Player
 )
 
-// Tower and Troop specs (Simple TCR, hardcoded for now)
-type Tower struct {
-	Name string
-	HP   int
-	ATK  int
-	DEF  int
-}
-
-type Troop struct {
-	Name  string
-	HP    int
-	ATK   int
-	DEF   int
-	Owner string // Username
-	// HP = 0 nghĩa là quân đã chết hoặc đã sử dụng
-}
-
-type PlayerState struct {
-	Username string
-	Towers   map[string]*Tower
-	Troops   []*Troop
-	Turn     bool
-}
-
+// GameState is a SIMPLE match: the engine state plus the room it belongs to
 type GameState struct {
-	RoomID         string
-	Players        map[string]*PlayerState // username -> state
-	TurnUser       string
-	Winner         string
-	Over           bool
-	AttackPatterns map[string]string // tracks which guard tower each player is attacking first
+	RoomID string
+	*engine.Match
+	SpecVersion int             // version of the specs the match started with
+	Specs       *SpecSet        `json:"-"`
+	Replay      *replayRecorder `json:"-"`
 }
 
 var (
@@ -90,68 +83,136 @@ var (
 // Enhanced TCR: Add CRIT, MANA, EXP, Leveling, Timer, JSON specs
 type TowerSpec struct {
 	Name string  `json:"name"`
+	Role string  `json:"role"` // king or guard; the rules use roles, not names
 	HP   int     `json:"hp"`
 	ATK  int     `json:"atk"`
 	DEF  int     `json:"def"`
 	CRIT float64 `json:"crit"`
 	EXP  int     `json:"exp"`
+	// HitSpeed is the sim ticks from one shot to the next in ENHANCED; 0 or 1 shoots every tick
+	HitSpeed int `json:"hit_speed,omitempty"`
 }
 
 type TroopSpec struct {
-	Name    string `json:"name"`
-	HP      int    `json:"hp"`
-	ATK     int    `json:"atk"`
-	DEF     int    `json:"def"`
-	MANA    int    `json:"mana"`
-	EXP     int    `json:"exp"`
-	Special string `json:"special"`
+	Name string `json:"name"`
+	HP   int    `json:"hp"`
+	ATK  int    `json:"atk"`
+	DEF  int    `json:"def"`
+	MANA int    `json:"mana"`
+	EXP  int    `json:"exp"`
+	// HitSpeed is the sim ticks from one attack to the next in ENHANCED; 0 or 1 attacks every tick
+	HitSpeed int `json:"hit_speed,omitempty"`
+	// Targets is "towers" for troops that ignore enemy troops; "" or "any" fights them first
+	Targets string `json:"targets,omitempty"`
+	// Ability is the troop's special effect, e.g. {"kind": "heal", "amount": 300}
+	Ability *engine.Ability `json:"ability,omitempty"`
+	Locked  bool            `json:"locked,omitempty"` // earned by winning matches instead of owned from the start
+}
+
+// SpellSpec is a spell card: cast in ENHANCED matches for mana, it applies its effect
+// without fighting a tower
+type SpellSpec struct {
+	Name     string          `json:"name"`
+	MANA     int             `json:"mana"`
+	Cooldown int             `json:"cooldown"` // ticks (regen intervals) before it can be cast again
+	Effect   *engine.Ability `json:"effect"`
+	Locked   bool            `json:"locked,omitempty"` // earned by winning matches instead of owned from the start
 }
 
 type PlayerProgress struct {
 	Username string         `json:"username"`
 	EXP      int            `json:"exp"`
 	Level    int            `json:"level"`
+	Gold     int            `json:"gold"`
+	Rating   int            `json:"rating"`
 	TowerLv  map[string]int `json:"tower_lv"`
 	TroopLv  map[string]int `json:"troop_lv"`
 }
 
 // Enhanced PlayerState for mana, exp, etc.
 type EnhancedPlayerState struct {
-	Username string
-	Towers   map[string]*Tower
-	Troops   []*Troop
-	Mana     int
-	EXP      int
-	Level    int
-	Progress *PlayerProgress
+	*engine.Player // towers, troops and mana
+	EXP            int
+	Level          int
+	Progress       *PlayerProgress
+	Deck           []string // cards the player may buy and cast, dealt from their active deck
 }
 
+// EnhancedGameState is an ENHANCED match; Players shadows Match.Players to add progress info
 type EnhancedGameState struct {
-	RoomID         string
-	Players        map[string]*EnhancedPlayerState
-	Winner         string
-	Over           bool
-	StartTime      time.Time
-	EndTime        time.Time
-	AttackPatterns map[string]string // tracks which guard tower each player is attacking first
+	RoomID string
+	*engine.Match
+	Players     map[string]*EnhancedPlayerState
+	StartTime   time.Time
+	EndTime     time.Time
+	SpecVersion int             // version of the specs the match started with
+	Spells      []SpellSpec     `json:",omitempty"` // spells the players can cast
+	Arena       *engine.Arena   `json:",omitempty"` // lane layout of an arena match; units are in Field
+	Specs       *SpecSet        `json:"-"`          // troops bought mid-match come from these specs
+	Replay      *replayRecorder `json:"-"`
+	seen        fieldSeen       // the field as players last saw it, for DELTA
 }
 
 var (
 	enhancedGames     = make(map[string]*EnhancedGameState)
 	enhancedGamesLock sync.Mutex
-	specsFile         = "data/specs.json"
-	progressFile      = "data/users.json"
 )
 
 func main() {
-	fmt.Println("TCR Server starting...") // Print server start message
-	ln, err := net.Listen("tcp", ":9000") // Listen for TCP connections on port 9000
+	// Subcommands run instead of the server: "gencert" writes a self-signed certificate
+	// for -tls-cert/-tls-key, "specs validate" checks a specs file
+	if len(os.Args) >= 2 && os.Args[1] == "gencert" {
+		runGencert(os.Args[2:])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "specs" {
+		runSpecsCommand(os.Args[2:])
+		return
+	}
+	// Settings come from data/config.json (or -config), overridden by flags
+	var err error
+	config, err = loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Println("Error in configuration:", err)
+		os.Exit(1)
+	}
+	if _, err := reloadSpecs(); err != nil { // Load specs at startup
+		fmt.Println("Error loading specs:", err)
+		os.Exit(1)
+	}
+	if config.SpecsPoll.Duration > 0 {
+		go watchSpecs(config.SpecsPoll.Duration) // Later edits are reloaded without a restart
+	}
+	serverTLS, err = loadTLSConfig(config.TLSCert, config.TLSKey)
+	if err != nil {
+		fmt.Println("Error loading TLS certificate:", err)
+		os.Exit(1)
+	}
+	store, err := openUserStore(config.Store)
+	if err != nil {
+		fmt.Println("Error opening user store:", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	userStore = store
+	go runMatchmaker() // Pair players waiting in QUEUE
+	if config.HTTPAddr != "" {
+		go startHTTP(config.HTTPAddr) // Browser clients connect over WebSocket
+	}
+	fmt.Println("TCR Server starting...")   // Print server start message
+	addr := fmt.Sprintf(":%d", config.Port) // Game port, 9000 by default
+	ln, err := net.Listen("tcp", addr)      // Listen for TCP connections on the game port
 	if err != nil {
 		fmt.Println("Error starting server:", err) // Print error if cannot start
 		os.Exit(1)                                 // Exit if error
 	}
-	defer ln.Close()                         // Ensure listener is closed on exit
-	fmt.Println("Server listening on :9000") // Print listening message
+	defer ln.Close() // Ensure listener is closed on exit
+	if serverTLS != nil {
+		ln = tls.NewListener(ln, serverTLS) // Every connection does the TLS handshake before its first line
+		fmt.Println("Server listening on", addr, "(TLS)")
+	} else {
+		fmt.Println("Server listening on", addr) // Print listening message
+	}
 	for {
 		conn, err := ln.Accept() // Accept new connection
 		if err != nil {
@@ -166,135 +227,210 @@ func main() {
 // conn: the TCP connection to the client
 func handleConnection(conn net.Conn) {
 	defer conn.Close() // Ensure connection is closed when function exits
-	// send is a helper function to send a message to the client, always appending a newline
-	send := func(msg string) { conn.Write([]byte(msg + "\n")) }
+	p := newPeer(conn) // Protocol version of this connection, switched by HELLO
+	var requestID string
+	// send is a helper function to reply to the current command in the connection's protocol
+	send := func(msg string) { p.Reply(msg, requestID) }
 	// scanner reads lines from the client connection
 	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 	var currentUser *User      // Track the currently logged-in user (if any)
 	var currentUsername string // Track the username of the current user
 	for scanner.Scan() {       // Main loop: read each line from client
-		line := scanner.Text()                // Read a line from client
+		line := scanner.Text() // Read a line from client
+		requestID = ""
+		if strings.HasPrefix(line, "{") {
+			// JSON envelope: handled exactly like the equivalent pipe command
+			l, id, err := envelopeToLine(line)
+			requestID = id
+			if err != nil {
+				send(errMsg(codeBadRequest, err.Error()))
+				continue
+			}
+			line = l
+		} else if strings.HasPrefix(line, "#") {
+			// #id|CMD|a|b: the reply to this command is sent back as #id|...
+			idAndCmd := strings.SplitN(line[1:], "|", 2)
+			requestID = idAndCmd[0]
+			line = ""
+			if len(idAndCmd) == 2 {
+				line = idAndCmd[1]
+			}
+		}
 		parts := strings.SplitN(line, "|", 3) // Split command by |
 		cmd := strings.ToUpper(parts[0])      // Get command type (always uppercase)
 		switch cmd {
+		case "HELLO":
+			if len(parts) < 2 {
+				send(errMsg(codeBadRequest, "Usage: HELLO|version"))
+				continue
+			}
+			p.hello(parts[1])
 		case "LOGIN":
 			if len(parts) < 3 {
-				send("ERR|Usage: LOGIN|username|password") // Not enough arguments
+				send(errMsg(codeBadRequest, "Usage: LOGIN|username|password")) // Not enough arguments
 				continue
 			}
 			user := authenticate(parts[1], parts[2]) // Check credentials
 			if user != nil {
-				currentUser = user                   // Save user struct
-				currentUsername = user.Username      // Save username
-				userConns.Store(user.Username, conn) // Store connection in global map
-				send("ACK|Login successful")         // Notify client
+				token, err := newSession(user.Username) // Session token used by RESUME after a drop
+				if err != nil {
+					send(errMsg(codeInternal, "Could not start a session, try again"))
+					continue
+				}
+				currentUser = user              // Save user struct
+				currentUsername = user.Username // Save username
+				// Store the connection in the global map; after a drop this also picks the match or draft back up
+				rejoin(user.Username, p, func(string) { send("ACK|Login successful|" + token) })
 			} else {
-				send("ERR|Invalid credentials") // Wrong username/password
+				send(errMsg(codeBadCredentials, "Invalid credentials")) // Wrong username/password
+			}
+		case "RESUME":
+			if len(parts) < 2 {
+				send(errMsg(codeBadRequest, "Usage: RESUME|token"))
+				continue
+			}
+			username := resumeSession(parts[1], p, requestID) // Rebind this connection and resend match state
+			if username == "" {
+				send(errMsg(codeBadSession, "Invalid or expired session"))
+				continue
+			}
+			currentUser = loadUser(username)
+			if currentUser == nil {
+				currentUser = &User{Username: username}
 			}
+			currentUsername = username
 		case "REGISTER":
 			if len(parts) < 3 {
-				send("ERR|Usage: REGISTER|username|password")
+				send(errMsg(codeBadRequest, "Usage: REGISTER|username|password"))
 				continue
 			}
-			if registerUser(parts[1], parts[2]) {
-				send("ACK|Registration successful")
+			if err := registerUser(parts[1], parts[2]); err != nil {
+				send(errorReply(fmt.Errorf("Register failed: %w", err)))
 			} else {
-				send("ERR|Username taken")
+				send("ACK|Registration successful")
 			}
 		case "CREATE_GAME":
 			if currentUser == nil {
-				send("ERR|Login first")
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			mode, draft, seed, bot, err := parseCreateGameArgs(strings.Split(line, "|")[1:])
+			if err != nil {
+				send(errMsg(codeBadRequest, err.Error()))
 				continue
 			}
-			mode := "SIMPLE" // Default mode
-			if len(parts) > 1 {
-				mode = strings.ToUpper(parts[1]) // Use provided mode if present
-			}
-			roomID := createGameRoom(currentUser.Username, mode) // Create new room
-			send("ACK|GAME_CREATED|" + roomID)                   // Notify client
-			// If ENHANCED mode, wait for guest and start game automatically
-			if mode == "ENHANCED" {
-				go func() {
-					for {
-						time.Sleep(200 * time.Millisecond)
-						roomsLock.Lock()
-						room, ok := gameRooms[roomID]
-						roomsLock.Unlock()
-						if ok && room.Guest != "" && room.Started {
-							startEnhancedGame(roomID)
-							for _, uname := range []string{room.Host, room.Guest} {
-								if v, ok := userConns.Load(uname); ok {
-									if conn, ok2 := v.(net.Conn); ok2 {
-										conn.Write([]byte("ACK|GAME_STARTED\n"))
-										stateMsg := getEnhancedGameState(uname)
-										conn.Write([]byte(stateMsg + "\n"))
-									}
-								}
-							}
-							break
-						}
-					}
-				}()
+			stopSpectating(currentUsername) // Playing replaces watching
+			dequeue(currentUsername)
+			roomID := createGameRoom(currentUser.Username, mode, seed, draft) // Create new room
+			send("ACK|GAME_CREATED|" + roomID)                                // Notify client
+			// A bot takes the guest slot right away; otherwise the match (or draft) starts on JOIN_GAME
+			if bot != "" {
+				name := botName(roomID, bot)
+				joinGameRoom(roomID, name)
+				if draft {
+					startDraft(roomID, bot) // the bot starts playing when the draft ends
+				} else {
+					beginMatch(roomID)
+					go runBot(roomID, name, bot, seed)
+				}
 			}
 			continue // Skip rest of loop
+		case "QUEUE":
+			if currentUser == nil {
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			mode := "SIMPLE"
+			if len(parts) > 1 && parts[1] != "" {
+				mode = strings.ToUpper(parts[1])
+			}
+			stopSpectating(currentUsername)
+			send(enqueue(currentUsername, mode)) // The matchmaker sends MATCH_FOUND and starts the match
+		case "CANCEL_QUEUE":
+			if currentUser == nil {
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			if dequeue(currentUsername) {
+				send("ACK|QUEUE_CANCELLED")
+			} else {
+				send(errMsg(codeNotQueued, "Not in queue"))
+			}
 		case "LIST_GAMES":
 			if currentUser == nil {
-				send("ERR|Login first")
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			// Open rooms as id:host, then running matches as id:host:guest:mode:spectators
+			rooms := []string{}
+			if list := listGameRooms(); list != "" {
+				rooms = append(rooms, list)
+			}
+			rooms = append(rooms, listLiveRooms()...)
+			send("GAMES|" + strings.Join(rooms, ","))
+		case "SPECTATE":
+			if currentUser == nil {
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			if len(parts) < 2 {
+				send(errMsg(codeBadRequest, "Usage: SPECTATE|room_id"))
+				continue
+			}
+			if _, _, inGame := findActiveGame(currentUsername); inGame {
+				send(errMsg(codeInGame, "Cannot spectate while playing"))
 				continue
 			}
-			list := listGameRooms() // Get available rooms
-			send("GAMES|" + list)
+			stopSpectating(currentUsername)
+			reply := startSpectating(parts[1], currentUsername)
+			send(reply)
+			if strings.HasPrefix(reply, "ACK|") {
+				sendSpectatorState(parts[1], currentUsername)
+			}
+		case "UNSPECTATE":
+			if !isSpectating(currentUsername) {
+				send(errMsg(codeNotSpectating, "Not spectating"))
+				continue
+			}
+			stopSpectating(currentUsername)
+			send("GAME_END|Stopped watching")
 		case "JOIN_GAME":
 			if currentUser == nil || len(parts) < 2 {
-				send("ERR|Usage: JOIN_GAME|room_id")
+				send(errMsg(codeBadRequest, "Usage: JOIN_GAME|room_id"))
 				continue
 			}
+			stopSpectating(currentUsername) // Playing replaces watching
+			dequeue(currentUsername)
 			ok := joinGameRoom(parts[1], currentUser.Username)
 			if ok {
-				room := gameRooms[parts[1]]
-				if room != nil && room.Host != "" && room.Guest != "" {
-					if room.Mode == "ENHANCED" {
-						startEnhancedGame(parts[1])
-						for _, uname := range []string{room.Host, room.Guest} {
-							if v, ok := userConns.Load(uname); ok {
-								if conn, ok2 := v.(net.Conn); ok2 {
-									conn.Write([]byte("ACK|GAME_STARTED\n"))
-									stateMsg := getEnhancedGameState(uname)
-									conn.Write([]byte(stateMsg + "\n"))
-								}
-							}
-						}
-					} else {
-						startGame(parts[1], room.Host, nil)
-						notifyGameStartedWithTurn(room.ID)
-					}
-				}
+				beginMatch(parts[1])
 				send("ACK|JOINED|" + parts[1])
 			} else {
-				send("ERR|Cannot join game")
+				send(errMsg(codeRoomUnavailable, "Cannot join game"))
 			}
 		case "START_GAME":
 			if currentUser == nil {
-				send("ERR|Login first")
+				send(errMsg(codeLoginRequired, "Login first"))
 				continue
 			}
 			if len(parts) < 2 {
-				send("ERR|Usage: START_GAME|room_id")
+				send(errMsg(codeBadRequest, "Usage: START_GAME|room_id"))
 				continue
 			}
 			ok := startGame(parts[1], currentUser.Username, conn)
 			if ok {
 				send("ACK|GAME_STARTED")
 			} else {
-				send("ERR|Cannot start game")
+				send(errMsg(codeRoomUnavailable, "Cannot start game"))
 			}
 		case "DEPLOY":
 			if currentUser == nil {
-				send("ERR|Login first")
+				send(errMsg(codeLoginRequired, "Login first"))
 				continue
 			}
 			if len(parts) < 3 {
-				send("ERR|Usage: DEPLOY|troop_name|target_tower")
+				send(errMsg(codeBadRequest, "Usage: DEPLOY|troop_name|target_tower"))
 				continue
 			}
 			// Check if player is in an enhanced game
@@ -317,7 +453,7 @@ func handleConnection(conn net.Conn) {
 			}
 		case "STATE":
 			if currentUser == nil {
-				send("ERR|Login first")
+				send(errMsg(codeLoginRequired, "Login first"))
 				continue
 			}
 			enhancedGamesLock.Lock()
@@ -332,37 +468,161 @@ func handleConnection(conn net.Conn) {
 			if inEnhancedGame {
 				send(getEnhancedGameState(currentUsername))
 			} else {
-				send(getGameState(currentUsername))
+				send(getGameState(currentUsername, p))
 			}
 		case "EXIT_GAME":
 			if currentUser == nil {
-				send("ERR|Login first")
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			if isSpectating(currentUsername) {
+				// Leaving as a spectator never affects the match
+				stopSpectating(currentUsername)
+				send("GAME_END|Stopped watching")
+				continue
+			}
+			if cancelDraft(currentUsername, "left") {
+				send("GAME_END|You left the draft")
 				continue
 			}
 			handlePlayerExit(currentUser.Username)
 			send("GAME_END|You have exited the game")
+		case "LIST_REPLAYS":
+			send(listReplays())
+		case "GET_REPLAY":
+			if len(parts) < 2 {
+				send(errMsg(codeBadRequest, "Usage: GET_REPLAY|replay_id"))
+				continue
+			}
+			send(getReplay(parts[1]))
+		case "UPGRADE":
+			if currentUser == nil {
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			if len(parts) < 2 {
+				send(errMsg(codeBadRequest, "Usage: UPGRADE|name|GOLD or EXP"))
+				continue
+			}
+			currency := ""
+			if len(parts) > 2 {
+				currency = parts[2]
+			}
+			send(handleUpgrade(currentUsername, parts[1], currency))
+		case "PROFILE":
+			if currentUser == nil {
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			send(handleProfile(currentUsername))
+		case "RELOAD_SPECS":
+			if currentUser == nil {
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			send(handleReloadSpecs(currentUsername))
+		case "SET_DECK":
+			if currentUser == nil {
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			if len(parts) < 2 {
+				send(errMsg(codeBadRequest, "Usage: SET_DECK|name|card1,card2,... (no cards selects a saved deck)"))
+				continue
+			}
+			cards := ""
+			if len(parts) > 2 {
+				cards = parts[2]
+			}
+			send(handleSetDeck(currentUsername, parts[1], cards))
+		case "LIST_DECKS":
+			if currentUser == nil {
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			send(handleListDecks(currentUsername))
+		case "PICK", "BAN":
+			if currentUser == nil {
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			if len(parts) < 2 {
+				send(errMsg(codeBadRequest, "Usage: "+cmd+"|troop_name"))
+				continue
+			}
+			send(handleDraft(currentUsername, cmd, parts[1]))
+		case "CAST":
+			if currentUser == nil {
+				send(errMsg(codeLoginRequired, "Login first"))
+				continue
+			}
+			if len(parts) < 2 {
+				send(errMsg(codeBadRequest, "Usage: CAST|spell_name|target_tower"))
+				continue
+			}
+			target := ""
+			if len(parts) > 2 {
+				target = parts[2]
+			}
+			send(handleEnhancedCast(currentUsername, parts[1], target))
 		case "BUY":
 			if currentUser == nil {
-				send("ERR|Login first")
+				send(errMsg(codeLoginRequired, "Login first"))
 				continue
 			}
 			if len(parts) < 2 {
-				send("ERR|Usage: BUY|troop_name")
+				send(errMsg(codeBadRequest, "Usage: BUY|troop_name"))
 				continue
 			}
 			response := handleEnhancedBuy(currentUsername, parts[1])
 			send(response)
 		default:
-			send("ERR|Unknown command")
+			send(errMsg(codeUnknownCommand, "Unknown command"))
 		}
 	}
 	if currentUsername != "" {
-		userConns.Delete(currentUsername) // Remove user from active connections on disconnect
+		stopSpectating(currentUsername)
+		dequeue(currentUsername)
+		handleDisconnect(currentUsername, p) // Remove connection; hold any running match for a reconnect
 	}
 }
 
 // Global map for user connections
-var userConns sync.Map // username -> net.Conn
+var userConns sync.Map // username -> *peer
+
+// roomSnapshot returns a copy of a room taken under roomsLock, so a match can be set up
+// from it while other goroutines join and leave rooms
+func roomSnapshot(roomID string) (GameRoom, bool) {
+	roomsLock.Lock()
+	defer roomsLock.Unlock()
+	room, ok := gameRooms[roomID]
+	if !ok {
+		return GameRoom{}, false
+	}
+	return *room, true
+}
+
+// beginMatch starts the match of a full room and sends GAME_STARTED and the first state to both players
+func beginMatch(roomID string) {
+	room, ok := roomSnapshot(roomID)
+	if !ok || room.Host == "" || room.Guest == "" {
+		return
+	}
+	if room.Draft && room.Picks == nil {
+		startDraft(roomID, "") // the draft calls back here once the picks are in
+		return
+	}
+	if room.Mode == "ENHANCED" {
+		startEnhancedGame(roomID)
+		for _, uname := range []string{room.Host, room.Guest} {
+			sendToUser(uname, "ACK|GAME_STARTED")
+			sendToUser(uname, getEnhancedGameState(uname))
+		}
+	} else {
+		startGame(roomID, room.Host, nil)
+		notifyGameStartedWithTurn(roomID)
+	}
+}
 
 func notifyGameStartedWithTurn(roomID string) {
 	gamesLock.Lock()
@@ -372,84 +632,130 @@ func notifyGameStartedWithTurn(roomID string) {
 		return
 	}
 	for uname := range game.Players {
-		if v, ok := userConns.Load(uname); ok {
-			if conn, ok2 := v.(net.Conn); ok2 {
-				// Gửi thông báo game đã bắt đầu
-				conn.Write([]byte("ACK|GAME_STARTED\n"))
+		if p, ok := loadPeer(uname); ok {
+			// Gửi thông báo game đã bắt đầu
+			p.Send("ACK|GAME_STARTED")
 
-				// Thêm delay nhỏ để đảm bảo các thông báo không đến quá gần nhau
-				time.Sleep(100 * time.Millisecond)
+			// Thêm delay nhỏ để đảm bảo các thông báo không đến quá gần nhau
+			time.Sleep(100 * time.Millisecond)
 
-				// Gửi trạng thái game ban đầu
-				stateMsg := "STATE|" + formatGameState(game, uname) + "\n"
-				conn.Write([]byte(stateMsg))
+			// Gửi trạng thái game ban đầu
+			p.Send(simpleStateLine(game, uname, p))
 
-				// Thêm delay nhỏ để đảm bảo các thông báo không đến quá gần nhau
-				time.Sleep(100 * time.Millisecond)
+			// Thêm delay nhỏ để đảm bảo các thông báo không đến quá gần nhau
+			time.Sleep(100 * time.Millisecond)
 
-				// Gửi thông báo lượt chơi
-				if uname == game.TurnUser {
-					conn.Write([]byte("TURN|Your turn!\n"))
-				} else {
-					conn.Write([]byte("TURN|Wait for your turn...\n"))
-				}
+			// Gửi thông báo lượt chơi
+			if uname == game.TurnUser {
+				p.Send("TURN|Your turn!")
+			} else {
+				p.Send("TURN|Wait for your turn...")
 			}
 		}
 	}
 }
 
 func authenticate(username, password string) *User {
-	usersLock.Lock()
-	defer usersLock.Unlock()
-	data, err := ioutil.ReadFile(usersFile)
-	if err != nil {
-		return nil
-	}
-	var users UsersData
-	if err := json.Unmarshal(data, &users); err != nil {
+	u, ok := userStore.Get(username)
+	if !ok || !verifyPassword(u.Password, password) {
 		return nil
 	}
-	for _, u := range users.Users {
-		if u.Username == username && u.Password == password {
-			return &u
+	// Migrate legacy plaintext passwords to a salted hash on successful login
+	if !isHashedPassword(u.Password) {
+		if hashed, err := hashPassword(password); err == nil {
+			u.Password = hashed
+			err := userStore.Modify(username, func(stored *User) error {
+				stored.Password = hashed
+				return nil
+			})
+			if err != nil {
+				fmt.Println("Error migrating password for", username+":", err)
+			}
 		}
 	}
-	return nil
+	return &u
 }
 
-func registerUser(username, password string) bool {
-	usersLock.Lock()
-	defer usersLock.Unlock()
-	data, err := ioutil.ReadFile(usersFile)
+// loadUser returns the stored user with the given name, or nil
+func loadUser(username string) *User {
+	u, ok := userStore.Get(username)
+	if !ok {
+		return nil
+	}
+	return &u
+}
+
+// registerUser creates a new user with a hashed password
+// Returns an error if the password is too weak or the username is taken
+func registerUser(username, password string) error {
+	if err := config.Password.Check(password); err != nil {
+		return &codedError{codeWeakPassword, err.Error()}
+	}
+	if isBot(username) {
+		return &codedError{codeReservedName, fmt.Sprintf("usernames starting with %q are reserved", botPrefix)}
+	}
+	if _, ok := userStore.Get(username); ok {
+		return ErrUserExists
+	}
+	hashed, err := hashPassword(password)
 	if err != nil {
-		return false
+		return &codedError{codeInternal, "cannot hash password"}
 	}
-	var users UsersData
-	if err := json.Unmarshal(data, &users); err != nil {
-		return false
+	return userStore.Create(User{Username: username, Password: hashed, EXP: 0, Level: 1})
+}
+
+// parseCreateGameArgs parses the arguments of CREATE_GAME|mode|seed or CREATE_GAME|mode|BOT|difficulty|seed
+// All are optional: mode defaults to SIMPLE, a missing seed is drawn from the clock and
+// BOT without a difficulty plays at medium. The returned difficulty is "" for a room that waits for a player.
+func parseCreateGameArgs(args []string) (string, bool, int64, engine.Difficulty, error) {
+	const usage = "Usage: CREATE_GAME|mode|DRAFT|BOT|easy/medium/hard|seed (DRAFT, BOT and seed are optional)"
+	mode := "SIMPLE" // Default mode
+	if len(args) > 0 && args[0] != "" {
+		mode = strings.ToUpper(args[0]) // Use provided mode if present
+	}
+	seed := time.Now().UnixNano()
+	var bot engine.Difficulty
+	rest := []string{}
+	if len(args) > 1 {
+		rest = args[1:]
+	}
+	draft := false
+	if len(rest) > 0 && strings.ToUpper(rest[0]) == "DRAFT" {
+		draft = true
+		rest = rest[1:]
+	}
+	if len(rest) > 0 && strings.ToUpper(rest[0]) == "BOT" {
+		bot = engine.Medium
+		rest = rest[1:]
+		if len(rest) > 0 {
+			if d, ok := engine.ParseDifficulty(rest[0]); ok {
+				bot = d
+				rest = rest[1:]
+			}
+		}
 	}
-	for _, u := range users.Users {
-		if u.Username == username {
-			return false
+	if len(rest) > 0 && rest[0] != "" {
+		v, err := strconv.ParseInt(rest[0], 10, 64)
+		if err != nil || len(rest) > 1 {
+			return "", false, 0, "", fmt.Errorf(usage)
 		}
+		seed = v // Explicit seed for tournaments and bug reproduction
 	}
-	newUser := User{Username: username, Password: password, EXP: 0, Level: 1}
-	users.Users = append(users.Users, newUser)
-	out, _ := json.MarshalIndent(users, "", "  ")
-	_ = ioutil.WriteFile(usersFile, out, 0644)
-	return true
+	return mode, draft, seed, bot, nil
 }
 
-// createGameRoom creates a new game room with the given host and mode (SIMPLE or ENHANCED)
+// createGameRoom creates a new game room with the given host, mode (SIMPLE or ENHANCED) and match seed
+// draft: the players draft their troops before the match
 // Returns the room ID string
-func createGameRoom(host, mode string) string {
-	roomsLock.Lock()                              // Lock the rooms map for thread safety
-	defer roomsLock.Unlock()                      // Ensure unlock after function
-	id := fmt.Sprintf("room%d", len(gameRooms)+1) // Generate a unique room ID
+func createGameRoom(host, mode string, seed int64, draft bool) string {
+	roomsLock.Lock()         // Lock the rooms map for thread safety
+	defer roomsLock.Unlock() // Ensure unlock after function
+	lastRoomID++
+	id := fmt.Sprintf("room%d", lastRoomID) // Generate a unique room ID
 	if mode == "ENHANCED" {
-		gameRooms[id] = &GameRoom{ID: id, Host: host, Started: false, Mode: "ENHANCED"} // Create enhanced room
+		gameRooms[id] = &GameRoom{ID: id, Host: host, Started: false, Mode: "ENHANCED", Seed: seed, Draft: draft} // Create enhanced room
 	} else {
-		gameRooms[id] = &GameRoom{ID: id, Host: host, Started: false, Mode: "SIMPLE"} // Create simple room
+		gameRooms[id] = &GameRoom{ID: id, Host: host, Started: false, Mode: "SIMPLE", Seed: seed, Draft: draft} // Create simple room
 	}
 	return id // Return the new room ID
 }
@@ -483,9 +789,7 @@ func joinGameRoom(id, guest string) bool {
 
 // Game logic functions
 func startGame(roomID, username string, conn net.Conn) bool {
-	roomsLock.Lock()
-	room, ok := gameRooms[roomID]
-	roomsLock.Unlock()
+	room, ok := roomSnapshot(roomID)
 	if !ok || !room.Started {
 		return false
 	}
@@ -496,106 +800,60 @@ func startGame(roomID, username string, conn net.Conn) bool {
 	if room.Host == "" || room.Guest == "" {
 		return false
 	}
+	// Held until the game is stored: the matchmaker and bots start games from their own goroutines
+	gamesLock.Lock()
+	defer gamesLock.Unlock()
 	if _, exists := games[roomID]; exists {
 		// If game already exists, do not re-initialize
 		return false
 	}
 	// Initialize game state
-	players := map[string]*PlayerState{}
-	// Build a map of available troop specs by name
-	troopSpecMap := map[string]TroopSpec{}
-	for _, t := range troopSpecs {
-		troopSpecMap[t.Name] = t
-	}
-	// Get all available troop names
-	availableTroopNames := make([]string, 0, len(troopSpecMap))
-	for name := range troopSpecMap {
-		availableTroopNames = append(availableTroopNames, name)
-	}
-	rand.Seed(time.Now().UnixNano()) // Seed random for troop selection
+	match := engine.NewMatch(engine.ModeSimple, config.rules(engine.ModeSimple), room.Seed)
+	rng := match.Rand()     // All dealing comes from the match seed
+	specs := currentSpecs() // The match keeps these specs even if the file is reloaded
 	for _, uname := range []string{room.Host, room.Guest} {
-		// Randomly select 3 unique troops for each player
-		troopNames := make([]string, len(availableTroopNames))
-		copy(troopNames, availableTroopNames)
-		rand.Shuffle(len(troopNames), func(i, j int) { troopNames[i], troopNames[j] = troopNames[j], troopNames[i] })
-		selected := troopNames[:3]
+		// Randomly select 3 unique troops from the player's deck (or take their picks), in deck order so a seed always deals the same hands
+		hand, _ := startingCards(&room, uname, specs, rng)
 		troops := []*Troop{}
-		for _, tn := range selected {
-			spec := troopSpecMap[tn]
+		for _, spec := range hand {
 			troops = append(troops, &Troop{
-				Name:  spec.Name,
-				HP:    spec.HP,
-				ATK:   spec.ATK,
-				DEF:   spec.DEF,
-				Owner: uname,
+				Name:    spec.Name,
+				HP:      spec.HP,
+				ATK:     spec.ATK,
+				DEF:     spec.DEF,
+				Owner:   uname,
+				Ability: spec.Ability,
 			})
 		}
-		// Assign towers from towerSpecs
+		// Assign towers from the tower specs
 		towers := map[string]*Tower{}
-		for _, ts := range towerSpecs {
+		for _, ts := range specs.Towers {
 			towers[ts.Name] = &Tower{
 				Name: ts.Name,
+				Role: ts.Role,
 				HP:   ts.HP,
 				ATK:  ts.ATK,
 				DEF:  ts.DEF,
 			}
 		}
-		players[uname] = &PlayerState{
+		match.AddPlayer(&PlayerState{
 			Username: uname,
 			Towers:   towers,
 			Troops:   troops,
-			Turn:     false,
-		}
+		})
 	}
 	// Randomly pick who starts
-	turnIdx := rand.Intn(2)
 	turnUser := room.Host
-	if turnIdx == 1 {
+	if rng.Intn(2) == 1 {
 		turnUser = room.Guest
 	}
-	players[turnUser].Turn = true // Set turn for starting player
-	games[roomID] = &GameState{
-		RoomID:         roomID,
-		Players:        players,
-		TurnUser:       turnUser,
-		Winner:         "",
-		Over:           false,
-		AttackPatterns: make(map[string]string), // initialize attack pattern tracking
-	}
+	match.SetTurn(turnUser)
+	game := &GameState{RoomID: roomID, Match: match, SpecVersion: specs.Version, Specs: specs}
+	game.Replay = newReplayRecorder(roomID, match, game)
+	games[roomID] = game
 	return true
 }
 
-// countAliveTroops returns the number of alive troops (HP > 0) for a player
-func countAliveTroops(ps *PlayerState) int {
-	c := 0
-	for _, tr := range ps.Troops {
-		if tr.HP > 0 {
-			c++
-		}
-	}
-	return c
-}
-
-// countAliveTowers returns the number of alive towers (HP > 0)
-func countAliveTowers(towers map[string]*Tower) int {
-	cnt := 0
-	for _, tw := range towers {
-		if tw.HP > 0 {
-			cnt++
-		}
-	}
-	return cnt
-}
-
-// sumTowerHP returns the total HP of all towers
-func sumTowerHP(towers map[string]*Tower) int {
-	total := 0
-	for _, tw := range towers {
-		total += tw.HP
-	}
-	return total
-}
-
 // handleDeploy processes a deploy command from a player in simple mode
 // username: the player making the move
 // troopName: the troop to deploy
@@ -612,185 +870,194 @@ func handleDeploy(username, troopName, towerName string) string {
 		}
 	}
 	if game == nil || game.Over {
-		return "ERR|No active game" // No game found or already over
-	}
-	if game.TurnUser != username {
-		return "ERR|Not your turn" // Not this player's turn
-	}
-	player := game.Players[username]
-	var troop *Troop
-	for _, t := range player.Troops {
-		// Special case for Queen who can be used even with HP=0
-		if t.Name == troopName && (t.HP > 0 || t.Name == "Queen") {
-			troop = t
-			break
-		}
-	}
-	if troop == nil {
-		return "ERR|Invalid or dead troop" // Troop not found or dead
+		return errMsg(engine.CodeNotInGame, "No active game") // No game found or already over
 	}
-	// Find target tower
-	var enemyName string
-	for uname := range game.Players {
-		if uname != username {
-			enemyName = uname
-			break
+	events, err := game.Apply(engine.Deploy{Player: username, Troop: troopName, Tower: towerName})
+	if err != nil {
+		return errorReply(err)
+	}
+	game.Replay.record(strings.Join([]string{"DEPLOY", username, troopName, towerName}, "|"), events, game)
+	enemyName := game.Opponent(username)
+	sendState := func() {
+		sendSimpleState(username, game)
+		sendSimpleState(enemyName, game)
+		for _, uname := range spectatorsOf(game.RoomID) {
+			sendSimpleState(uname, game)
 		}
 	}
-	enemy := game.Players[enemyName]
-
-	// Check tower attack restrictions
-	if towerName == "King" {
-		// Must destroy at least one guard tower before attacking King
-		if enemy.Towers["Guard1"].HP > 0 && enemy.Towers["Guard2"].HP > 0 {
-			return "ERR|Must destroy either Guard1 or Guard2 tower before attacking King"
-		}
-	} else if towerName == "Guard1" || towerName == "Guard2" {
-		// Check if this is the first guard tower attack by this player
-		firstGuardTower, hasPattern := game.AttackPatterns[username]
-		if !hasPattern {
-			// First time attacking a guard tower - record the choice
-			game.AttackPatterns[username] = towerName
-		} else if firstGuardTower != towerName {
-			// Player is trying to attack the other guard tower
-			if enemy.Towers[firstGuardTower].HP > 0 {
-				return fmt.Sprintf("ERR|You must destroy %s Tower first before attacking %s Tower", firstGuardTower, towerName)
+	for _, ev := range events {
+		switch ev.Kind {
+		case engine.EventAttack:
+			// 1. First send attack result, then updated state with a small delay to both players
+			attackResult := fmt.Sprintf("ATTACK_RESULT|%s|%s|%d|%d", ev.Troop, ev.Tower, ev.Damage, ev.TowerHP)
+			sendToUser(username, attackResult)
+			sendToUser(enemyName, attackResult)
+			sendToSpectators(game.RoomID, attackResult)
+			time.Sleep(200 * time.Millisecond)
+			sendState()
+		case engine.EventAbility:
+			// 2. Troop abilities (heal, splash, poison, ...), followed by the updated state
+			abilityMsg := abilityMessage(ev)
+			sendToUser(username, abilityMsg)
+			sendToUser(enemyName, abilityMsg)
+			sendToSpectators(game.RoomID, abilityMsg)
+			time.Sleep(200 * time.Millisecond)
+			sendState()
+		case engine.EventGameOver:
+			game.Replay.finish(ev)
+			ratings := updateRatings(game.Match, ev)
+			recordHistory(game.Match, ev, game.Replay.ID())
+			awardCard(game.Match, ev, game.Specs)
+			for uname := range game.Players {
+				sendToUser(uname, gameEndMessage(ev, uname)+ratings[uname])
+			}
+			sendToSpectators(game.RoomID, spectatorGameEnd(ev))
+			// Finished games are removed so the players can start new ones
+			delete(games, game.RoomID)
+			roomsLock.Lock()
+			delete(gameRooms, game.RoomID)
+			roomsLock.Unlock()
+		case engine.EventTurn:
+			// 3. Finally, send turn notifications with a longer delay
+			time.Sleep(300 * time.Millisecond)
+			for playerName := range game.Players {
+				if playerName == game.TurnUser {
+					sendToUser(playerName, "TURN|Your turn!")
+				} else {
+					sendToUser(playerName, "TURN|Wait for your turn...")
+				}
+			}
+			sendToSpectators(game.RoomID, "TURN|"+game.TurnUser+"'s turn")
+			// The match stays open while the next player is away; they resume into their turn
+			if isDisconnected(game.TurnUser) {
+				sendToUser(username, fmt.Sprintf("WAITING|%s is disconnected, waiting up to %ds for a reconnect", game.TurnUser, int(config.ReconnectGrace.Seconds())))
 			}
 		}
 	}
-	tower, ok := enemy.Towers[towerName]
-	if !ok || tower.HP <= 0 {
-		return "ERR|Invalid or destroyed tower" // Tower not found or already destroyed
-	}
+	return "ACK|Deploy successful"
+}
 
-	// Simple attack logic - troop attacks tower
-	damage := troop.ATK - tower.DEF
-	if damage < 0 {
-		damage = 0
+// abilityMessage returns the ABILITY line for an ability event:
+// ABILITY|player|troop|kind|target player|tower|amount|value|duration[|DESTROYED]
+// value is the tower's HP afterwards, or the target's mana after a mana drain
+func abilityMessage(ev engine.Event) string {
+	value := ev.TowerHP
+	if ev.Ability == engine.AbilityManaDrain {
+		value = ev.Mana
 	}
-	tower.HP -= damage
-	if tower.HP < 0 {
-		tower.HP = 0
+	msg := fmt.Sprintf("ABILITY|%s|%s|%s|%s|%s|%d|%d|%d", ev.Player, ev.Troop, ev.Ability, ev.Target, ev.Tower, ev.Amount, value, ev.Duration)
+	if ev.Destroyed {
+		msg += "|DESTROYED"
 	}
+	return msg
+}
 
-	// Check if all troops are dead for either player
-	if countAliveTroops(player) == 0 || countAliveTroops(enemy) == 0 {
-		// Count alive towers for both players
-		aliveP := countAliveTowers(player.Towers)
-		aliveE := countAliveTowers(enemy.Towers)
-		if aliveP != aliveE {
-			// Whoever has more towers alive wins
-			var winner, loser string
-			if aliveP > aliveE {
-				winner = username
-				loser = enemyName
-			} else {
-				winner = enemyName
-				loser = username
-			}
-			game.Over = true
-			game.Winner = winner
-			sendToUser(winner, fmt.Sprintf("GAME_END|You win! You have more towers alive (%d vs %d).", aliveP, aliveE))
-			sendToUser(loser, fmt.Sprintf("GAME_END|You lose! Fewer towers alive (%d vs %d).", aliveE, aliveP))
-		} else {
-			// If tower count is equal, compare total HP
-			hpP := sumTowerHP(player.Towers)
-			hpE := sumTowerHP(enemy.Towers)
-			switch {
-			case hpP > hpE:
-				game.Over = true
-				game.Winner = username
-				sendToUser(username, "GAME_END|You win! Equal tower count but higher total HP.")
-				sendToUser(enemyName, "GAME_END|You lose! Equal tower count but lower total HP.")
-			case hpE > hpP:
-				game.Over = true
-				game.Winner = enemyName
-				sendToUser(enemyName, "GAME_END|You win! Equal tower count but higher total HP.")
-				sendToUser(username, "GAME_END|You lose! Equal tower count but lower total HP.")
-			default:
-				game.Over = true
-				sendToUser(username, "GAME_END|Draw! Equal tower count and equal total HP.")
-				sendToUser(enemyName, "GAME_END|Draw! Equal tower count and equal total HP.")
-			}
+// enhancedEventMessage returns the line announcing an ENHANCED event, or "" for the
+// events announced some other way, such as GAME_OVER. Field events are sent as:
+// UNIT_DEPLOYED|player|troop|unit|lane|pos|tower (lane and pos in the arena, tower otherwise)
+// UNIT_HIT|player|troop|unit|target player|foe troop|foe unit|damage|foe HP[|KILLED]
+// TOWER_SHOT|player|tower|target player|foe troop|foe unit|damage|foe HP|CRIT:bool[|KILLED]
+func enhancedEventMessage(ev engine.Event) string {
+	var msg string
+	switch ev.Kind {
+	case engine.EventAttack:
+		msg = fmt.Sprintf("ATTACK_RESULT|%s|%s|%d|%d|TOWER_HIT:%d|CRIT:%v|TROOP_HP:%d", ev.Troop, ev.Tower, ev.Damage, ev.TowerHP, ev.CounterDamage, ev.Crit, ev.TroopHP)
+		if ev.Destroyed {
+			msg += "|DESTROYED"
 		}
-		return "STATE|" + formatGameState(game, username)
-	}
+	case engine.EventAbility:
+		msg = abilityMessage(ev)
+	case engine.EventDeployed:
+		msg = fmt.Sprintf("UNIT_DEPLOYED|%s|%s|%d|%s|%d|%s", ev.Player, ev.Troop, ev.Unit, ev.Lane, ev.Pos, ev.Tower)
+	case engine.EventClash:
+		msg = fmt.Sprintf("UNIT_HIT|%s|%s|%d|%s|%s|%d|%d|%d", ev.Player, ev.Troop, ev.Unit, ev.Target, ev.Foe, ev.FoeUnit, ev.Damage, ev.FoeHP)
+	case engine.EventShot:
+		msg = fmt.Sprintf("TOWER_SHOT|%s|%s|%s|%s|%d|%d|%d|CRIT:%v", ev.Player, ev.Tower, ev.Target, ev.Foe, ev.FoeUnit, ev.Damage, ev.FoeHP, ev.Crit)
+	case engine.EventPhase:
+		msg = fmt.Sprintf("PHASE|%s|%d", ev.Phase, int(phaseLength(ev.Phase).Seconds()))
+	}
+	if ev.Killed {
+		msg += "|KILLED"
+	}
+	return msg
+}
 
-	// Tower counter-attack logic - tower attacks troop
-	counterDamage := tower.ATK - troop.DEF
-	if counterDamage < 0 {
-		counterDamage = 0
-	}
-	troop.HP -= counterDamage
-	if troop.HP <= 0 {
-		troop.HP = 0 // Mark troop as dead/used
+// phaseLength returns how long a period of an ENHANCED match lasts
+func phaseLength(phase string) time.Duration {
+	switch phase {
+	case engine.PhaseOvertime:
+		return config.Overtime.Duration
+	case engine.PhaseSuddenDeath:
+		return config.SuddenDeath.Duration
 	}
+	return config.MatchLength.Duration
+}
 
-	// Check for win by King destroyed
-	if enemy.Towers["King"].HP <= 0 {
-		game.Over = true
-		game.Winner = username
-		sendToUser(username, "GAME_END|You win! King destroyed.")
-		sendToUser(enemyName, "GAME_END|You lose! King destroyed.")
-		return "STATE|" + formatGameState(game, username)
-	}
-	// Switch turn
-	game.TurnUser = enemyName
-	for uname, p := range game.Players {
-		if uname == game.TurnUser {
-			p.Turn = true
-		} else {
-			p.Turn = false
+// broadcastEnhancedEvents sends the line of each event to the players and spectators and
+// ends the game on GAME_OVER. Returns true if the game ended.
+// Caller holds enhancedGamesLock
+func broadcastEnhancedEvents(gs *EnhancedGameState, events []engine.Event) bool {
+	for _, ev := range events {
+		if ev.Kind == engine.EventGameOver {
+			endEnhancedGame(gs, ev)
+			return true
 		}
-	}
-	// 1. First send attack result
-	attackResult := fmt.Sprintf("ATTACK_RESULT|%s|%s|%d|%d", troopName, towerName, damage, tower.HP)
-	sendToUser(username, attackResult)
-	sendToUser(enemyName, attackResult)
-	// 2. Then send updated state with a small delay to both players
-	time.Sleep(200 * time.Millisecond)
-	stateMsg := "STATE|" + formatGameState(game, username)
-	sendToUser(username, stateMsg)
-	sendToUser(enemyName, "STATE|"+formatGameState(game, enemyName))
-
-	// 3. Check if the deployed troop is a Queen, and if so, activate healing ability
-	if troop.Name == "Queen" {
-		// Find tower with lowest HP to heal
-		minHP := 999999
-		var healTower *Tower
-		for _, t := range player.Towers {
-			if t.HP > 0 && t.HP < minHP {
-				minHP = t.HP
-				healTower = t
+		if msg := enhancedEventMessage(ev); msg != "" {
+			for uname := range gs.Players {
+				sendToUser(uname, msg)
 			}
-		}
-		// Apply healing effect if found a valid tower to heal
-		if healTower != nil {
-			healAmount := 300 // Heal by 300 HP
-			healTower.HP += healAmount
-			// Notify players about the healing
-			healMsg := fmt.Sprintf("QUEEN_HEAL|%s|%s|%d|%d", username, healTower.Name, healAmount, healTower.HP)
-			sendToUser(username, healMsg)
-			sendToUser(enemyName, healMsg)
+			sendToSpectators(gs.RoomID, msg)
 		}
 	}
-	// 2. Then send updated state with a small delay to both players
-	time.Sleep(200 * time.Millisecond)
-	stateMsg = "STATE|" + formatGameState(game, username)
-	sendToUser(username, stateMsg)
-	sendToUser(enemyName, "STATE|"+formatGameState(game, enemyName))
+	return false
+}
 
-	// 4. Finally, send turn notifications with a longer delay
-	time.Sleep(300 * time.Millisecond)
-	// Send appropriate turn message to each player
-	for playerName := range game.Players {
-		if playerName == game.TurnUser {
-			sendToUser(playerName, "TURN|Your turn!")
-		} else {
-			sendToUser(playerName, "TURN|Wait for your turn...")
-		}
+// gameEndMessage returns the GAME_END line for username given the engine's game over event
+// Returns "" for a player who forfeited (they already left)
+// The match seed is appended so the result can be reproduced
+func gameEndMessage(ev engine.Event, username string) string {
+	msg := gameEndText(ev, username)
+	if msg == "" {
+		return ""
 	}
-	return "ACK|Deploy successful"
+	return fmt.Sprintf("%s|SEED:%d", msg, ev.Seed)
+}
+
+// gameEndText returns the human-readable GAME_END line for username, or ""
+func gameEndText(ev engine.Event, username string) string {
+	won := ev.Winner == username
+	switch {
+	case ev.Reason == engine.ReasonForfeit:
+		if won {
+			return "GAME_END|Your opponent has left the game"
+		}
+		return ""
+	case ev.Reason == engine.ReasonKingDestroyed && won:
+		return "GAME_END|You win! King destroyed."
+	case ev.Reason == engine.ReasonKingDestroyed:
+		return "GAME_END|You lose! King destroyed."
+	case ev.Reason == engine.ReasonMoreTowers && ev.Winner == engine.Draw:
+		return "GAME_END|Draw! Equal tower count."
+	case ev.Reason == engine.ReasonMoreTowers && won:
+		return fmt.Sprintf("GAME_END|You win! You have more towers alive (%d vs %d).", ev.Scores[0], ev.Scores[1])
+	case ev.Reason == engine.ReasonMoreTowers:
+		return fmt.Sprintf("GAME_END|You lose! Fewer towers alive (%d vs %d).", ev.Scores[1], ev.Scores[0])
+	case ev.Reason == engine.ReasonSuddenDeath && won:
+		return "GAME_END|You win! Your opponent lost the first tower in sudden death."
+	case ev.Reason == engine.ReasonSuddenDeath:
+		return "GAME_END|You lose! You lost the first tower in sudden death."
+	case ev.Reason == engine.ReasonLowestTower && ev.Winner == engine.Draw:
+		return fmt.Sprintf("GAME_END|Draw! Time up: equal weakest towers (%d%%).", ev.Scores[0])
+	case ev.Reason == engine.ReasonLowestTower && won:
+		return fmt.Sprintf("GAME_END|You win! Your weakest tower has more HP left (%d%% vs %d%%).", ev.Scores[0], ev.Scores[1])
+	case ev.Reason == engine.ReasonLowestTower:
+		return fmt.Sprintf("GAME_END|You lose! Your weakest tower has less HP left (%d%% vs %d%%).", ev.Scores[1], ev.Scores[0])
+	case ev.Winner == engine.Draw:
+		return "GAME_END|Draw! Equal tower count and equal total HP."
+	case won:
+		return "GAME_END|You win! Equal tower count but higher total HP."
+	}
+	return "GAME_END|You lose! Equal tower count but lower total HP."
 }
 
 // Enhanced BUY: mua troop tốn mana, thêm vào danh sách troops đã mua
@@ -805,59 +1072,130 @@ func handleEnhancedBuy(username, troopName string) string {
 		}
 	}
 	if game == nil {
-		return "ERR|Not in enhanced game"
+		return errMsg(engine.CodeNotInGame, "Not in enhanced game")
 	}
 	ps := game.Players[username]
-	// Tìm troop spec
-	var tspec TroopSpec
-	found := false
-	for _, t := range troopSpecs {
-		if t.Name == troopName {
-			tspec = t
-			found = true
+	// Tìm troop spec trong bộ specs của trận
+	tspec, found := game.Specs.Troop(troopName)
+	if !found {
+		return errMsg(engine.CodeInvalidTroop, "No such troop")
+	}
+	if !contains(ps.Deck, tspec.Name) {
+		return errMsg(codeNotInDeck, troopName+" is not in your deck")
+	}
+	// Stat scaling by this troop's own upgrade level
+	mult := levelMultiplier(unitLevel(ps.Progress.TroopLv, tspec.Name))
+	events, err := game.Apply(engine.Buy{
+		Player: username,
+		Cost:   tspec.MANA,
+		Troop: Troop{
+			Name:     tspec.Name,
+			HP:       int(float64(tspec.HP) * mult),
+			ATK:      int(float64(tspec.ATK) * mult),
+			DEF:      int(float64(tspec.DEF) * mult),
+			HitSpeed: tspec.HitSpeed,
+			Targets:  tspec.Targets,
+			Ability:  tspec.Ability,
+		},
+	})
+	if err != nil {
+		return errorReply(err)
+	}
+	game.Replay.record("BUY|"+username+"|"+troopName, events, game)
+	return "ACK|Buy successful"
+}
+
+// handleEnhancedCast casts a spell for mana; the spell's effects and the new STATE are sent to
+// both players and the spectators
+func handleEnhancedCast(username, spellName, targetTower string) string {
+	enhancedGamesLock.Lock()
+	defer enhancedGamesLock.Unlock()
+	var game *EnhancedGameState
+	for _, g := range enhancedGames {
+		if g.Players[username] != nil {
+			game = g
 			break
 		}
 	}
+	if game == nil {
+		return errMsg(engine.CodeNotInGame, "Not in enhanced game")
+	}
+	spec, found := game.Specs.Spell(spellName)
 	if !found {
-		return "ERR|No such troop"
-	}
-	if ps.Mana < tspec.MANA {
-		return "ERR|Not enough mana"
-	}
-	ps.Mana -= tspec.MANA
-	// Stat scaling by user level
-	mult := 1.0 + 0.1*float64(ps.Level-1)
-	ps.Troops = append(ps.Troops, &Troop{
-		Name:  tspec.Name,
-		HP:    int(float64(tspec.HP) * mult),
-		ATK:   int(float64(tspec.ATK) * mult),
-		DEF:   int(float64(tspec.DEF) * mult),
-		Owner: username,
+		return errMsg(engine.CodeInvalidSpell, "No such spell")
+	}
+	if !contains(game.Players[username].Deck, spec.Name) {
+		return errMsg(codeNotInDeck, spellName+" is not in your deck")
+	}
+	events, err := game.Apply(engine.Cast{
+		Player: username,
+		Spell:  engine.Spell{Name: spec.Name, Cost: spec.MANA, Cooldown: spec.Cooldown, Effect: *spec.Effect},
+		Tower:  targetTower,
 	})
-	return "ACK|Buy successful"
+	if err != nil {
+		return errorReply(err)
+	}
+	game.Replay.record(strings.Join([]string{"CAST", username, spellName, targetTower}, "|"), events, game)
+	for _, ev := range events {
+		var msg string
+		switch ev.Kind {
+		case engine.EventCast:
+			msg = fmt.Sprintf("SPELL_CAST|%s|%s|%s|%d", ev.Player, ev.Troop, ev.Tower, ev.Mana)
+		case engine.EventAbility:
+			msg = abilityMessage(ev)
+		case engine.EventGameOver:
+			endEnhancedGame(game, ev)
+			return "ACK|Cast successful"
+		}
+		for uname := range game.Players {
+			sendToUser(uname, msg)
+		}
+		sendToSpectators(game.RoomID, msg)
+	}
+	state := enhancedStateMessage(game)
+	for uname := range game.Players {
+		sendToUser(uname, state)
+	}
+	sendToSpectators(game.RoomID, state)
+	return "ACK|Cast successful"
 }
 
 // sendToUser sends a message to a user if they are connected
 // username: the username to send to
 // msg: the message to send
 func sendToUser(username, msg string) {
-	if v, ok := userConns.Load(username); ok { // Check if user is in the map
-		if conn, ok2 := v.(net.Conn); ok2 { // Type assert to net.Conn
-			conn.Write([]byte(msg + "\n")) // Write message with newline
-		}
+	if p, ok := loadPeer(username); ok { // Check if user is connected
+		p.Send(msg) // Write message in the user's protocol
+	}
+}
+
+// sendSimpleState sends the state of a simple game to a connected user
+func sendSimpleState(username string, g *GameState) {
+	if p, ok := loadPeer(username); ok {
+		p.Send(simpleStateLine(g, username, p))
+	}
+}
+
+// simpleStateLine returns the STATE line of a simple game for peer p
+// Pipe clients get the multi-line text of formatGameState; JSON clients get the state as JSON
+func simpleStateLine(g *GameState, username string, p *peer) string {
+	if p.JSON() {
+		state, _ := json.Marshal(g)
+		return "STATE|" + string(state)
 	}
+	return "STATE|" + formatGameState(g, username)
 }
 
 // getGameState returns the current game state for a user as a string
-func getGameState(username string) string {
+func getGameState(username string, p *peer) string {
 	gamesLock.Lock() // Lock for thread safety
 	defer gamesLock.Unlock()
 	for _, g := range games {
 		if g.Players[username] != nil {
-			return "STATE|" + formatGameState(g, username) // Return formatted state
+			return simpleStateLine(g, username, p) // Return formatted state
 		}
 	}
-	return "ERR|Not in game" // Not found
+	return errMsg(engine.CodeNotInGame, "Not in game") // Not found
 }
 
 // formatGameState formats the game state for display to a user
@@ -869,15 +1207,18 @@ func formatGameState(g *GameState, username string) string {
 	for uname, ps := range g.Players {
 		sb.WriteString(fmt.Sprintf("Player: %s %s\n", uname, ternary(uname == g.TurnUser, "(TURN)", "")))
 		sb.WriteString("  Towers:\n")
-		for _, t := range []string{"Guard1", "Guard2", "King"} {
+		for _, t := range ps.TowerNames() {
 			tower := ps.Towers[t]
-			sb.WriteString(fmt.Sprintf("    %s: HP=%d ATK=%d DEF=%d\n", tower.Name, tower.HP, tower.ATK, tower.DEF))
+			sb.WriteString(fmt.Sprintf("    %s: HP=%d ATK=%d DEF=%d%s\n", tower.Name, tower.HP, tower.ATK, tower.DEF, describeEffects(tower.Effects)))
 		}
 		sb.WriteString("  Troops:\n")
 		for _, tr := range ps.Troops {
-			// Special display for Queen
-			if tr.Name == "Queen" {
-				sb.WriteString(fmt.Sprintf("    %s: Heals the tower with lowest HP by 300\n", tr.Name))
+			// Support troops (the Queen) are shown by what their ability does
+			if tr.Support() {
+				sb.WriteString(fmt.Sprintf("    %s: %s\n", tr.Name, describeAbility(tr.Ability, g.Rules)))
+			} else if tr.Ability != nil {
+				sb.WriteString(fmt.Sprintf("    %s: HP=%d ATK=%d DEF=%d (%s)\n",
+					tr.Name, tr.HP, tr.ATK, tr.DEF, describeAbility(tr.Ability, g.Rules)))
 			} else {
 				sb.WriteString(fmt.Sprintf("    %s: HP=%d ATK=%d DEF=%d\n",
 					tr.Name, tr.HP, tr.ATK, tr.DEF))
@@ -885,12 +1226,76 @@ func formatGameState(g *GameState, username string) string {
 		}
 	}
 	sb.WriteString(fmt.Sprintf("Current turn: %s\n", g.TurnUser))
+	sb.WriteString(fmt.Sprintf("Seed: %d\n", g.Seed))
+	sb.WriteString(fmt.Sprintf("Specs: v%d\n", g.SpecVersion))
 	if g.Winner != "" {
 		sb.WriteString(fmt.Sprintf("Winner: %s\n", g.Winner))
 	}
 	return sb.String()
 }
 
+// abilityTargets names each targeting rule for the text state view
+var abilityTargets = map[string]string{
+	engine.TargetWeakestOwn: "the tower with lowest HP",
+	engine.TargetOwnKing:    "the King",
+	engine.TargetAllOwn:     "every standing tower",
+	engine.TargetTower:      "the attacked tower",
+	engine.TargetAdjacent:   "towers next to the attacked one",
+	engine.TargetAllEnemy:   "every enemy tower",
+	engine.TargetEnemy:      "the enemy",
+	engine.TargetOwnTroops:  "your troops",
+}
+
+// describeAbility explains an ability for the text state view
+func describeAbility(a *engine.Ability, rules engine.Rules) string {
+	target := abilityTargets[a.TargetRule()]
+	switch a.Kind {
+	case engine.AbilityHeal:
+		amount := a.Amount
+		if amount == 0 {
+			amount = rules.HealAmount
+		}
+		return fmt.Sprintf("Heals %s by %d", target, amount)
+	case engine.AbilityShield:
+		if a.Duration > 0 {
+			return fmt.Sprintf("Shields %s from %d damage for %d turns", target, a.Amount, a.Duration)
+		}
+		return fmt.Sprintf("Shields %s from %d damage", target, a.Amount)
+	case engine.AbilitySplash:
+		return fmt.Sprintf("Deals %d splash damage to %s", a.Amount, target)
+	case engine.AbilityPoison:
+		return fmt.Sprintf("Poisons %s for %d damage a turn over %d turns", target, a.Amount, a.Duration)
+	case engine.AbilityStun:
+		return fmt.Sprintf("Stuns %s for %d turns", target, a.Duration)
+	case engine.AbilityManaDrain:
+		return fmt.Sprintf("Drains %d mana from %s", a.Amount, target)
+	case engine.AbilityDamage:
+		return fmt.Sprintf("Deals %d damage to %s", a.Amount, target)
+	case engine.AbilityRage:
+		return fmt.Sprintf("Raises troop ATK by %d%% for %d turns", a.Amount, a.Duration)
+	}
+	return a.Kind
+}
+
+// describeEffects lists the effects on a tower for the text state view, e.g. " [shield 200, poison 50x2]"
+func describeEffects(effects []engine.Effect) string {
+	if len(effects) == 0 {
+		return ""
+	}
+	parts := make([]string, len(effects))
+	for i, e := range effects {
+		switch e.Kind {
+		case engine.AbilityShield:
+			parts[i] = fmt.Sprintf("shield %d", e.Amount)
+		case engine.AbilityPoison:
+			parts[i] = fmt.Sprintf("poison %dx%d", e.Amount, e.Turns)
+		default:
+			parts[i] = fmt.Sprintf("%s %d", e.Kind, e.Turns)
+		}
+	}
+	return " [" + strings.Join(parts, ", ") + "]"
+}
+
 // ternary is a helper function for inline if-else
 func ternary(cond bool, a, b string) string {
 	if cond {
@@ -899,71 +1304,38 @@ func ternary(cond bool, a, b string) string {
 	return b
 }
 
-// loadSpecs loads tower and troop specs from the JSON file
-func loadSpecs() {
-	data, err := ioutil.ReadFile(specsFile) // Read the file
-	if err != nil {
-		fmt.Println("Error loading specs.json:", err)
-		os.Exit(1)
-	}
-	var specs struct {
-		Towers []TowerSpec `json:"towers"`
-		Troops []TroopSpec `json:"troops"`
-	}
-	if err := json.Unmarshal(data, &specs); err != nil {
-		fmt.Println("Error parsing specs.json:", err)
-		os.Exit(1)
-	}
-	towerSpecs = specs.Towers // Assign loaded towers
-	troopSpecs = specs.Troops // Assign loaded troops
-}
-
-// init is called automatically before main
-func init() {
-	loadSpecs() // Load specs at startup
-}
-
 // Load/save player progress (exp, level, etc.)
-// Hàm loadProgress lấy thông tin tiến trình (level, exp, ...) của user từ file JSON
+// Hàm loadProgress lấy thông tin tiến trình (level, exp, ...) của user từ user store
 func loadProgress(username string) *PlayerProgress {
-	usersLock.Lock()                           // Khóa để tránh race condition khi đọc file
-	defer usersLock.Unlock()                   // Mở khóa khi hàm kết thúc
-	data, err := ioutil.ReadFile(progressFile) // Đọc file tiến trình (users.json)
-	if err != nil {
-		// Nếu lỗi (chưa có file), trả về tiến trình mặc định (level 1, chưa có nâng cấp tower/troop)
-		return &PlayerProgress{Username: username, Level: 1, TowerLv: map[string]int{}, TroopLv: map[string]int{}}
-	}
-	var users UsersData              // Tạo biến lưu danh sách user
-	_ = json.Unmarshal(data, &users) // Parse JSON thành struct UsersData
-	for _, u := range users.Users {
-		if u.Username == username {
-			// Nếu tìm thấy user, trả về tiến trình với EXP, Level hiện tại
-			return &PlayerProgress{Username: u.Username, EXP: u.EXP, Level: u.Level, TowerLv: map[string]int{}, TroopLv: map[string]int{}}
-		}
+	u, ok := userStore.Get(username)
+	if !ok {
+		// Nếu không tìm thấy user, trả về tiến trình mặc định (level 1, chưa có nâng cấp tower/troop)
+		return &PlayerProgress{Username: username, Level: 1, Rating: defaultRating, TowerLv: map[string]int{}, TroopLv: map[string]int{}}
+	}
+	// Nếu tìm thấy user, trả về tiến trình với EXP, Level, gold và level từng tower/troop
+	progress := &PlayerProgress{Username: u.Username, EXP: u.EXP, Level: u.Level, Gold: u.Gold, Rating: userRating(u), TowerLv: map[string]int{}, TroopLv: map[string]int{}}
+	for name, lv := range u.TowerLv {
+		progress.TowerLv[name] = lv
+	}
+	for name, lv := range u.TroopLv {
+		progress.TroopLv[name] = lv
 	}
-	// Nếu không tìm thấy user, trả về tiến trình mặc định
-	return &PlayerProgress{Username: username, Level: 1, TowerLv: map[string]int{}, TroopLv: map[string]int{}}
+	return progress
 }
 
-// Hàm saveProgress lưu lại tiến trình (level, exp, ...) của user vào file JSON
+// Hàm saveProgress lưu lại tiến trình (level, exp, ...) của user vào user store
 func saveProgress(progress *PlayerProgress) {
-	usersLock.Lock() // Khóa để tránh race condition khi ghi file
-	defer usersLock.Unlock()
-	data, err := ioutil.ReadFile(progressFile) // Đọc file tiến trình
-	if err != nil {
-		return // Nếu lỗi thì bỏ qua
-	}
-	var users UsersData
-	_ = json.Unmarshal(data, &users) // Parse JSON thành struct
-	for i, u := range users.Users {
-		if u.Username == progress.Username {
-			// Nếu tìm thấy user, cập nhật EXP và Level
-			users.Users[i].EXP = progress.EXP
-			users.Users[i].Level = progress.Level
-		}
+	err := userStore.Modify(progress.Username, func(u *User) error {
+		u.EXP = progress.EXP
+		u.Level = progress.Level
+		u.Gold = progress.Gold
+		u.TowerLv = cloneLevels(progress.TowerLv)
+		u.TroopLv = cloneLevels(progress.TroopLv)
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrUserNotFound) { // Nếu không có user thì bỏ qua
+		fmt.Println("Error saving progress for", progress.Username+":", err)
 	}
-	out, _ := json.MarshalIndent(users, "", "  ") // Chuyển lại thành JSON
-	_ = ioutil.WriteFile(progressFile, out, 0644) // Ghi ra file
 }
 
 // Enhanced game start: continuous, mana, exp, timer
@@ -971,7 +1343,7 @@ func saveProgress(progress *PlayerProgress) {
 func startEnhancedGame(roomID string) bool {
 	enhancedGamesLock.Lock() // Khóa để tránh race condition
 	defer enhancedGamesLock.Unlock()
-	room, ok := gameRooms[roomID]
+	room, ok := roomSnapshot(roomID)
 	if !ok || !room.Started {
 		return false // Nếu phòng không tồn tại hoặc chưa start thì trả về false
 	}
@@ -981,367 +1353,228 @@ func startEnhancedGame(roomID string) bool {
 	if _, exists := enhancedGames[roomID]; exists {
 		return false // Nếu game đã tồn tại thì không khởi tạo lại
 	}
+	match := engine.NewMatch(engine.ModeEnhanced, config.rules(engine.ModeEnhanced), room.Seed)
+	specs := currentSpecs() // Trận giữ nguyên bộ specs này kể cả khi file được nạp lại
 	players := map[string]*EnhancedPlayerState{}
 	for _, uname := range []string{room.Host, room.Guest} {
 		progress := loadProgress(uname) // Lấy tiến trình user
-		level := 1
-		if progress != nil {
-			level = progress.Level // Lấy level hiện tại
-		}
-		mult := 1.0 + 0.1*float64(level-1) // Tính hệ số nhân theo level
 		towers := map[string]*Tower{}
-		for _, v := range towerSpecs {
-			lv := progress.TowerLv[v.Name]
-			if lv == 0 {
-				lv = 1
-			}
-			// Nhân chỉ số tower theo level
+		for _, v := range specs.Towers {
+			// Nhân chỉ số tower theo level nâng cấp của chính tower đó
+			mult := levelMultiplier(unitLevel(progress.TowerLv, v.Name))
 			towers[v.Name] = &Tower{
-				Name: v.Name,
-				HP:   int(float64(v.HP) * mult),
-				ATK:  int(float64(v.ATK) * mult),
-				DEF:  int(float64(v.DEF) * mult),
+				Name:     v.Name,
+				Role:     v.Role,
+				HP:       int(float64(v.HP) * mult),
+				ATK:      int(float64(v.ATK) * mult),
+				DEF:      int(float64(v.DEF) * mult),
+				CRIT:     v.CRIT,
+				HitSpeed: v.HitSpeed,
 			}
 		}
-		// Phát 3 troops ngẫu nhiên đầu game
-		availableTroopNames := make([]string, 0, len(troopSpecs))
-		for _, t := range troopSpecs {
-			availableTroopNames = append(availableTroopNames, t.Name)
-		}
-		rand.Seed(time.Now().UnixNano())
-		rand.Shuffle(len(availableTroopNames), func(i, j int) {
-			availableTroopNames[i], availableTroopNames[j] = availableTroopNames[j], availableTroopNames[i]
-		})
-		selected := availableTroopNames[:3]
+		// Phát 3 troops ngẫu nhiên từ deck của user (hoặc các troop đã draft) đầu game
+		hand, deck := startingCards(&room, uname, specs, match.Rand())
 		troops := []*Troop{}
-		for _, tn := range selected {
-			var tspec TroopSpec
-			for _, t := range troopSpecs {
-				if t.Name == tn {
-					tspec = t
-					break
-				}
-			}
+		for _, tspec := range hand {
+			mult := levelMultiplier(unitLevel(progress.TroopLv, tspec.Name)) // Level nâng cấp của troop
 			troops = append(troops, &Troop{
-				Name:  tspec.Name,
-				HP:    int(float64(tspec.HP) * mult),
-				ATK:   int(float64(tspec.ATK) * mult),
-				DEF:   int(float64(tspec.DEF) * mult),
-				Owner: uname,
+				Name:     tspec.Name,
+				HP:       int(float64(tspec.HP) * mult),
+				ATK:      int(float64(tspec.ATK) * mult),
+				DEF:      int(float64(tspec.DEF) * mult),
+				Owner:    uname,
+				HitSpeed: tspec.HitSpeed,
+				Targets:  tspec.Targets,
+				Ability:  tspec.Ability,
 			})
 		}
-		players[uname] = &EnhancedPlayerState{
+		player := &PlayerState{
 			Username: uname,
 			Towers:   towers,
 			Troops:   troops,
-			Mana:     5, // Mỗi user bắt đầu với 5 mana
+			Mana:     config.StartingMana, // Mana ban đầu của mỗi user
+		}
+		match.AddPlayer(player)
+		players[uname] = &EnhancedPlayerState{
+			Player:   player,
 			EXP:      progress.EXP,
 			Level:    progress.Level,
-			Progress: progress}
+			Progress: progress,
+			Deck:     deck}
 	}
 	gs := &EnhancedGameState{
-		RoomID:         roomID,
-		Players:        players,
-		Winner:         "",
-		Over:           false,
-		StartTime:      time.Now(),
-		EndTime:        time.Now().Add(3 * time.Minute), // Game kéo dài 3 phút
-		AttackPatterns: make(map[string]string),
-	}
-	enhancedGames[roomID] = gs  // Lưu game vào map
-	go enhancedGameLoop(roomID) // Chạy goroutine quản lý game loop
+		RoomID:      roomID,
+		Match:       match,
+		Players:     players,
+		StartTime:   time.Now(),
+		EndTime:     time.Now().Add(config.MatchLength.Duration), // Thời lượng trận theo cấu hình
+		SpecVersion: specs.Version,
+		Spells:      specs.Spells,
+		Arena:       match.Rules.Arena,
+		Specs:       specs,
+	}
+	gs.Replay = newReplayRecorder(roomID, match, gs) // Ghi lại replay của trận
+	enhancedGames[roomID] = gs                       // Lưu game vào map
+	go enhancedGameLoop(roomID)                      // Chạy goroutine quản lý game loop
 	return true
 }
 
-// Enhanced game loop: mana regen, timer, end conditions
-// Goroutine này chạy liên tục để hồi mana, kiểm tra hết giờ, tính thắng/thua, cập nhật exp/level
+// Enhanced game loop: field simulation, mana regen, timer, end conditions
+// Goroutine này chạy theo nhịp sim_tick để mô phỏng quân trên sân, hồi mana mỗi regen_interval,
+// kiểm tra hết giờ, tính thắng/thua, cập nhật exp/level
 func enhancedGameLoop(roomID string) {
-	for {
-		time.Sleep(1 * time.Second) // Mỗi giây lặp lại
+	ticker := time.NewTicker(config.SimTick.Duration)
+	defer ticker.Stop()
+	nextRegen := time.Now().Add(config.RegenInterval.Duration)
+	for range ticker.C {
 		enhancedGamesLock.Lock()
 		gs, ok := enhancedGames[roomID]
 		if !ok || gs.Over {
 			enhancedGamesLock.Unlock()
 			return // Nếu game đã kết thúc thì dừng
 		}
-		for _, ps := range gs.Players {
-			if ps.Mana < 10 {
-				ps.Mana++ // Hồi mana mỗi giây, tối đa 10
+		// A player who stayed disconnected past the grace period forfeits the match
+		for uname := range gs.Players {
+			if graceExpired(uname) {
+				enhancedGamesLock.Unlock()
+				disconnectedLock.Lock()
+				delete(disconnected, uname)
+				disconnectedLock.Unlock()
+				handlePlayerExit(uname)
+				return
 			}
 		}
-		// Kiểm tra hết giờ hoặc game đã kết thúc
-		if time.Now().After(gs.EndTime) || gs.Over {
-			gs.Over = true
-			// Tính số tower còn sống của mỗi người
-			aliveCounts := map[string]int{}
-			for uname, ps := range gs.Players {
-				alive := 0
-				for _, t := range ps.Towers {
-					if t.HP > 0 {
-						alive++
-					}
-				}
-				aliveCounts[uname] = alive
-			}
-			// So sánh số tower còn sống để xác định thắng/thua/hòa
-			var winner string
-			var draw bool
-			usernames := []string{}
-			for uname := range aliveCounts {
-				usernames = append(usernames, uname)
-			}
-			if len(usernames) == 2 {
-				a1 := aliveCounts[usernames[0]]
-				a2 := aliveCounts[usernames[1]]
-				if a1 > a2 {
-					winner = usernames[0]
-				} else if a2 > a1 {
-					winner = usernames[1]
-				} else {
-					draw = true
-				}
+		// Mô phỏng một bước trên sân: quân di chuyển, đánh nhau, tower bắn; chỉ gửi DELTA thay vì cả STATE
+		if len(gs.Field) > 0 {
+			events, _ := gs.Apply(engine.Step{})
+			if len(events) > 0 { // quiet steps only move units; the next frame shows where they got to
+				gs.Replay.record("STEP", events, gs)
 			}
-			if draw {
-				gs.Winner = "DRAW"
-			} else {
-				gs.Winner = winner
-			}
-			// Cộng EXP cho người chơi
-			for uname, ps := range gs.Players {
-				oppName := ""
-				for n := range gs.Players {
-					if n != uname {
-						oppName = n
-						break
-					}
-				}
-				oppLv := 1
-				if oppName != "" {
-					oppLv = gs.Players[oppName].Level
+			if broadcastEnhancedEvents(gs, events) {
+				enhancedGamesLock.Unlock()
+				return
+			}
+			if delta := gs.deltaMessage(); delta != "" {
+				for uname := range gs.Players {
+					sendToUser(uname, delta)
 				}
-				if gs.Winner == "DRAW" {
-					ps.EXP += 2 * oppLv // Hòa thì cộng ít exp
-				} else if gs.Winner == uname {
-					ps.EXP += 5 * oppLv // Thắng thì cộng nhiều exp
+				sendToSpectators(gs.RoomID, delta)
+			}
+		}
+		// Mỗi regen_interval: hồi mana, tối đa mana_cap, và chạy các hiệu ứng kéo dài (poison, stun, shield)
+		if !time.Now().Before(nextRegen) {
+			nextRegen = nextRegen.Add(config.RegenInterval.Duration)
+			if events, _ := gs.Apply(engine.Tick{}); len(events) > 0 {
+				gs.Replay.record("TICK", events, gs)
+				if broadcastEnhancedEvents(gs, events) {
+					enhancedGamesLock.Unlock()
+					return
 				}
-				// Tăng level nếu đủ exp
-				req := 100 + int(0.1*float64(ps.Level-1)*100)
-				for ps.EXP >= req {
-					ps.EXP -= req
-					ps.Level++
-					req = 100 + int(0.1*float64(ps.Level-1)*100)
+				state := enhancedStateMessage(gs)
+				for uname := range gs.Players {
+					sendToUser(uname, state)
 				}
-				ps.Progress.EXP = ps.EXP
-				ps.Progress.Level = ps.Level
-				saveProgress(ps.Progress)
+				sendToSpectators(gs.RoomID, state)
 			}
-			// Gửi trạng thái cuối cùng và GAME_END cho cả hai người chơi
+		}
+		// Kiểm tra hết giờ: bên nhiều tower hơn thắng; hòa thì sang overtime (x2 mana), rồi sudden death
+		if time.Now().After(gs.EndTime) {
+			events, _ := gs.Apply(engine.TimeUp{})
+			gs.Replay.record("TIME_UP", events, gs)
+			if broadcastEnhancedEvents(gs, events) {
+				enhancedGamesLock.Unlock()
+				return
+			}
+			gs.EndTime = time.Now().Add(phaseLength(gs.Phase)) // Hòa: tính giờ cho hiệp phụ tiếp theo
+			state := enhancedStateMessage(gs)
 			for uname := range gs.Players {
-				if v, ok := userConns.Load(uname); ok {
-					if conn, ok2 := v.(net.Conn); ok2 {
-						// Gửi trạng thái cuối cùng
-						state, _ := json.Marshal(gs)
-						conn.Write([]byte("STATE|" + string(state) + "\n"))
-						// Gửi GAME_END
-						if gs.Winner == "DRAW" {
-							conn.Write([]byte("GAME_END|Draw!\n"))
-						} else if gs.Winner == uname {
-							conn.Write([]byte("GAME_END|You win!\n"))
-						} else {
-							conn.Write([]byte("GAME_END|You lose!\n"))
-						}
-					}
-				}
+				sendToUser(uname, state)
 			}
-			// Đợi 2 giây rồi xóa game khỏi bộ nhớ
-			enhancedGamesLock.Unlock()
-			time.Sleep(2 * time.Second)
-			enhancedGamesLock.Lock()
-			delete(enhancedGames, roomID)
-			roomsLock.Lock()
-			delete(gameRooms, roomID)
-			roomsLock.Unlock()
-			enhancedGamesLock.Unlock()
-			return
+			sendToSpectators(gs.RoomID, state)
 		}
 		enhancedGamesLock.Unlock()
 	}
 }
 
+// endEnhancedGame awards EXP and gold, sends the final state and GAME_END, and removes the game
+// Caller holds enhancedGamesLock
+func endEnhancedGame(gs *EnhancedGameState, ev engine.Event) {
+	gs.Replay.finish(ev)
+	// Cộng EXP cho người chơi
+	for uname, ps := range gs.Players {
+		oppLv := 1
+		if opp := gs.Players[gs.Opponent(uname)]; opp != nil {
+			oppLv = opp.Level
+		}
+		if gs.Winner == engine.Draw {
+			ps.EXP += 2 * oppLv // Hòa thì cộng ít exp
+		} else if gs.Winner == uname {
+			ps.EXP += 5 * oppLv // Thắng thì cộng nhiều exp
+		}
+		// Tăng level nếu đủ exp
+		req := config.expToLevelUp(ps.Level)
+		for ps.EXP >= req {
+			ps.EXP -= req
+			ps.Level++
+			req = config.expToLevelUp(ps.Level)
+		}
+		ps.Progress.EXP = ps.EXP
+		ps.Progress.Level = ps.Level
+		ps.Progress.Gold += goldForResult(gs.Winner, uname) // Thưởng gold để nâng cấp
+		saveProgress(ps.Progress)
+	}
+	ratings := updateRatings(gs.Match, ev)
+	recordHistory(gs.Match, ev, gs.Replay.ID())
+	awardCard(gs.Match, ev, gs.Specs)
+	// Gửi trạng thái cuối cùng và GAME_END cho cả hai người chơi và người xem
+	state := enhancedStateMessage(gs)
+	for uname := range gs.Players {
+		if msg := gameEndMessage(ev, uname); msg != "" {
+			sendToUser(uname, state)
+			sendToUser(uname, msg+ratings[uname])
+		}
+	}
+	sendToSpectators(gs.RoomID, state)
+	sendToSpectators(gs.RoomID, spectatorGameEnd(ev))
+	// Xóa game khỏi bộ nhớ
+	delete(enhancedGames, gs.RoomID)
+	roomsLock.Lock()
+	delete(gameRooms, gs.RoomID)
+	roomsLock.Unlock()
+}
+
 // Enhanced deploy: check mana, crit, continuous
 func handleEnhancedDeploy(username, troopName, targetTower string) string {
 	enhancedGamesLock.Lock()
 	defer enhancedGamesLock.Unlock()
 	var game *EnhancedGameState
-	var roomID string
-	for rid, g := range enhancedGames {
+	for _, g := range enhancedGames {
 		if g.Players[username] != nil {
 			game = g
-			roomID = rid
 			break
 		}
 	}
 	if game == nil {
-		return "ERR|Not in game"
+		return errMsg(engine.CodeNotInGame, "Not in game")
 	}
 	if game.Over {
-		return "ERR|Game is over"
-	}
-	ps := game.Players[username]
-	// Lấy troop đã mua (không tạo mới, không trừ mana khi deploy)
-	var troop *Troop
-	for _, t := range ps.Troops {
-		if t.Name == troopName {
-			if t.Name == "Queen" {
-				// Queen luôn luôn deploy được, không quan tâm HP
-				troop = t
-				break
-			} else if t.HP > 0 {
-				troop = t
-				break
-			}
-		}
-	}
-	if troop == nil {
-		return "ERR|No such troop or dead"
-	}
-	// Không kiểm tra/trừ mana ở đây nữa
-	// Find opponent
-	var opp *EnhancedPlayerState
-	var oppName string
-	for uname, p := range game.Players {
-		if uname != username {
-			opp = p
-			oppName = uname
-			break
-		}
-	}
-
-	if opp == nil {
-		return "ERR|No opponent"
+		return errMsg(engine.CodeGameOver, "Game is over")
 	}
-
-	// Check tower attack restrictions
-	if targetTower == "King" {
-		// Check if at least one guard tower is destroyed before allowing King tower attack
-		if opp.Towers["Guard1"].HP > 0 && opp.Towers["Guard2"].HP > 0 {
-			return "ERR|Must destroy either Guard1 or Guard2 tower before attacking King"
-		}
-	} else if targetTower == "Guard1" || targetTower == "Guard2" {
-		// Check if this is the first guard tower attack by this player
-		firstGuardTower, hasPattern := game.AttackPatterns[username]
-
-		if !hasPattern {
-			// First time attacking a guard tower - record the choice
-			game.AttackPatterns[username] = targetTower
-		} else if firstGuardTower != targetTower {
-			// Player is trying to attack the other guard tower
-			if opp.Towers[firstGuardTower].HP > 0 {
-				// The first guard tower is not yet destroyed, prevent switch
-				return fmt.Sprintf("ERR|You must destroy %s Tower first before attacking %s Tower", firstGuardTower, targetTower)
-			}
-		}
-	}
-
-	tower := opp.Towers[targetTower]
-	if tower == nil || tower.HP <= 0 {
-		return "ERR|Invalid or destroyed tower"
-	}
-	// CRIT logic (tower attacks troop)
-	critChance := 0.0
-	for _, t := range towerSpecs {
-		if t.Name == targetTower {
-			critChance = t.CRIT
-			break
-		}
-	}
-	crit := rand.Float64() < critChance
-	// Troop attacks tower
-	atk := troop.ATK
-	dmg := atk - tower.DEF
-	if dmg < 0 {
-		dmg = 0
-	}
-	tower.HP -= dmg
-	// Tower phản công troop (có CRIT)
-	counterATK := tower.ATK
-	if crit {
-		counterATK = int(float64(counterATK) * 1.2)
-	}
-	counterDmg := counterATK - troop.DEF
-	if counterDmg < 0 {
-		counterDmg = 0
-	}
-	troop.HP -= counterDmg
-	if troop.HP < 0 {
-		troop.HP = 0
-	}
-	msg := fmt.Sprintf("ATTACK_RESULT|%s|%s|%d|%d|TOWER_HIT:%d|CRIT:%v|TROOP_HP:%d", troop.Name, tower.Name, dmg, tower.HP, counterDmg, crit, troop.HP)
-	if tower.HP <= 0 {
-		msg += "|DESTROYED"
-		if tower.Name == "King" {
-			game.Over = true
-			game.Winner = username
-			// Send ATTACK_RESULT, final STATE, and GAME_END to both players
-			for uname := range game.Players {
-				if v, ok := userConns.Load(uname); ok {
-					if conn, ok2 := v.(net.Conn); ok2 {
-						conn.Write([]byte(msg + "\n"))
-						state, _ := json.Marshal(game)
-						conn.Write([]byte("STATE|" + string(state) + "\n"))
-						if uname == username {
-							conn.Write([]byte("GAME_END|You win! King destroyed.\n"))
-						} else {
-							conn.Write([]byte("GAME_END|You lose! King destroyed.\n"))
-						}
-					}
-				}
-			}
-			delete(enhancedGames, roomID)
-			roomsLock.Lock()
-			delete(gameRooms, roomID)
-			roomsLock.Unlock()
-			return "ACK|Deploy successful"
-		}
+	events, err := game.Apply(engine.Deploy{Player: username, Troop: troopName, Tower: targetTower})
+	if err != nil {
+		return errorReply(err)
 	}
-	// Queen's heal (giống simple: chỉ heal cho Guard1 hoặc Guard2 nếu còn sống, chọn tower có HP thấp nhất)
-	if troop.Name == "Queen" {
-		minHP := 99999
-		var healTower *Tower
-		for _, tname := range []string{"Guard1", "Guard2"} {
-			t := ps.Towers[tname]
-			if t.HP > 0 && t.HP < minHP {
-				minHP = t.HP
-				healTower = t
-			}
-		}
-		if healTower != nil {
-			healAmount := 300
-			before := healTower.HP
-			healTower.HP = before + healAmount // Always add 300, no cap
-			healMsg := fmt.Sprintf("QUEEN_HEAL|%s|%s|%d|%d", username, healTower.Name, healAmount, healTower.HP)
-			if v, ok := userConns.Load(username); ok {
-				if conn, ok2 := v.(net.Conn); ok2 {
-					conn.Write([]byte(healMsg + "\n"))
-				}
-			}
-			if v, ok := userConns.Load(oppName); ok {
-				if conn, ok2 := v.(net.Conn); ok2 {
-					conn.Write([]byte(healMsg + "\n"))
-				}
-			}
-		}
+	game.Replay.record(strings.Join([]string{"DEPLOY", username, troopName, targetTower}, "|"), events, game)
+	// Send UNIT_DEPLOYED (or a support troop's ability events) and updated STATE to both players;
+	// the unit fights from the next step of enhancedGameLoop on
+	if broadcastEnhancedEvents(game, events) {
+		return "ACK|Deploy successful"
 	}
-	// Send ATTACK_RESULT and updated STATE to both players
+	state := enhancedStateMessage(game)
 	for uname := range game.Players {
-		if v, ok := userConns.Load(uname); ok {
-			if conn, ok2 := v.(net.Conn); ok2 {
-				conn.Write([]byte(msg + "\n"))
-				state, _ := json.Marshal(game)
-				conn.Write([]byte("STATE|" + string(state) + "\n"))
-			}
-		}
+		sendToUser(uname, state)
 	}
+	sendToSpectators(game.RoomID, state)
 	return "ACK|Deploy successful"
 }
 
@@ -1351,46 +1584,47 @@ func getEnhancedGameState(username string) string {
 	defer enhancedGamesLock.Unlock()
 	for _, g := range enhancedGames {
 		if g.Players[username] != nil {
-			state, _ := json.Marshal(g)
-			return "STATE|" + string(state)
+			return enhancedStateMessage(g)
 		}
 	}
-	return "ERR|Not in game"
+	return errMsg(engine.CodeNotInGame, "Not in game")
+}
+
+// enhancedStateMessage returns the STATE|{json} line for an enhanced game
+// The same view goes to both players and spectators
+func enhancedStateMessage(g *EnhancedGameState) string {
+	g.seen.sync(g) // the next DELTA is relative to this full state
+	state, _ := json.Marshal(g)
+	return "STATE|" + string(state)
 }
 
 // Helper function to handle a player exiting the game
+// The player forfeits: the opponent wins and is sent back to the menu
 func handlePlayerExit(username string) {
 	// First check if the player is in a simple game
 	gamesLock.Lock()
-	var gameFound *GameState
-	var gameRoomID string
-	var opponent string
-
 	for roomID, g := range games {
-		if _, ok := g.Players[username]; ok {
-			gameFound = g
-			gameRoomID = roomID
-
-			// Find opponent name
+		if _, ok := g.Players[username]; !ok {
+			continue
+		}
+		events, _ := g.Apply(engine.Forfeit{Player: username})
+		g.Replay.record("EXIT|"+username, events, g)
+		for _, ev := range events {
+			g.Replay.finish(ev)
+			ratings := updateRatings(g.Match, ev)
+			recordHistory(g.Match, ev, g.Replay.ID())
 			for uname := range g.Players {
-				if uname != username {
-					opponent = uname
-					break
+				if msg := gameEndMessage(ev, uname); msg != "" {
+					sendToUser(uname, msg+ratings[uname]) // Send GAME_END to opponent to return them to the menu
 				}
 			}
-			break
+			sendToSpectators(roomID, spectatorGameEnd(ev))
 		}
-	}
-
-	if gameFound != nil {
-		// Notify opponent that this player has left
-		if opponent != "" {
-			// Send GAME_END to opponent to return them to the menu
-			sendToUser(opponent, "GAME_END|Your opponent has left the game")
-		}
-
 		// Remove the game
-		delete(games, gameRoomID)
+		delete(games, roomID)
+		roomsLock.Lock()
+		delete(gameRooms, roomID)
+		roomsLock.Unlock()
 		gamesLock.Unlock()
 		return
 	}
@@ -1398,39 +1632,18 @@ func handlePlayerExit(username string) {
 
 	// Check if player is in an enhanced game
 	enhancedGamesLock.Lock()
-	var enhancedGameFound *EnhancedGameState
-	var enhancedGameRoomID string
-	opponent = ""
-
-	for roomID, g := range enhancedGames {
-		if _, ok := g.Players[username]; ok {
-			enhancedGameFound = g
-			enhancedGameRoomID = roomID
-
-			// Find opponent name
-			for uname := range g.Players {
-				if uname != username {
-					opponent = uname
-					break
-				}
-			}
-			break
+	defer enhancedGamesLock.Unlock()
+	for _, g := range enhancedGames {
+		if _, ok := g.Players[username]; !ok {
+			continue
 		}
-	}
-
-	if enhancedGameFound != nil {
-		// Notify opponent that this player has left
-		if opponent != "" {
-			// Send GAME_END to opponent to return them to the menu
-			sendToUser(opponent, "GAME_END|Your opponent has left the game")
+		events, _ := g.Apply(engine.Forfeit{Player: username})
+		g.Replay.record("EXIT|"+username, events, g)
+		for _, ev := range events {
+			if ev.Kind == engine.EventGameOver {
+				endEnhancedGame(g, ev) // Awards the win to the opponent and removes the game
+			}
 		}
-
-		// Remove the game
-		delete(enhancedGames, enhancedGameRoomID)
-		// Remove the room from gameRooms to allow new games with same name
-		roomsLock.Lock()
-		delete(gameRooms, enhancedGameRoomID)
-		roomsLock.Unlock()
+		return
 	}
-	enhancedGamesLock.Unlock()
 }
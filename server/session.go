@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Session ties a token handed out at LOGIN to a username, so a dropped client can RESUME
+type Session struct {
+	Token    string
+	Username string
+	Expires  time.Time
+}
+
+var (
+	sessions     = make(map[string]*Session) // token -> session
+	sessionsLock sync.Mutex
+	sessionTTL   = 24 * time.Hour
+
+	disconnected     = make(map[string]time.Time) // username -> time the connection dropped
+	disconnectedLock sync.Mutex
+)
+
+// newSession creates a session token for username. It fails if no random token can be
+// made: a guessable one would let anyone RESUME the session.
+func newSession(username string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("create session token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+	now := time.Now()
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for t, s := range sessions { // prune expired tokens, which nothing else may ever look up again
+		if now.After(s.Expires) {
+			delete(sessions, t)
+		}
+	}
+	sessions[token] = &Session{Token: token, Username: username, Expires: now.Add(sessionTTL)}
+	return token, nil
+}
+
+// lookupSession returns the username for a valid token and extends its expiry
+func lookupSession(token string) (string, bool) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	s, ok := sessions[token]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(s.Expires) {
+		delete(sessions, token)
+		return "", false
+	}
+	s.Expires = time.Now().Add(sessionTTL)
+	return s.Username, true
+}
+
+// findActiveGame returns the room a user is currently playing in and whether it is an enhanced game
+func findActiveGame(username string) (string, bool, bool) {
+	gamesLock.Lock()
+	for roomID, g := range games {
+		if _, ok := g.Players[username]; ok && !g.Over {
+			gamesLock.Unlock()
+			return roomID, false, true
+		}
+	}
+	gamesLock.Unlock()
+	enhancedGamesLock.Lock()
+	defer enhancedGamesLock.Unlock()
+	for roomID, g := range enhancedGames {
+		if _, ok := g.Players[username]; ok && !g.Over {
+			return roomID, true, true
+		}
+	}
+	return "", false, false
+}
+
+// opponentOf returns the other player of the game username is in, or ""
+func opponentOf(username string) string {
+	gamesLock.Lock()
+	for _, g := range games {
+		if _, ok := g.Players[username]; ok {
+			for uname := range g.Players {
+				if uname != username {
+					gamesLock.Unlock()
+					return uname
+				}
+			}
+		}
+	}
+	gamesLock.Unlock()
+	enhancedGamesLock.Lock()
+	defer enhancedGamesLock.Unlock()
+	for _, g := range enhancedGames {
+		if _, ok := g.Players[username]; ok {
+			for uname := range g.Players {
+				if uname != username {
+					return uname
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// isDisconnected reports whether username dropped out of a match and has not resumed yet
+func isDisconnected(username string) bool {
+	disconnectedLock.Lock()
+	defer disconnectedLock.Unlock()
+	_, ok := disconnected[username]
+	return ok
+}
+
+// graceExpired reports whether a disconnected user has used up the reconnect grace period
+func graceExpired(username string) bool {
+	disconnectedLock.Lock()
+	defer disconnectedLock.Unlock()
+	at, ok := disconnected[username]
+	return ok && time.Since(at) >= config.ReconnectGrace.Duration
+}
+
+// handleDisconnect keeps a dropped player's match or draft alive for the grace period
+// p: the connection that dropped; ignored if the user already resumed on a newer one
+func handleDisconnect(username string, p *peer) {
+	if !userConns.CompareAndDelete(username, p) {
+		return // User already resumed on another connection
+	}
+	// A draft is held too; its turns time out meanwhile and the match may start without them
+	opp, drafting := draftOpponent(username)
+	if !drafting {
+		if _, _, ok := findActiveGame(username); !ok {
+			return
+		}
+		opp = opponentOf(username)
+	}
+	at := time.Now()
+	disconnectedLock.Lock()
+	disconnected[username] = at
+	disconnectedLock.Unlock()
+	if opp != "" {
+		sendToUser(opp, fmt.Sprintf("OPPONENT_DISCONNECTED|%s|%d", username, int(config.ReconnectGrace.Seconds())))
+	}
+	fmt.Printf("%s disconnected, holding match for %v\n", username, config.ReconnectGrace)
+	// Simple games and drafts have no loop of their own, so end them from a timer; the enhanced loop also checks every tick
+	time.AfterFunc(config.ReconnectGrace.Duration, func() {
+		disconnectedLock.Lock()
+		still := disconnected[username].Equal(at)
+		if still {
+			delete(disconnected, username)
+		}
+		disconnectedLock.Unlock()
+		if !still {
+			return
+		}
+		if cancelDraft(username, "disconnected") {
+			fmt.Printf("%s did not reconnect, cancelling draft\n", username)
+			return
+		}
+		fmt.Printf("%s did not reconnect, forfeiting match\n", username)
+		handlePlayerExit(username)
+	})
+}
+
+// resumeSession rebinds p to the user behind token and replays the current match state
+// requestID: id of the RESUME request, echoed in its ACK
+// Returns the username, or "" if the token is invalid
+func resumeSession(token string, p *peer, requestID string) string {
+	username, ok := lookupSession(token)
+	if !ok {
+		return ""
+	}
+	rejoin(username, p, func(where string) {
+		p.Reply("ACK|Resumed|"+username+"|"+where, requestID)
+	})
+	return username
+}
+
+// rejoin binds p to username, ends any reconnect grace period and replays the match or
+// draft the user is in. RESUME and a fresh LOGIN after a drop both come back this way.
+// ack: sends the reply to the request, told LOBBY or INGAME|room_id, before any state
+func rejoin(username string, p *peer, ack func(where string)) {
+	userConns.Store(username, p)
+	disconnectedLock.Lock()
+	_, dropped := disconnected[username]
+	delete(disconnected, username)
+	disconnectedLock.Unlock()
+	roomID, enhanced, inGame := findActiveGame(username)
+	if !inGame {
+		ack("LOBBY")
+		if opp, ok := draftOpponent(username); ok && dropped {
+			sendToUser(opp, "OPPONENT_RECONNECTED|"+username)
+		}
+		sendDraftState(username)
+		return
+	}
+	ack("INGAME|" + roomID)
+	if opp := opponentOf(username); opp != "" && dropped {
+		sendToUser(opp, "OPPONENT_RECONNECTED|"+username)
+	}
+	p.Send("ACK|GAME_STARTED")
+	if enhanced {
+		p.Send(getEnhancedGameState(username))
+		return
+	}
+	p.Send(getGameState(username, p))
+	gamesLock.Lock()
+	turnUser := ""
+	if g, ok := games[roomID]; ok {
+		turnUser = g.TurnUser
+	}
+	gamesLock.Unlock()
+	if turnUser == username {
+		p.Send("TURN|Your turn!")
+	} else {
+		p.Send("TURN|Wait for your turn...")
+	}
+}
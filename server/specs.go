@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpecSet is one loaded version of the specs file. A match keeps the set it started
+// with, so reloading only affects matches created afterwards.
+type SpecSet struct {
+	Version  int
+	Towers   []TowerSpec
+	Troops   []TroopSpec
+	Spells   []SpellSpec
+	LoadedAt time.Time
+}
+
+var (
+	activeSpecs atomic.Pointer[SpecSet] // the set new matches start with
+	reloadLock  sync.Mutex              // serialises reloads so versions stay in order
+	specsStamp  fileStamp               // specs file as last loaded, guarded by reloadLock
+)
+
+// currentSpecs returns the spec set new matches use
+func currentSpecs() *SpecSet {
+	return activeSpecs.Load()
+}
+
+// Troop returns the troop spec with the given name
+func (s *SpecSet) Troop(name string) (TroopSpec, bool) {
+	for _, t := range s.Troops {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return TroopSpec{}, false
+}
+
+// Spell returns the spell spec with the given name
+func (s *SpecSet) Spell(name string) (SpellSpec, bool) {
+	for _, sp := range s.Spells {
+		if sp.Name == name {
+			return sp, true
+		}
+	}
+	return SpellSpec{}, false
+}
+
+// Tower returns the tower spec with the given name
+func (s *SpecSet) Tower(name string) (TowerSpec, bool) {
+	for _, t := range s.Towers {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return TowerSpec{}, false
+}
+
+// fileStamp identifies a version of a file on disk
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statStamp(path string) (fileStamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}, nil
+}
+
+// reloadSpecs reads and validates the specs file and, if it is valid, makes it the
+// active set under the next version number. On error the active set is unchanged.
+func reloadSpecs() (*SpecSet, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	stamp, err := statStamp(config.SpecsFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(config.SpecsFile)
+	if err != nil {
+		return nil, err
+	}
+	specsStamp = stamp // a broken file is reported once, not on every poll
+	set, err := parseSpecs(data)
+	if err != nil {
+		return nil, err
+	}
+	if old := currentSpecs(); old != nil {
+		set.Version = old.Version + 1
+	} else {
+		set.Version = 1
+	}
+	set.LoadedAt = time.Now()
+	activeSpecs.Store(set)
+	return set, nil
+}
+
+// watchSpecs reloads the specs file whenever its modification time or size changes
+func watchSpecs(every time.Duration) {
+	for {
+		time.Sleep(every)
+		stamp, err := statStamp(config.SpecsFile)
+		reloadLock.Lock()
+		changed := err == nil && stamp != specsStamp
+		reloadLock.Unlock()
+		if !changed {
+			continue
+		}
+		if set, err := reloadSpecs(); err != nil {
+			fmt.Println("Specs file changed but was not loaded:", err)
+		} else {
+			fmt.Printf("Specs reloaded: version %d (%d towers, %d troops)\n", set.Version, len(set.Towers), len(set.Troops))
+		}
+	}
+}
+
+// handleReloadSpecs implements the admin command RELOAD_SPECS
+func handleReloadSpecs(username string) string {
+	if !config.isAdmin(username) {
+		return errMsg(codeForbidden, "Admins only")
+	}
+	set, err := reloadSpecs()
+	if err != nil {
+		return errMsg(codeInvalidSpecs, "Specs not reloaded: "+err.Error())
+	}
+	fmt.Printf("Specs reloaded by %s: version %d\n", username, set.Version)
+	return fmt.Sprintf("ACK|SPECS_RELOADED|%d|%d|%d", set.Version, len(set.Towers), len(set.Troops))
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
+)
+
+// Specs file schema. The allowed keys are the json tags of specFile and the types it
+// contains; values are checked by SpecSet.validate. Problems are located by JSON path
+// (e.g. troops[2].ability.kind) and reported with the line they appear on.
+
+// specFile is the layout of the specs file
+type specFile struct {
+	Towers []TowerSpec `json:"towers"`
+	Troops []TroopSpec `json:"troops"`
+	Spells []SpellSpec `json:"spells"` // optional
+}
+
+// specKeyHints explain keys that older specs files used
+var specKeyHints = map[string]string{
+	"special": `replaced by "ability", e.g. "ability": {"kind": "heal"}`,
+}
+
+// specProblem is one schema violation
+type specProblem struct {
+	path   string
+	offset int64 // byte offset in the file, or -1 to look the path up
+	msg    string
+}
+
+// SpecError lists every problem found in a specs file
+type SpecError struct {
+	Problems []SpecIssue
+}
+
+// SpecIssue is one problem with its location
+type SpecIssue struct {
+	Line   int    // 1-based, 0 if unknown
+	Path   string // JSON path, "" for the whole file
+	Msg    string
+	Source string // the text of the line, trimmed
+}
+
+func (e *SpecError) Error() string {
+	parts := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (p SpecIssue) String() string {
+	s := p.Msg
+	if p.Path != "" {
+		s = p.Path + ": " + s
+	}
+	if p.Line > 0 {
+		s = fmt.Sprintf("line %d: %s", p.Line, s)
+	}
+	return s
+}
+
+// parseSpecs decodes the specs file contents and checks them against the schema
+// Returns a *SpecError listing every problem
+func parseSpecs(data []byte) (*SpecSet, error) {
+	var file specFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		var syntax *json.SyntaxError
+		var typ *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntax):
+			return nil, locate(data, nil, []specProblem{{"", syntax.Offset, syntax.Error()}})
+		case errors.As(err, &typ):
+			// Offset is just past the bad value, which is on the line we want
+			return nil, locate(data, nil, []specProblem{{indexPath(typ.Field), typ.Offset - 1, fmt.Sprintf("expected %s, got %s", typ.Type, typ.Value)}})
+		}
+		return nil, &SpecError{Problems: []SpecIssue{{Msg: err.Error()}}}
+	}
+	offsets, problems := indexJSON(data, reflect.TypeOf(file))
+	set := &SpecSet{Towers: file.Towers, Troops: file.Troops, Spells: file.Spells}
+	problems = append(problems, set.validate()...)
+	if len(problems) > 0 {
+		return nil, locate(data, offsets, problems)
+	}
+	return set, nil
+}
+
+// validate checks the values of a decoded spec set
+func (s *SpecSet) validate() []specProblem {
+	var problems []specProblem
+	add := func(path, format string, args ...interface{}) {
+		problems = append(problems, specProblem{path, -1, fmt.Sprintf(format, args...)})
+	}
+	names := map[string]string{} // unit name -> path of its first definition
+	checkName := func(path, name string) {
+		switch {
+		case name == "":
+			add(path+".name", "missing name")
+		case names[name] != "":
+			add(path+".name", "duplicate name %q, first used at %s", name, names[name])
+		default:
+			names[name] = path
+		}
+	}
+	kings, guards := 0, 0
+	for i, t := range s.Towers {
+		path := fmt.Sprintf("towers[%d]", i)
+		checkName(path, t.Name)
+		switch t.Role {
+		case engine.RoleKing:
+			if kings++; kings > 1 {
+				add(path+".role", "only one tower may be the king")
+			}
+		case engine.RoleGuard:
+			guards++
+		case "":
+			add(path, "missing role (king or guard)")
+		default:
+			add(path+".role", "role must be king or guard, got %q", t.Role)
+		}
+		if t.HP <= 0 {
+			add(path+".hp", "must be positive")
+		}
+		if t.ATK < 0 || t.DEF < 0 || t.EXP < 0 {
+			add(path, "atk, def and exp must not be negative")
+		}
+		if t.CRIT < 0 || t.CRIT > 1 {
+			add(path+".crit", "must be between 0 and 1")
+		}
+		if t.HitSpeed < 0 {
+			add(path+".hit_speed", "must not be negative")
+		}
+	}
+	if kings == 0 {
+		add("towers", "need a tower with role king")
+	}
+	if guards == 0 {
+		add("towers", "need at least one tower with role guard")
+	}
+	for i, t := range s.Troops {
+		path := fmt.Sprintf("troops[%d]", i)
+		checkName(path, t.Name)
+		if t.HP < 0 || (t.HP == 0 && !t.Ability.Support()) {
+			add(path+".hp", "must be positive (only heal troops may have 0)")
+		}
+		if t.ATK < 0 || t.DEF < 0 || t.MANA < 0 || t.EXP < 0 {
+			add(path, "atk, def, mana and exp must not be negative")
+		}
+		if t.HitSpeed < 0 {
+			add(path+".hit_speed", "must not be negative")
+		}
+		switch t.Targets {
+		case "", engine.HitsAny, engine.HitsTowers:
+		default:
+			add(path+".targets", "targets must be any or towers, got %q", t.Targets)
+		}
+		if t.Ability != nil {
+			for _, p := range t.Ability.Validate() {
+				add(path+".ability."+p.Field, "%s", p.Msg)
+			}
+		}
+	}
+	for i, sp := range s.Spells {
+		path := fmt.Sprintf("spells[%d]", i)
+		checkName(path, sp.Name)
+		if sp.MANA < 0 || sp.Cooldown < 0 {
+			add(path, "mana and cooldown must not be negative")
+		}
+		if sp.Effect == nil {
+			add(path, "missing effect, e.g. \"effect\": {\"kind\": \"damage\", \"amount\": 300}")
+			continue
+		}
+		for _, p := range sp.Effect.Validate() {
+			add(path+".effect."+p.Field, "%s", p.Msg)
+		}
+	}
+	if len(s.Troops) < 3 {
+		add("troops", "need at least 3 troops to deal a hand, got %d", len(s.Troops))
+	}
+	unlocked := 0
+	for _, t := range s.Troops {
+		if !t.Locked {
+			unlocked++
+		}
+	}
+	if len(s.Troops) >= 3 && unlocked < 3 {
+		add("troops", "need at least 3 troops that are not locked so new players can be dealt a hand, got %d", unlocked)
+	}
+	return problems
+}
+
+// indexJSON walks data alongside the Go type it decodes into. It returns the offset of
+// every value by JSON path and reports keys that type does not have.
+func indexJSON(data []byte, t reflect.Type) (map[string]int64, []specProblem) {
+	offsets := map[string]int64{}
+	var problems []specProblem
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string, t reflect.Type) error
+	walk = func(path string, t reflect.Type) error {
+		for t != nil && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		offsets[path] = skipSeparators(data, dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			fields := jsonFields(t)
+			for dec.More() {
+				keyAt := skipSeparators(data, dec.InputOffset())
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				name := key.(string)
+				child := name
+				if path != "" {
+					child = path + "." + name
+				}
+				ft, known := fields[name]
+				if fields != nil && !known {
+					msg := "unknown field"
+					if hint, ok := specKeyHints[name]; ok {
+						msg += ": " + hint
+					}
+					problems = append(problems, specProblem{child, keyAt, msg})
+				}
+				if err := walk(child, ft); err != nil {
+					return err
+				}
+			}
+		case json.Delim('['):
+			var elem reflect.Type
+			if t != nil && t.Kind() == reflect.Slice {
+				elem = t.Elem()
+			}
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", path, i), elem); err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+		_, err = dec.Token() // closing delimiter
+		return err
+	}
+	walk("", t)
+	return offsets, problems
+}
+
+// jsonFields returns the json keys of a struct type and their types, or nil for other types
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// skipSeparators moves an offset past whitespace, commas and colons to the next token
+func skipSeparators(data []byte, off int64) int64 {
+	for off < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+// locate turns problems into a SpecError with line numbers and source lines
+// A problem without an offset uses its path, or the nearest enclosing path that has one.
+func locate(data []byte, offsets map[string]int64, problems []specProblem) *SpecError {
+	lines := bytes.Split(data, []byte("\n"))
+	e := &SpecError{}
+	for _, p := range problems {
+		off := p.offset
+		for path := p.path; off < 0; path = parentPath(path) {
+			if o, ok := offsets[path]; ok {
+				off = o
+			} else if path == "" {
+				break
+			}
+		}
+		issue := SpecIssue{Path: p.path, Msg: p.msg}
+		if off >= 0 {
+			if off > int64(len(data)) {
+				off = int64(len(data))
+			}
+			issue.Line = bytes.Count(data[:off], []byte("\n")) + 1
+			issue.Source = strings.TrimSpace(string(lines[issue.Line-1]))
+		}
+		e.Problems = append(e.Problems, issue)
+	}
+	// In file order; problems without a line stay first
+	sort.SliceStable(e.Problems, func(i, j int) bool { return e.Problems[i].Line < e.Problems[j].Line })
+	return e
+}
+
+// indexPath writes a path from encoding/json (towers.0.hp) the way problems are reported (towers[0].hp)
+func indexPath(field string) string {
+	var sb strings.Builder
+	for i, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			sb.WriteString("[" + part + "]")
+			continue
+		}
+		if i > 0 {
+			sb.WriteString(".")
+		}
+		sb.WriteString(part)
+	}
+	return sb.String()
+}
+
+// parentPath drops the last element of a JSON path: troops[2].ability -> troops[2] -> troops -> ""
+func parentPath(path string) string {
+	if i := strings.LastIndexAny(path, ".["); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// runSpecsCommand implements "server specs validate [flags] [file]". Without a file it checks
+// the specs file the server would load, from data/config.json (or -config) and -specs-file.
+func runSpecsCommand(args []string) {
+	const usage = "Usage: server specs validate [-config file] [-specs-file file] [file]"
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("specs validate", flag.ExitOnError)
+	cfg, err := loadConfig(fs, args[1:])
+	if err != nil {
+		fmt.Println("Error in configuration:", err)
+		os.Exit(1)
+	}
+	if fs.NArg() > 1 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+	path := cfg.SpecsFile
+	if fs.NArg() == 1 {
+		path = fs.Arg(0)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	set, err := parseSpecs(data)
+	var specErr *SpecError
+	if errors.As(err, &specErr) {
+		for _, p := range specErr.Problems {
+			loc := path
+			if p.Line > 0 {
+				loc = fmt.Sprintf("%s:%d", path, p.Line)
+			}
+			if p.Path != "" {
+				fmt.Printf("%s: %s: %s\n", loc, p.Path, p.Msg)
+			} else {
+				fmt.Printf("%s: %s\n", loc, p.Msg)
+			}
+			if p.Source != "" {
+				fmt.Printf("    %4d | %s\n", p.Line, p.Source)
+			}
+		}
+		fmt.Printf("%d problem(s) found\n", len(specErr.Problems))
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK (%d towers, %d troops, %d spells)\n", path, len(set.Towers), len(set.Troops), len(set.Spells))
+}
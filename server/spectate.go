@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/SinhVienHoBui/text-based-clash-royale/engine"
+)
+
+// startSpectating subscribes username to a running room's event stream
+// Returns the reply for the SPECTATE command
+func startSpectating(roomID, username string) string {
+	roomsLock.Lock()
+	defer roomsLock.Unlock()
+	room, ok := gameRooms[roomID]
+	if !ok || !room.Started || room.Guest == "" {
+		return errMsg(codeRoomUnavailable, "No running game in that room")
+	}
+	if room.Host == username || room.Guest == username {
+		return errMsg(codeInGame, "You are playing in that room")
+	}
+	if room.Spectators == nil {
+		room.Spectators = map[string]bool{}
+	}
+	room.Spectators[username] = true
+	return "ACK|SPECTATING|" + roomID + "|" + room.Mode
+}
+
+// sendSpectatorState pushes a room's current state to a new spectator
+// Spectators see exactly what both players see: the shared state, no private data
+func sendSpectatorState(roomID, username string) {
+	// A draft room has no match yet; the draft is its state until the picks are done
+	draftsLock.Lock()
+	if d, ok := drafts[roomID]; ok {
+		sendToUser(username, d.message(""))
+	}
+	draftsLock.Unlock()
+	enhancedGamesLock.Lock()
+	if gs, ok := enhancedGames[roomID]; ok {
+		sendToUser(username, enhancedStateMessage(gs))
+	}
+	enhancedGamesLock.Unlock()
+	gamesLock.Lock()
+	if g, ok := games[roomID]; ok {
+		sendSimpleState(username, g)
+		sendToUser(username, "TURN|"+g.TurnUser+"'s turn")
+	}
+	gamesLock.Unlock()
+}
+
+// stopSpectating removes username from whichever room they are watching
+func stopSpectating(username string) {
+	roomsLock.Lock()
+	defer roomsLock.Unlock()
+	for _, room := range gameRooms {
+		delete(room.Spectators, username)
+	}
+}
+
+// isSpectating reports whether username is watching any room
+func isSpectating(username string) bool {
+	roomsLock.Lock()
+	defer roomsLock.Unlock()
+	for _, room := range gameRooms {
+		if room.Spectators[username] {
+			return true
+		}
+	}
+	return false
+}
+
+// sendToSpectators sends a message to everyone watching a room
+func sendToSpectators(roomID, msg string) {
+	for _, uname := range spectatorsOf(roomID) {
+		sendToUser(uname, msg)
+	}
+}
+
+// spectatorsOf returns the usernames watching a room
+func spectatorsOf(roomID string) []string {
+	roomsLock.Lock()
+	defer roomsLock.Unlock()
+	var watchers []string
+	if room, ok := gameRooms[roomID]; ok {
+		for uname := range room.Spectators {
+			watchers = append(watchers, uname)
+		}
+	}
+	return watchers
+}
+
+// spectatorGameEnd returns the GAME_END line shown to spectators
+func spectatorGameEnd(ev engine.Event) string {
+	if ev.Winner == engine.Draw {
+		return fmt.Sprintf("GAME_END|Draw (%s)|SEED:%d", ev.Reason, ev.Seed)
+	}
+	return fmt.Sprintf("GAME_END|%s wins (%s)|SEED:%d", ev.Winner, ev.Reason, ev.Seed)
+}
+
+// listLiveRooms returns "id:host:guest:mode:spectators" entries for rooms with a match in progress
+func listLiveRooms() []string {
+	roomsLock.Lock()
+	defer roomsLock.Unlock()
+	var live []string
+	for id, room := range gameRooms {
+		if room.Started && room.Guest != "" {
+			live = append(live, fmt.Sprintf("%s:%s:%s:%s:%d", id, room.Host, room.Guest, room.Mode, len(room.Spectators)))
+		}
+	}
+	sort.Strings(live)
+	return live
+}
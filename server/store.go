@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// UserStore persists user accounts and progress
+type UserStore interface {
+	Get(username string) (User, bool) // Look up a user by name
+	Create(u User) error              // Add a new user, ErrUserExists if the name is taken
+	Update(u User) error              // Replace an existing user, ErrUserNotFound if missing
+	// Modify reads a user, lets change edit it and saves the result, all under the store's
+	// lock, so concurrent writers never undo each other. Nothing is saved if change fails.
+	Modify(username string, change func(u *User) error) error
+	List() []User // All users sorted by username
+	Close() error
+}
+
+var (
+	ErrUserExists   = errors.New("username taken")
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// userStore is the store selected at startup
+var userStore UserStore
+
+// openUserStore opens the store implementation named by kind ("json" or "log")
+func openUserStore(kind string) (UserStore, error) {
+	switch kind {
+	case "json":
+		return openJSONFileStore(config.UsersFile)
+	case "log":
+		return openLogStore(config.UsersLogFile, config.UsersFile)
+	}
+	return nil, fmt.Errorf("unknown user store %q (want json or log)", kind)
+}
+
+// sortedUsers returns copies of the users of m sorted by username
+func sortedUsers(m map[string]User) []User {
+	out := make([]User, 0, len(m))
+	for _, u := range m {
+		out = append(out, cloneUser(u))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Username < out[j].Username })
+	return out
+}
+
+// cloneUser returns a copy of u that shares no maps or slices with it. Stores keep and hand
+// out only copies, so callers can never change a cached user outside the store's lock.
+func cloneUser(u User) User {
+	u.TowerLv = cloneLevels(u.TowerLv)
+	u.TroopLv = cloneLevels(u.TroopLv)
+	u.History = append([]MatchRecord(nil), u.History...)
+	u.Cards = append([]string(nil), u.Cards...)
+	if u.Decks != nil {
+		decks := make(map[string][]string, len(u.Decks))
+		for name, cards := range u.Decks {
+			decks[name] = append([]string(nil), cards...)
+		}
+		u.Decks = decks
+	}
+	return u
+}
+
+func cloneLevels(levels map[string]int) map[string]int {
+	if levels == nil {
+		return nil
+	}
+	out := make(map[string]int, len(levels))
+	for name, lv := range levels {
+		out[name] = lv
+	}
+	return out
+}
+
+// writeFileAtomic writes data to a temp file in the same directory and renames it over path,
+// so readers and crashes only ever see the old or the new file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after a successful rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// JSONFileStore keeps users in memory and rewrites data/users.json atomically on every change
+type JSONFileStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[string]User
+	order []string // file order, preserved on rewrite
+}
+
+func openJSONFileStore(path string) (*JSONFileStore, error) {
+	s := &JSONFileStore{path: path, users: map[string]User{}}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var users UsersData
+		if err := json.Unmarshal(data, &users); err != nil {
+			return nil, fmt.Errorf("parse %s: %v", path, err)
+		}
+		for _, u := range users.Users {
+			if _, dup := s.users[u.Username]; !dup {
+				s.order = append(s.order, u.Username)
+			}
+			s.users[u.Username] = u
+		}
+	}
+	return s, nil
+}
+
+func (s *JSONFileStore) Get(username string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	return cloneUser(u), ok
+}
+
+func (s *JSONFileStore) Create(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[u.Username]; ok {
+		return ErrUserExists
+	}
+	s.users[u.Username] = cloneUser(u)
+	s.order = append(s.order, u.Username)
+	if err := s.flush(); err != nil {
+		delete(s.users, u.Username)
+		s.order = s.order[:len(s.order)-1]
+		return err
+	}
+	return nil
+}
+
+func (s *JSONFileStore) Update(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[u.Username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	s.users[u.Username] = cloneUser(u)
+	if err := s.flush(); err != nil {
+		s.users[u.Username] = old
+		return err
+	}
+	return nil
+}
+
+func (s *JSONFileStore) Modify(username string, change func(u *User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u := cloneUser(old)
+	if err := change(&u); err != nil {
+		return err
+	}
+	u.Username = username
+	s.users[username] = u
+	if err := s.flush(); err != nil {
+		s.users[username] = old
+		return err
+	}
+	return nil
+}
+
+func (s *JSONFileStore) List() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedUsers(s.users)
+}
+
+func (s *JSONFileStore) Close() error { return nil }
+
+// flush writes the cache to disk, caller holds s.mu
+func (s *JSONFileStore) flush() error {
+	users := UsersData{Users: make([]User, 0, len(s.order))}
+	for _, name := range s.order {
+		users.Users = append(users.Users, s.users[name])
+	}
+	out, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, out)
+}
+
+// LogStore is an append-only log of user records, one JSON object per line.
+// The latest record for a username wins; a torn final line from a crash is ignored on replay.
+type LogStore struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	users map[string]User
+}
+
+// openLogStore replays the log at path, seeding it from the JSON users file the first time
+func openLogStore(path, seedJSON string) (*LogStore, error) {
+	s := &LogStore{path: path, users: map[string]User{}}
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			var u User
+			if json.Unmarshal(scanner.Bytes(), &u) != nil || u.Username == "" {
+				continue // Skip a torn or corrupt record
+			}
+			s.users[u.Username] = u
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err):
+		// First start with the log store: import the existing users
+		if seed, err := openJSONFileStore(seedJSON); err == nil {
+			for _, u := range seed.List() {
+				s.users[u.Username] = u
+			}
+		}
+	default:
+		return nil, err
+	}
+	// Compact on startup so the log holds one record per user
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compact rewrites the log with the current records and reopens it for appending
+func (s *LogStore) compact() error {
+	var buf []byte
+	for _, u := range sortedUsers(s.users) {
+		line, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	if err := writeFileAtomic(s.path, buf); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	return nil
+}
+
+// appendRecord writes one user record to the end of the log, caller holds s.mu
+func (s *LogStore) appendRecord(u User) error {
+	line, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *LogStore) Get(username string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	return cloneUser(u), ok
+}
+
+func (s *LogStore) Create(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[u.Username]; ok {
+		return ErrUserExists
+	}
+	if err := s.appendRecord(u); err != nil {
+		return err
+	}
+	s.users[u.Username] = cloneUser(u)
+	return nil
+}
+
+func (s *LogStore) Update(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[u.Username]; !ok {
+		return ErrUserNotFound
+	}
+	if err := s.appendRecord(u); err != nil {
+		return err
+	}
+	s.users[u.Username] = cloneUser(u)
+	return nil
+}
+
+func (s *LogStore) Modify(username string, change func(u *User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u := cloneUser(old)
+	if err := change(&u); err != nil {
+		return err
+	}
+	u.Username = username
+	if err := s.appendRecord(u); err != nil {
+		return err
+	}
+	s.users[username] = u
+	return nil
+}
+
+func (s *LogStore) List() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedUsers(s.users)
+}
+
+func (s *LogStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
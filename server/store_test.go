@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// storeKinds opens each UserStore implementation on files in dir; calling open again
+// reopens the same files, as a restart would
+var storeKinds = []struct {
+	name string
+	open func(dir string) (UserStore, error)
+}{
+	{"json", func(dir string) (UserStore, error) {
+		return openJSONFileStore(filepath.Join(dir, "users.json"))
+	}},
+	{"log", func(dir string) (UserStore, error) {
+		return openLogStore(filepath.Join(dir, "users.log"), filepath.Join(dir, "users.json"))
+	}},
+}
+
+// testUser returns a user with every map and slice filled in
+func testUser() User {
+	return User{
+		Username: "idea", Password: "hash", EXP: 40, Level: 2, Gold: 300, Rating: 1210,
+		TowerLv:    map[string]int{"King": 2},
+		TroopLv:    map[string]int{"Knight": 3},
+		History:    []MatchRecord{{Opponent: "thao", Result: "win"}},
+		Cards:      []string{"Wizard"},
+		Decks:      map[string][]string{"main": {"Pawn", "Knight", "Wizard"}},
+		ActiveDeck: "main",
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	for _, kind := range storeKinds {
+		t.Run(kind.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := kind.open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := testUser()
+			if err := s.Create(want); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Create(User{Username: "idea"}); !errors.Is(err, ErrUserExists) {
+				t.Errorf("second Create = %v, want ErrUserExists", err)
+			}
+			if err := s.Update(User{Username: "nobody"}); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("Update of a missing user = %v, want ErrUserNotFound", err)
+			}
+			want.Gold = 500
+			if err := s.Update(want); err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := s.Get("idea"); !ok || !reflect.DeepEqual(got, want) {
+				t.Errorf("Get = %+v, %v, want %+v", got, ok, want)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = kind.open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if got, ok := s.Get("idea"); !ok || !reflect.DeepEqual(got, want) {
+				t.Errorf("Get after reopening = %+v, %v, want %+v", got, ok, want)
+			}
+			if users := s.List(); len(users) != 1 {
+				t.Errorf("List has %d users, want 1", len(users))
+			}
+		})
+	}
+}
+
+func TestLogStoreReplayLastWriteWins(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.log")
+	log := `{"username":"idea","password":"a","gold":100}
+{"username":"thao","password":"b","gold":7}
+{"username":"idea","password":"a","gold":250}
+{"username":"idea","password":"a","go`
+	if err := ioutil.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openLogStore(path, filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if u, _ := s.Get("idea"); u.Gold != 250 {
+		t.Errorf("idea has %d gold, want 250 from the last whole record", u.Gold)
+	}
+	if u, _ := s.Get("thao"); u.Gold != 7 {
+		t.Errorf("thao has %d gold, want 7", u.Gold)
+	}
+}
+
+func TestStoreModify(t *testing.T) {
+	for _, kind := range storeKinds {
+		t.Run(kind.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := kind.open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := testUser()
+			if err := s.Create(want); err != nil {
+				t.Fatal(err)
+			}
+
+			failed := errors.New("not enough gold")
+			err = s.Modify("idea", func(u *User) error {
+				u.Gold = 0
+				u.TroopLv["Knight"] = 9
+				u.Decks["main"][0] = "Rook"
+				u.Cards = append(u.Cards, "Witch")
+				return failed
+			})
+			if err != failed {
+				t.Fatalf("Modify = %v, want the callback's error", err)
+			}
+			if got, _ := s.Get("idea"); !reflect.DeepEqual(got, want) {
+				t.Errorf("failed Modify changed the user to %+v", got)
+			}
+
+			err = s.Modify("idea", func(u *User) error {
+				u.Gold += 50
+				u.TroopLv["Knight"]++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want.Gold, want.TroopLv = 350, map[string]int{"Knight": 4}
+			if err := s.Modify("nobody", func(*User) error { return nil }); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("Modify of a missing user = %v, want ErrUserNotFound", err)
+			}
+			s.Close()
+
+			s, err = kind.open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if got, _ := s.Get("idea"); !reflect.DeepEqual(got, want) {
+				t.Errorf("Get after reopening = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestStoreHandsOutCopies(t *testing.T) {
+	for _, kind := range storeKinds {
+		t.Run(kind.name, func(t *testing.T) {
+			s, err := kind.open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			created := testUser()
+			if err := s.Create(created); err != nil {
+				t.Fatal(err)
+			}
+			created.TowerLv["King"] = 5 // the caller's user is not the stored one either
+
+			got, _ := s.Get("idea")
+			got.TowerLv["King"] = 9
+			got.TroopLv["Knight"] = 9
+			got.History[0].Result = "loss"
+			got.Cards[0] = "Witch"
+			got.Decks["main"][0] = "Rook"
+			got.Decks["spare"] = nil
+			for _, u := range s.List() {
+				u.TroopLv["Knight"] = 9
+			}
+
+			if again, _ := s.Get("idea"); !reflect.DeepEqual(again, testUser()) {
+				t.Errorf("changing copies changed the store: %+v", again)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLS for the game listener and the HTTP listener, enabled by -tls-cert and -tls-key.
+// "server gencert" writes a self-signed pair for local use; clients pin it with -ca.
+
+// serverTLS is the TLS config of both listeners, nil when serving cleartext
+var serverTLS *tls.Config
+
+// loadTLSConfig loads a certificate and key; both paths empty means TLS is off
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// runGencert implements "server gencert [-cert f] [-key f] [-hosts h1,h2] [-days n]"
+func runGencert(args []string) {
+	fs := flag.NewFlagSet("gencert", flag.ExitOnError)
+	certFile := fs.String("cert", "data/cert.pem", "where to write the certificate")
+	keyFile := fs.String("key", "data/key.pem", "where to write the private key")
+	hosts := fs.String("hosts", "localhost,127.0.0.1,::1", "comma-separated host names and IPs the certificate is valid for")
+	days := fs.Int("days", 365, "validity in days")
+	fs.Parse(args)
+	if err := generateCert(*certFile, *keyFile, strings.Split(*hosts, ","), time.Duration(*days)*24*time.Hour); err != nil {
+		fmt.Println("Error generating certificate:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Wrote", *certFile, "and", *keyFile)
+	fmt.Printf("Start the server with -tls-cert %s -tls-key %s and the client with -tls -ca %s\n", *certFile, *keyFile, *certFile)
+}
+
+// generateCert writes a self-signed ECDSA certificate for hosts and its private key as PEM files
+func generateCert(certFile, keyFile string, hosts []string, validFor time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"TCR self-signed"}},
+		NotBefore:             now.Add(-time.Hour), // tolerate small clock differences
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true, // self-signed: the certificate is its own CA, so clients can pin it with -ca
+	}
+	for _, h := range hosts {
+		h = strings.TrimSpace(h)
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})); err != nil {
+		return err
+	}
+	// The key is created fresh so it is never readable by others, not even briefly
+	if err := os.Remove(keyFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Card/tower upgrades: each tower and troop has its own level per user
+const (
+	maxUnitLevel      = 10
+	upgradeGoldPerLv  = 100 // gold cost to go from level L to L+1 is L * upgradeGoldPerLv
+	upgradeEXPPerLv   = 20  // EXP cost to go from level L to L+1 is L * upgradeEXPPerLv
+	goldForWin        = 50
+	goldForDraw       = 20
+	goldForLoss       = 10
+	unitLevelStatStep = 0.1 // each unit level adds 10% to HP/ATK/DEF
+)
+
+// unitLevel returns the level stored for a unit, defaulting to 1
+func unitLevel(levels map[string]int, name string) int {
+	if lv := levels[name]; lv > 0 {
+		return lv
+	}
+	return 1
+}
+
+// levelMultiplier returns the stat multiplier for a unit at level lv
+func levelMultiplier(lv int) float64 {
+	return 1.0 + unitLevelStatStep*float64(lv-1)
+}
+
+// goldForResult returns the gold a player earns at the end of a match
+func goldForResult(winner, username string) int {
+	switch winner {
+	case username:
+		return goldForWin
+	case "DRAW":
+		return goldForDraw
+	}
+	return goldForLoss
+}
+
+// handleUpgrade raises the level of one of the user's towers or troops
+// currency: "GOLD" (default) or "EXP"
+// Returns a string message to send back to the client
+func handleUpgrade(username, name, currency string) string {
+	// Match progress is saved at game end, so upgrades mid-match would be overwritten
+	if _, _, inGame := findActiveGame(username); inGame {
+		return errMsg(codeInGame, "Cannot upgrade during a match")
+	}
+	currency = strings.ToUpper(currency)
+	if currency == "" {
+		currency = "GOLD"
+	}
+	if currency != "GOLD" && currency != "EXP" {
+		return errMsg(codeBadRequest, "Usage: UPGRADE|name|GOLD or EXP")
+	}
+	specs := currentSpecs()
+	_, isTower := specs.Tower(name)
+	_, isTroop := specs.Troop(name)
+	if !isTower && !isTroop {
+		return errMsg(codeUnknownUnit, "No such tower or troop")
+	}
+	// Pay and level up in one locked step, so a failed save or a concurrent write loses nothing
+	var lv, gold, exp int
+	err := userStore.Modify(username, func(u *User) error {
+		if isTroop {
+			if u.TroopLv == nil {
+				u.TroopLv = map[string]int{}
+			}
+			lv = unitLevel(u.TroopLv, name)
+		} else {
+			if u.TowerLv == nil {
+				u.TowerLv = map[string]int{}
+			}
+			lv = unitLevel(u.TowerLv, name)
+		}
+		if lv >= maxUnitLevel {
+			return &codedError{codeMaxLevel, fmt.Sprintf("%s is already at max level %d", name, maxUnitLevel)}
+		}
+		if currency == "GOLD" {
+			cost := lv * upgradeGoldPerLv
+			if u.Gold < cost {
+				return &codedError{codeNoGold, fmt.Sprintf("Not enough gold (need %d, have %d)", cost, u.Gold)}
+			}
+			u.Gold -= cost
+		} else {
+			cost := lv * upgradeEXPPerLv
+			if u.EXP < cost {
+				return &codedError{codeNoEXP, fmt.Sprintf("Not enough EXP (need %d, have %d)", cost, u.EXP)}
+			}
+			u.EXP -= cost
+		}
+		if isTroop {
+			u.TroopLv[name] = lv + 1
+		} else {
+			u.TowerLv[name] = lv + 1
+		}
+		gold, exp = u.Gold, u.EXP
+		return nil
+	})
+	var coded *codedError
+	switch {
+	case errors.As(err, &coded), errors.Is(err, ErrUserNotFound):
+		return errorReply(err)
+	case err != nil:
+		return errMsg(codeStorage, "Cannot save upgrade")
+	}
+	return fmt.Sprintf("ACK|UPGRADED|%s|%d|GOLD:%d|EXP:%d", name, lv+1, gold, exp)
+}
+
+// handleProfile returns the user's progress, currencies and unit levels as JSON
+func handleProfile(username string) string {
+	progress := loadProgress(username)
+	out, _ := json.Marshal(progress)
+	return "PROFILE|" + string(out)
+}
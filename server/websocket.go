@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"embed"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Browser gateway: an optional HTTP listener that serves the web client and the read-only
+// API (api.go), and upgrades /ws to a WebSocket. Each text frame is one protocol line, so
+// a WebSocket runs through the same handleConnection as a TCP client.
+
+//go:embed web
+var webFiles embed.FS
+
+// websocketGUID is the fixed key suffix from RFC 6455 section 1.3
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsMaxMessage = 1 << 20 // largest message accepted from a browser
+)
+
+// httpMux returns the routes of the HTTP listener
+func httpMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", serveWebSocket)
+	registerAPI(mux)
+	static, _ := fs.Sub(webFiles, "web")
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	return mux
+}
+
+// startHTTP serves the web client and the WebSocket gateway on addr, over TLS when the game listener uses it
+func startHTTP(addr string) {
+	srv := &http.Server{Addr: addr, Handler: httpMux(), TLSConfig: serverTLS}
+	var err error
+	if serverTLS != nil {
+		fmt.Println("HTTPS listening on", addr)
+		err = srv.ListenAndServeTLS("", "") // certificate comes from TLSConfig
+	} else {
+		fmt.Println("HTTP listening on", addr)
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		fmt.Println("HTTP server error:", err)
+	}
+}
+
+// serveWebSocket performs the RFC 6455 opening handshake and hands the connection to handleConnection
+func serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	// Only pages served from this host may open a socket
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "cross-origin WebSocket refused", http.StatusForbidden)
+			return
+		}
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	handleConnection(&wsConn{Conn: conn, br: rw.Reader})
+}
+
+// headerHasToken reports whether a comma-separated header contains token (case-insensitive)
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn adapts a WebSocket to net.Conn: Read yields each received message followed by
+// a newline and each Write is sent as one text message.
+type wsConn struct {
+	net.Conn // hijacked connection, used for addresses, deadlines and Close
+	br       *bufio.Reader
+	pending  []byte // part of the current message not yet returned by Read
+	wmu      sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = append(msg, '\n')
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	msg := p
+	if len(msg) > 0 && msg[len(msg)-1] == '\n' {
+		msg = msg[:len(msg)-1] // the frame boundary replaces the line ending
+	}
+	if err := c.writeFrame(wsOpText, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.writeFrame(wsOpClose, nil)
+	return c.Conn.Close()
+}
+
+// readMessage returns the next complete text or binary message, answering pings on the way
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpPing:
+			c.writeFrame(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			return nil, io.EOF
+		case wsOpText, wsOpBinary, wsOpContinuation:
+			msg = append(msg, payload...)
+			if len(msg) > wsMaxMessage {
+				return nil, errors.New("websocket message too large")
+			}
+			if fin {
+				return msg, nil
+			}
+		default:
+			return nil, fmt.Errorf("unknown websocket opcode %d", op)
+		}
+	}
+}
+
+// readFrame reads one frame; frames from browsers are always masked
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	op := head[0] & 0x0F
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked websocket frame from client")
+	}
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > wsMaxMessage {
+		return false, 0, nil, errors.New("websocket frame too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame sends one unfragmented, unmasked frame
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	head := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xFFFF:
+		head = append(head, 126, byte(n>>8), byte(n))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	if _, err := c.Conn.Write(append(head, payload...)); err != nil {
+		return err
+	}
+	return nil
+}